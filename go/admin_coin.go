@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// adminGrantCoins ユーザにISU-COINを付与する
+// POST /admin/user/{userID}/coins
+func (h *Handler) adminGrantCoins(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(AdminGrantCoinsRequest)
+	if err = parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.Amount <= 0 {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidRequestBody)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	tx, err := c.Get("db").(*sqlx.DB).Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err = h.creditCoins(tx, userID, req.Amount, CoinReasonAdminGrant, nil, requestAt); err != nil {
+		if err == ErrUserNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	transaction := new(UserCoinTransaction)
+	query := "SELECT * FROM user_coin_transactions WHERE user_id=? ORDER BY seq DESC LIMIT 1"
+	if err = tx.Get(transaction, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminGrantCoinsResponse{
+		Transaction: transaction,
+	})
+}
+
+type AdminGrantCoinsRequest struct {
+	Amount int64 `json:"amount"`
+}
+
+type AdminGrantCoinsResponse struct {
+	Transaction *UserCoinTransaction `json:"transaction"`
+}
+
+// adminReconcileCoins 全シャードのISU-COINの台帳と残高を突き合わせる
+// GET /admin/coins/reconciliation
+func (h *Handler) adminReconcileCoins(c echo.Context) error {
+	discrepancies, err := h.reconcileCoins()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminReconcileCoinsResponse{
+		Consistent:    len(discrepancies) == 0,
+		Discrepancies: discrepancies,
+	})
+}
+
+type AdminReconcileCoinsResponse struct {
+	Consistent    bool               `json:"consistent"`
+	Discrepancies []*CoinDiscrepancy `json:"discrepancies"`
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// adminReplayGachaDraw 保存されたシードと抽選時のマスタからガチャの抽選を再現し、記録された結果と一致するか確かめる
+// POST /admin/user/{userID}/gacha/draws/{drawID}/replay
+func (h *Handler) adminReplayGachaDraw(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	drawID, err := strconv.ParseInt(c.Param("drawID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	draw := new(UserGachaDraw)
+	query := "SELECT * FROM user_gacha_draws WHERE id=? AND user_id=?"
+	if err = c.Get("db").(*sqlx.DB).Get(draw, query, drawID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrGachaDrawNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	recorded := make([]int64, 0, draw.DrawCount)
+	if err = json.Unmarshal([]byte(draw.Result), &recorded); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	items, err := replayGachaDraw(draw)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	replayed := gachaItemIDs(items)
+
+	matched := len(recorded) == len(replayed)
+	for i := 0; matched && i < len(recorded); i++ {
+		matched = recorded[i] == replayed[i]
+	}
+
+	return successResponse(c, &AdminReplayGachaDrawResponse{
+		Draw:         draw,
+		SeedVerified: verifyGachaSeed(h.GachaSecret, draw.ID, draw.Seed),
+		Recorded:     recorded,
+		Replayed:     replayed,
+		Items:        items,
+		Matched:      matched,
+	})
+}
+
+type AdminReplayGachaDrawResponse struct {
+	Draw *UserGachaDraw `json:"draw"`
+	// SeedVerified シードが今の秘密鍵と抽選IDから作られたものか
+	SeedVerified bool               `json:"seedVerified"`
+	Recorded     []int64            `json:"recorded"`
+	Replayed     []int64            `json:"replayed"`
+	Items        []*GachaItemMaster `json:"items"`
+	// Matched 再現した結果が記録された結果と一致したか
+	Matched bool `json:"matched"`
+}
+
+// adminValidateGachaRates 有効なマスタの全てのガチャについて、排出率と開示するうえで問題のある点を返す
+// GET /admin/gacha/rates
+func (h *Handler) adminValidateGachaRates(c echo.Context) error {
+	masters, err := h.masterStore()
+	if err != nil {
+		if err == ErrActiveMasterVersionNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	valid := true
+	rates := make([]*AdminGachaRates, 0)
+	for _, v := range masters.Gachas() {
+		// ステップアップガチャはステップごと、ボックスガチャは在庫が全て残っている状態で確認する
+		steps := 1
+		if v.GachaType == GachaTypeStepUp && len(v.StepPrices()) > 0 {
+			steps = len(v.StepPrices())
+		}
+		for step := 1; step <= steps; step++ {
+			r := computeGachaRates(v, gachaPool(v, masters.GachaItems(v.ID), &UserGachaState{Step: step}, nil))
+			problems := r.problems()
+			valid = valid && len(problems) == 0
+			rates = append(rates, &AdminGachaRates{
+				GachaRates: r,
+				Step:       step,
+				Valid:      len(problems) == 0,
+				Problems:   problems,
+			})
+		}
+	}
+
+	return successResponse(c, &AdminValidateGachaRatesResponse{
+		MasterVersion: masters.Version.MasterVersion,
+		Valid:         valid,
+		Gachas:        rates,
+	})
+}
+
+type AdminValidateGachaRatesResponse struct {
+	MasterVersion string             `json:"masterVersion"`
+	Valid         bool               `json:"valid"`
+	Gachas        []*AdminGachaRates `json:"gachas"`
+}
+
+type AdminGachaRates struct {
+	*GachaRates
+	// Step ステップアップガチャのステップ。それ以外は1
+	Step int `json:"step"`
+	// Valid 問題が無いか
+	Valid    bool     `json:"valid"`
+	Problems []string `json:"problems"`
+}
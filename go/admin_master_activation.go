@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// adminListMasterActivations 予約中のマスタバージョン切り替え一覧
+// GET /admin/master/activations
+func (h *Handler) adminListMasterActivations(c echo.Context) error {
+	activations := make([]*MasterVersionActivation, 0)
+	query := "SELECT * FROM master_version_activations WHERE status=? ORDER BY activate_at ASC, id ASC"
+	if err := h.DB.Select(&activations, query, ActivationStatusPending); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminListMasterActivationsResponse{
+		Activations: activations,
+	})
+}
+
+type AdminListMasterActivationsResponse struct {
+	Activations []*MasterVersionActivation `json:"activations"`
+}
+
+// adminScheduleMasterActivation マスタバージョンの切り替えを予約する
+// POST /admin/master/activations
+func (h *Handler) adminScheduleMasterActivation(c echo.Context) error {
+	defer c.Request().Body.Close()
+	req := new(AdminScheduleMasterActivationRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.ActivateAt <= 0 || req.GraceSeconds < 0 {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidRequestBody)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	version := new(VersionMaster)
+	if err = h.DB.Get(version, "SELECT * FROM version_masters WHERE id=?", req.VersionMasterID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found version master"))
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if version.Status == 1 {
+		return errorResponse(c, http.StatusConflict, ErrMasterVersionAlreadyActive)
+	}
+
+	aID, err := h.generateID()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	activation := &MasterVersionActivation{
+		ID:              aID,
+		VersionMasterID: version.ID,
+		MasterVersion:   version.MasterVersion,
+		ActivateAt:      req.ActivateAt,
+		GraceSeconds:    req.GraceSeconds,
+		Status:          ActivationStatusPending,
+		CreatedAt:       requestAt,
+		UpdatedAt:       requestAt,
+	}
+	query := "INSERT INTO master_version_activations(id, version_master_id, master_version, previous_master_version, activate_at, grace_seconds, status, message, created_at, updated_at)" +
+		" VALUES (:id, :version_master_id, :master_version, :previous_master_version, :activate_at, :grace_seconds, :status, :message, :created_at, :updated_at)"
+	if _, err = h.DB.NamedExec(query, activation); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminMasterActivationResponse{
+		Activation: activation,
+	})
+}
+
+type AdminScheduleMasterActivationRequest struct {
+	VersionMasterID int64 `json:"versionMasterId"`
+	ActivateAt      int64 `json:"activateAt"`
+	// GraceSeconds 切り替え後に前のマスタバージョンを受け付ける秒数
+	GraceSeconds int64 `json:"graceSeconds"`
+}
+
+type AdminMasterActivationResponse struct {
+	Activation *MasterVersionActivation `json:"activation"`
+}
+
+// adminCancelMasterActivation マスタバージョン切り替えの予約を取り消す
+// DELETE /admin/master/activations/{activationID}
+func (h *Handler) adminCancelMasterActivation(c echo.Context) error {
+	activationID, err := strconv.ParseInt(c.Param("activationID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	query := "UPDATE master_version_activations SET status=?, updated_at=? WHERE id=? AND status=?"
+	res, err := h.DB.Exec(query, ActivationStatusCancelled, requestAt, activationID, ActivationStatusPending)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	} else if n == 0 {
+		return errorResponse(c, http.StatusNotFound, ErrActivationNotFound)
+	}
+
+	activation := new(MasterVersionActivation)
+	if err = h.DB.Get(activation, "SELECT * FROM master_version_activations WHERE id=?", activationID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminMasterActivationResponse{
+		Activation: activation,
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MasterExportFormatCSV  string = "csv"
+	MasterExportFormatJSON string = "json"
+	MasterExportFormatZip  string = "zip"
+)
+
+// adminExportMaster マスタデータをPUT /admin/masterでそのまま読み戻せるCSVなどで書き出す
+// GET /admin/master/export
+func (h *Handler) adminExportMaster(c echo.Context) error {
+	tables := masterTables
+	if name := c.QueryParam("table"); name != "" {
+		t, ok := findMasterTable(name)
+		if !ok {
+			return errorResponse(c, http.StatusNotFound, ErrMasterTableNotFound)
+		}
+		tables = []*masterTable{t}
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = MasterExportFormatZip
+		if len(tables) == 1 {
+			format = MasterExportFormatCSV
+		}
+	}
+	switch format {
+	case MasterExportFormatCSV:
+		if len(tables) != 1 {
+			return errorResponse(c, http.StatusBadRequest, ErrInvalidExportFormat)
+		}
+	case MasterExportFormatJSON, MasterExportFormatZip:
+	default:
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidExportFormat)
+	}
+
+	export, err := h.loadMasterExport(c.Request().Context(), tables, c.QueryParam("master_version"))
+	if err != nil {
+		if err == ErrMasterVersionNotFound || err == ErrActiveMasterVersionNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	switch format {
+	case MasterExportFormatCSV:
+		buf := new(bytes.Buffer)
+		if err = writeMasterCSV(buf, tables[0], export.Rows[tables[0]]); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		return attachmentResponse(c, "text/csv; charset=utf-8", tables[0].FormName+".csv", buf.Bytes())
+
+	case MasterExportFormatZip:
+		buf := new(bytes.Buffer)
+		zw := zip.NewWriter(buf)
+		for _, t := range tables {
+			w, err := zw.Create(t.FormName + ".csv")
+			if err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+			if err = writeMasterCSV(w, t, export.Rows[t]); err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+		}
+		if err = zw.Close(); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		return attachmentResponse(c, "application/zip", fmt.Sprintf("master_%s.zip", export.MasterVersion), buf.Bytes())
+	}
+
+	res := &AdminExportMasterResponse{
+		MasterVersion: export.MasterVersion,
+		Tables:        make(map[string][]map[string]interface{}, len(tables)),
+	}
+	for _, t := range tables {
+		rows := make([]map[string]interface{}, 0, len(export.Rows[t]))
+		for _, row := range export.Rows[t] {
+			v := make(map[string]interface{}, len(t.Columns))
+			for _, col := range t.Columns {
+				v[col.Name] = row[col.Name]
+				if col.Kind == masterColumnBool {
+					v[col.Name] = row.Int(col.Name) != 0
+				}
+			}
+			rows = append(rows, v)
+		}
+		res.Tables[t.Table] = rows
+	}
+	return successResponse(c, res)
+}
+
+type AdminExportMasterResponse struct {
+	MasterVersion string                              `json:"masterVersion"`
+	Tables        map[string][]map[string]interface{} `json:"tables"`
+}
+
+// masterExport 書き出すマスタデータ。行はIDの昇順
+type masterExport struct {
+	MasterVersion string
+	Rows          map[*masterTable][]masterRow
+}
+
+// loadMasterExport マスタバージョンが最後に有効だった時点のマスタデータを読み込む。versionが空なら有効なマスタバージョン
+func (h *Handler) loadMasterExport(ctx context.Context, tables []*masterTable, version string) (*masterExport, error) {
+	// テーブルをまたいで同じ時点の内容を読む
+	tx, err := h.DB.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if version == "" {
+		if version, err = activeMasterVersionName(ctx, tx); err != nil {
+			return nil, err
+		}
+		if version == "" {
+			return nil, ErrActiveMasterVersionNotFound
+		}
+	}
+	until, err := masterVersionPoint(ctx, tx, version)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &masterExport{
+		MasterVersion: version,
+		Rows:          make(map[*masterTable][]masterRow, len(tables)),
+	}
+	for _, t := range tables {
+		rows, err := masterRowsAsOf(ctx, tx, t, until)
+		if err != nil {
+			return nil, err
+		}
+		export.Rows[t] = sortedMasterRows(rows)
+	}
+
+	return export, nil
+}
+
+// writeMasterCSV readFormFileToCSVで読み込める形式で書き出す。1行目は列名
+func writeMasterCSV(w io.Writer, t *masterTable, rows []masterRow) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(t.columnNames()); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := make([]string, 0, len(t.Columns))
+		for _, col := range t.Columns {
+			record = append(record, formatMasterValue(col.Kind, row[col.Name]))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// attachmentResponse ファイルとしてダウンロードさせる
+func attachmentResponse(c echo.Context, contentType, filename string, b []byte) error {
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	return c.Blob(http.StatusOK, contentType, b)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+// adminListMasterVersions マスタ更新の履歴に残っているマスタバージョンの一覧
+// GET /admin/master/versions
+func (h *Handler) adminListMasterVersions(c echo.Context) error {
+	ctx := c.Request().Context()
+	active, err := activeMasterVersionName(ctx, h.DB)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	madeBy := make([]*MasterVersionSummary, 0)
+	query := "SELECT master_version, MAX(seq) AS last_update_seq, MAX(updated_at) AS updated_at, COUNT(*) AS updates" +
+		" FROM master_update_logs WHERE status=? AND master_version<>'' GROUP BY master_version"
+	if err = h.DB.Select(&madeBy, query, MasterUpdateStatusCommitted); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// 最初の更新より前のマスタバージョンは、切り替え前のバージョンとしてだけ残っている
+	leftBy := make([]*MasterVersionSummary, 0)
+	query = "SELECT previous_master_version AS master_version, MAX(seq) AS last_update_seq, MAX(updated_at) AS updated_at, 0 AS updates" +
+		" FROM master_update_logs WHERE status=? AND previous_master_version<>'' GROUP BY previous_master_version"
+	if err = h.DB.Select(&leftBy, query, MasterUpdateStatusCommitted); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	versions := make([]*MasterVersionSummary, 0, len(madeBy))
+	found := map[string]bool{}
+	for _, v := range madeBy {
+		found[v.MasterVersion] = true
+		versions = append(versions, v)
+	}
+	for _, v := range leftBy {
+		if !found[v.MasterVersion] {
+			found[v.MasterVersion] = true
+			versions = append(versions, v)
+		}
+	}
+	if active != "" && !found[active] {
+		versions = append(versions, &MasterVersionSummary{MasterVersion: active})
+	}
+	for _, v := range versions {
+		v.Active = v.MasterVersion == active
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].Active != versions[j].Active {
+			return versions[i].Active
+		}
+		return versions[i].LastUpdateSeq > versions[j].LastUpdateSeq
+	})
+
+	return successResponse(c, &AdminListMasterVersionsResponse{
+		Versions: versions,
+	})
+}
+
+type AdminListMasterVersionsResponse struct {
+	Versions []*MasterVersionSummary `json:"versions"`
+}
+
+type MasterVersionSummary struct {
+	MasterVersion string `json:"masterVersion" db:"master_version"`
+	// LastUpdateSeq このバージョンに関わった最後のマスタ更新のseq
+	LastUpdateSeq int64 `json:"lastUpdateSeq" db:"last_update_seq"`
+	UpdatedAt     int64 `json:"updatedAt" db:"updated_at"`
+	// Updates このバージョンにしたマスタ更新の回数
+	Updates int  `json:"updates" db:"updates"`
+	Active  bool `json:"active" db:"-"`
+}
+
+// adminShowMasterVersionTable マスタバージョンが最後に有効だった時点のテーブルの内容
+// GET /admin/master/versions/{masterVersion}/tables/{table}
+func (h *Handler) adminShowMasterVersionTable(c echo.Context) error {
+	t, ok := findMasterTable(c.Param("table"))
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, ErrMasterTableNotFound)
+	}
+
+	export, err := h.loadMasterExport(c.Request().Context(), []*masterTable{t}, c.Param("masterVersion"))
+	if err != nil {
+		if err == ErrMasterVersionNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminShowMasterVersionTableResponse{
+		MasterVersion: export.MasterVersion,
+		Table:         t.Table,
+		Rows:          export.Rows[t],
+	})
+}
+
+type AdminShowMasterVersionTableResponse struct {
+	MasterVersion string      `json:"masterVersion"`
+	Table         string      `json:"table"`
+	Rows          []masterRow `json:"rows"`
+}
+
+// adminRollbackMaster 全てのマスタを、マスタバージョンが最後に有効だった時点の内容に全シャードで戻す
+// POST /admin/master/versions/{masterVersion}/rollback
+func (h *Handler) adminRollbackMaster(c echo.Context) error {
+	ctx := c.Request().Context()
+	version := c.Param("masterVersion")
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	active, err := activeMasterVersionName(ctx, h.DB)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if version == active {
+		return errorResponse(c, http.StatusConflict, ErrMasterVersionAlreadyActive)
+	}
+
+	target, err := h.loadMasterExport(ctx, masterTables, version)
+	if err != nil {
+		if err == ErrMasterVersionNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	stmts := make([]*masterUpdateStatement, 0, len(masterTables))
+	for _, t := range masterTables {
+		current, err := loadMasterRows(ctx, h.DB, t)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+
+		s := &masterUpdateStatement{
+			Table:   t,
+			Data:    make([]map[string]interface{}, 0),
+			Deletes: make([]int64, 0),
+		}
+		for _, row := range target.Rows[t] {
+			id := row.Int("id")
+			if before, ok := current[id]; ok && masterRowEqual(t, before, row) {
+				delete(current, id)
+				continue
+			}
+			delete(current, id)
+			s.Data = append(s.Data, map[string]interface{}(row))
+		}
+		// 戻し先の時点で無かった行は削除する
+		for id := range current {
+			s.Deletes = append(s.Deletes, id)
+		}
+		if len(s.Data) > 0 || len(s.Deletes) > 0 {
+			stmts = append(stmts, s)
+		}
+	}
+
+	update, err := h.applyMasterUpdate(stmts, version, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if _, err = h.reloadMasterStore(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminMasterUpdateResponse{
+		Update: update,
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// callMasterUpload CSVをマスタ更新のフォームとしてアップロードする
+func callMasterUpload(t *testing.T, h *Handler, query string, files map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	for name, content := range files {
+		part, err := w.CreateFormFile(name, name+".csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = part.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPut, "/admin/master"+query, body)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("requestTime", int64(1656000000))
+	if err := h.adminUpdateMaster(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+func countRows(t *testing.T, db *sqlx.DB, query string) int {
+	t.Helper()
+
+	var n int
+	if err := db.Get(&n, query); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestAdminUpdateMasterRejectsInvalidCSV(t *testing.T) {
+	db := openTestDB(t)
+	h := newTestHandler(t, db)
+
+	if _, err := db.Exec("INSERT INTO version_masters(id, status, master_version) VALUES (1, 1, 'v0')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO item_masters(id, item_type, name) VALUES (1, 3, 'material')"); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]string{
+		"gachaItemMaster": "id,gacha_id,item_type,item_id,amount,weight,created_at\n" +
+			"1,999,3,1,1,10,1656000000\n" +
+			"2,999,3,1,x,10,1656000000\n",
+	}
+
+	// dry-runと同じエラーで書き込まずに拒否する
+	rec := callMasterUpload(t, h, "?dryRun=true", invalid)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("dry-run status %d: %s", rec.Code, rec.Body.String())
+	}
+	dryRun := new(AdminUpdateMasterDryRunResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), dryRun); err != nil {
+		t.Fatal(err)
+	}
+	if dryRun.Valid || len(dryRun.Errors) == 0 {
+		t.Fatalf("dry-run accepted an invalid CSV: %s", rec.Body.String())
+	}
+
+	rec = callMasterUpload(t, h, "", invalid)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid upload returned %d: %s", rec.Code, rec.Body.String())
+	}
+	res := new(AdminUpdateMasterErrorResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Errors) != len(dryRun.Errors) {
+		t.Errorf("upload reported %d errors, dry-run reported %d", len(res.Errors), len(dryRun.Errors))
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM gacha_item_masters"); n != 0 {
+		t.Errorf("%d gacha items were written", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM master_update_logs"); n != 0 {
+		t.Errorf("%d master updates were started", n)
+	}
+
+	// 正しいCSVは書き込まれる
+	valid := map[string]string{
+		"itemMaster": "id,item_type,name,description,amount_per_sec,max_level,max_amount_per_sec,base_exp_per_level,gained_exp,shortening_min\n" +
+			"2,3,material2,desc,,,,,10,\n",
+	}
+	rec = callMasterUpload(t, h, "", valid)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid upload returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM item_masters WHERE id=2"); n != 1 {
+		t.Errorf("valid item was not written")
+	}
+}
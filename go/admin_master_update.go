@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// adminListMasterUpdates マスタ更新の履歴
+// GET /admin/master/updates
+func (h *Handler) adminListMasterUpdates(c echo.Context) error {
+	updates := make([]*MasterUpdateLog, 0)
+	query := "SELECT * FROM master_update_logs ORDER BY seq DESC"
+	if err := h.DB.Select(&updates, query); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminListMasterUpdatesResponse{
+		Updates: updates,
+	})
+}
+
+type AdminListMasterUpdatesResponse struct {
+	Updates []*MasterUpdateLog `json:"updates"`
+}
+
+// adminRepairMasterUpdate 一部のシャードだけコミットされたマスタ更新を残りのシャードでコミットする
+// POST /admin/master/updates/{updateID}/repair
+func (h *Handler) adminRepairMasterUpdate(c echo.Context) error {
+	updateID, err := strconv.ParseInt(c.Param("updateID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	masterUpdateMu.Lock()
+	defer masterUpdateMu.Unlock()
+
+	update := new(MasterUpdateLog)
+	if err = h.DB.Get(update, "SELECT * FROM master_update_logs WHERE id=?", updateID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrMasterUpdateNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if update.Status != MasterUpdateStatusFailed && update.Status != MasterUpdateStatusCommitting {
+		return errorResponse(c, http.StatusConflict, ErrMasterUpdateNotRepairable)
+	}
+
+	if err = h.commitMasterUpdate(update); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if _, err = h.reloadMasterStore(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminMasterUpdateResponse{
+		Update: update,
+	})
+}
+
+type AdminMasterUpdateResponse struct {
+	Update *MasterUpdateLog `json:"update"`
+}
+
+// adminCheckMasterConsistency マスタのテーブルごとに全シャードの内容が一致しているか確認する
+// GET /admin/master/consistency
+func (h *Handler) adminCheckMasterConsistency(c echo.Context) error {
+	res := &AdminMasterConsistencyResponse{
+		Consistent: true,
+		Tables:     make([]*MasterTableConsistency, 0, len(masterTables)),
+	}
+
+	for _, t := range masterTables {
+		tc := &MasterTableConsistency{
+			Table:      t.Table,
+			Consistent: true,
+			Shards:     make([]*MasterShardChecksum, 0, len(h.Shards)),
+		}
+		for i, db := range h.Shards {
+			checksum, rows, err := masterTableChecksum(c.Request().Context(), db, t)
+			if err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+			tc.Shards = append(tc.Shards, &MasterShardChecksum{
+				Shard:    i,
+				Rows:     rows,
+				Checksum: checksum,
+			})
+			if checksum != tc.Shards[0].Checksum {
+				tc.Consistent = false
+				res.Consistent = false
+			}
+		}
+		res.Tables = append(res.Tables, tc)
+	}
+
+	return successResponse(c, res)
+}
+
+type AdminMasterConsistencyResponse struct {
+	Consistent bool                      `json:"consistent"`
+	Tables     []*MasterTableConsistency `json:"tables"`
+}
+
+type MasterTableConsistency struct {
+	Table      string                 `json:"table"`
+	Consistent bool                   `json:"consistent"`
+	Shards     []*MasterShardChecksum `json:"shards"`
+}
+
+type MasterShardChecksum struct {
+	Shard    int    `json:"shard"`
+	Rows     int    `json:"rows"`
+	Checksum string `json:"checksum"`
+}
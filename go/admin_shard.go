@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// adminListShardMigrations シャード移行の一覧
+// GET /admin/shard/migrations
+func (h *Handler) adminListShardMigrations(c echo.Context) error {
+	migrations := make([]*UserShardMigration, 0)
+	query := "SELECT * FROM user_shard_migrations ORDER BY created_at DESC, id DESC"
+	if err := h.DB.Select(&migrations, query); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminListShardMigrationsResponse{
+		Migrations: migrations,
+	})
+}
+
+type AdminListShardMigrationsResponse struct {
+	Migrations []*UserShardMigration `json:"migrations"`
+}
+
+// adminStartShardMigration ユーザを別のシャードへ移行する
+// POST /admin/shard/migrations
+func (h *Handler) adminStartShardMigration(c echo.Context) error {
+	defer c.Request().Body.Close()
+	req := new(AdminStartShardMigrationRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	migration, err := h.Migrator.start(req.UserID, req.TargetShard, requestAt)
+	if err != nil {
+		switch err {
+		case ErrInvalidShard:
+			return errorResponse(c, http.StatusBadRequest, err)
+		case ErrUserNotFound:
+			return errorResponse(c, http.StatusNotFound, err)
+		case ErrMigrationInProgress:
+			return errorResponse(c, http.StatusConflict, err)
+		case ErrMigrationLockTimeout:
+			return errorResponse(c, http.StatusServiceUnavailable, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(http.StatusAccepted, &AdminShardMigrationResponse{
+		Migration: migration,
+	})
+}
+
+type AdminStartShardMigrationRequest struct {
+	UserID      int64 `json:"userId"`
+	TargetShard int   `json:"targetShard"`
+}
+
+type AdminShardMigrationResponse struct {
+	Migration *UserShardMigration `json:"migration"`
+}
+
+// adminShowShardMigration シャード移行の進捗
+// GET /admin/shard/migrations/{migrationID}
+func (h *Handler) adminShowShardMigration(c echo.Context) error {
+	migrationID, err := strconv.ParseInt(c.Param("migrationID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	migration := new(UserShardMigration)
+	if err = h.DB.Get(migration, "SELECT * FROM user_shard_migrations WHERE id=?", migrationID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrMigrationNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminShardMigrationResponse{
+		Migration: migration,
+	})
+}
+
+// adminRollbackShardMigration シャード移行の取り消しを開始する。進捗はadminShowShardMigrationで確認する
+// POST /admin/shard/migrations/{migrationID}/rollback
+func (h *Handler) adminRollbackShardMigration(c echo.Context) error {
+	migrationID, err := strconv.ParseInt(c.Param("migrationID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	migration, err := h.Migrator.rollback(migrationID)
+	if err != nil {
+		switch err {
+		case ErrMigrationNotFound:
+			return errorResponse(c, http.StatusNotFound, err)
+		case ErrMigrationInProgress, ErrMigrationConflict:
+			return errorResponse(c, http.StatusConflict, err)
+		case ErrMigrationLockTimeout:
+			return errorResponse(c, http.StatusServiceUnavailable, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if migration.Status == MigrationStatusRolledBack {
+		return successResponse(c, &AdminShardMigrationResponse{
+			Migration: migration,
+		})
+	}
+
+	return c.JSON(http.StatusAccepted, &AdminShardMigrationResponse{
+		Migration: migration,
+	})
+}
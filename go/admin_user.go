@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
@@ -68,6 +69,48 @@ func (h *Handler) adminUser(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
+	query = "SELECT * FROM user_gacha_pities WHERE user_id=?"
+	gachaPities := make([]*UserGachaPity, 0)
+	if err = c.Get("db").(*sqlx.DB).Select(&gachaPities, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	query = "SELECT * FROM user_gacha_draws WHERE user_id=? ORDER BY created_at DESC, id DESC"
+	gachaDraws := make([]*UserGachaDraw, 0)
+	if err = c.Get("db").(*sqlx.DB).Select(&gachaDraws, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	query = "SELECT * FROM user_gacha_draw_items WHERE user_id=? ORDER BY created_at DESC, draw_id DESC, seq ASC"
+	gachaDrawItems := make([]*UserGachaDrawItem, 0)
+	if err = c.Get("db").(*sqlx.DB).Select(&gachaDrawItems, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	query = "SELECT * FROM user_gacha_states WHERE user_id=?"
+	gachaStates := make([]*UserGachaState, 0)
+	if err = c.Get("db").(*sqlx.DB).Select(&gachaStates, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	query = "SELECT * FROM user_gacha_box_items WHERE user_id=?"
+	gachaBoxItems := make([]*UserGachaBoxItem, 0)
+	if err = c.Get("db").(*sqlx.DB).Select(&gachaBoxItems, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	query = "SELECT * FROM user_coin_transactions WHERE user_id=? ORDER BY seq DESC"
+	coinTransactions := make([]*UserCoinTransaction, 0)
+	if err = c.Get("db").(*sqlx.DB).Select(&coinTransactions, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	query = "SELECT * FROM user_deck_histories WHERE user_id=? ORDER BY created_at DESC, id DESC"
+	deckHistories := make([]*UserDeckHistory, 0)
+	if err = c.Get("db").(*sqlx.DB).Select(&deckHistories, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
 	return successResponse(c, &AdminUserResponse{
 		User:                          user,
 		UserDevices:                   devices,
@@ -77,6 +120,13 @@ func (h *Handler) adminUser(c echo.Context) error {
 		UserLoginBonuses:              loginBonuses,
 		UserPresents:                  presents,
 		UserPresentAllReceivedHistory: presentHistory,
+		UserGachaPities:               gachaPities,
+		UserGachaDraws:                gachaDraws,
+		UserGachaDrawItems:            gachaDrawItems,
+		UserGachaStates:               gachaStates,
+		UserGachaBoxItems:             gachaBoxItems,
+		UserCoinTransactions:          coinTransactions,
+		UserDeckHistories:             deckHistories,
 	})
 }
 
@@ -90,6 +140,13 @@ type AdminUserResponse struct {
 	UserLoginBonuses              []*UserLoginBonus                `json:"userLoginBonuses"`
 	UserPresents                  []*UserPresent                   `json:"userPresents"`
 	UserPresentAllReceivedHistory []*UserPresentAllReceivedHistory `json:"userPresentAllReceivedHistory"`
+	UserGachaPities               []*UserGachaPity                 `json:"userGachaPities"`
+	UserGachaDraws                []*UserGachaDraw                 `json:"userGachaDraws"`
+	UserGachaDrawItems            []*UserGachaDrawItem             `json:"userGachaDrawItems"`
+	UserGachaStates               []*UserGachaState                `json:"userGachaStates"`
+	UserGachaBoxItems             []*UserGachaBoxItem              `json:"userGachaBoxItems"`
+	UserCoinTransactions          []*UserCoinTransaction           `json:"userCoinTransactions"`
+	UserDeckHistories             []*UserDeckHistory               `json:"userDeckHistories"`
 }
 
 // adminBanUser ユーザBAN処理
@@ -125,6 +182,14 @@ func (h *Handler) adminBanUser(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
+	query = "DELETE FROM user_sessions WHERE user_id=?"
+	if _, err = c.Get("db").(*sqlx.DB).Exec(query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if err = h.revokeUserSessions(userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
 	return successResponse(c, &AdminBanUserResponse{
 		User: user,
 	})
@@ -133,3 +198,18 @@ func (h *Handler) adminBanUser(c echo.Context) error {
 type AdminBanUserResponse struct {
 	User *User `json:"user"`
 }
+
+// adminSessionStats セッションディレクトリのヒット率
+// GET /admin/session/stats
+func (h *Handler) adminSessionStats(c echo.Context) error {
+	stats := h.Sessions.Stats()
+	stats.Fallbacks = atomic.LoadInt64(&h.sessionFallbacks)
+
+	return successResponse(c, &AdminSessionStatsResponse{
+		Stats: stats,
+	})
+}
+
+type AdminSessionStatsResponse struct {
+	Stats *SessionStoreStats `json:"stats"`
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"math"
 	"net/http"
 	"strconv"
 
@@ -36,7 +35,7 @@ func (h *Handler) addExpToCard(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	if err = h.checkOneTimeToken(c, req.OneTimeToken, 2, requestAt); err != nil {
+	if err = h.checkOneTimeToken(c, userID, req.OneTimeToken, TokenPurposeCardExp, requestAt); err != nil {
 		if err == ErrInvalidToken {
 			return errorResponse(c, http.StatusBadRequest, err)
 		}
@@ -50,65 +49,30 @@ func (h *Handler) addExpToCard(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	// get target card
-	card := new(TargetUserCardData)
-	query := `
-	SELECT uc.id , uc.user_id , uc.card_id , uc.amount_per_sec , uc.level, uc.total_exp, im.amount_per_sec as 'base_amount_per_sec', im.max_level , im.max_amount_per_sec , im.base_exp_per_level
-	FROM user_cards as uc
-	INNER JOIN item_masters as im ON uc.card_id = im.id
-	WHERE uc.id = ? AND uc.user_id=?
-	`
-	if err = c.Get("db").(*sqlx.DB).Get(card, query, cardID, userID); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, err)
-		}
+	masters, err := h.masterStore()
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	if card.Level == card.MaxLevel {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("target card is max level"))
-	}
-
-	// 消費アイテムの所持チェック
-	items := make([]*ConsumeUserItemData, 0)
-	query = `
-	SELECT ui.id, ui.user_id, ui.item_id, ui.item_type, ui.amount, ui.created_at, ui.updated_at, im.gained_exp
-	FROM user_items as ui
-	INNER JOIN item_masters as im ON ui.item_id = im.id
-	WHERE ui.item_type = 3 AND ui.id=? AND ui.user_id=?
-	`
-	for _, v := range req.Items {
-		item := new(ConsumeUserItemData)
-		if err = c.Get("db").(*sqlx.DB).Get(item, query, v.ID, userID); err != nil {
-			if err == sql.ErrNoRows {
-				return errorResponse(c, http.StatusNotFound, err)
-			}
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-
-		if v.Amount > item.Amount {
-			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("item not enough"))
+	card, items, err := loadAddExpTarget(c.Get("db").(*sqlx.DB), masters, userID, cardID, req.Items)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows, ErrItemNotFound:
+			return errorResponse(c, http.StatusNotFound, err)
+		case ErrNotEnoughExpItem:
+			return errorResponse(c, http.StatusBadRequest, err)
 		}
-		item.ConsumeAmount = v.Amount
-		items = append(items, item)
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	// 経験値付与
-	// 経験値をカードに付与
-	for _, v := range items {
-		card.TotalExp += v.GainedExp * v.ConsumeAmount
+	if card.Level >= card.levelCap() {
+		return errorResponse(c, http.StatusBadRequest, ErrCardMaxLevel)
 	}
 
-	// lv up判定(lv upしたら生産性を加算)
-	for {
-		nextLvThreshold := int(float64(card.BaseExpPerLevel) * math.Pow(1.2, float64(card.Level-1)))
-		if nextLvThreshold > card.TotalExp {
-			break
-		}
-
-		// lv up処理
-		card.Level += 1
-		card.AmountPerSec += (card.MaxAmountPerSec - card.BaseAmountPerSec) / (card.MaxLevel - 1)
+	// 経験値付与(lv upしたら生産性を加算)。最高レベルを超える分は設定に従って扱う
+	result := card.addExp(items, h.ExpOverflowPolicy)
+	if result.Rejected {
+		return errorResponse(c, http.StatusBadRequest, ErrExpOverflow)
 	}
 
 	tx, err := c.Get("db").(*sqlx.DB).Beginx()
@@ -119,7 +83,7 @@ func (h *Handler) addExpToCard(c echo.Context) error {
 	defer tx.Rollback() //nolint:errcheck
 
 	// cardのlvと経験値の更新、itemの消費
-	query = "UPDATE user_cards SET amount_per_sec=?, level=?, total_exp=?, updated_at=? WHERE id=?"
+	query := "UPDATE user_cards SET amount_per_sec=?, level=?, total_exp=?, updated_at=? WHERE id=?"
 	if _, err = tx.Exec(query, card.AmountPerSec, card.Level, card.TotalExp, requestAt, card.ID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
@@ -136,7 +100,7 @@ func (h *Handler) addExpToCard(c echo.Context) error {
 	query = "SELECT * FROM user_cards WHERE id=?"
 	if err = tx.Get(resultCard, query, card.ID); err != nil {
 		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found card"))
+			return errorResponse(c, http.StatusNotFound, ErrCardNotFound)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
@@ -159,6 +123,7 @@ func (h *Handler) addExpToCard(c echo.Context) error {
 	}
 
 	return successResponse(c, &AddExpToCardResponse{
+		WastedExp:        result.WastedExp,
 		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, []*UserCard{resultCard}, nil, resultItems, nil, nil),
 	})
 }
@@ -170,6 +135,8 @@ type AddExpToCardRequest struct {
 }
 
 type AddExpToCardResponse struct {
+	// WastedExp 最高レベルを超えて使われなかった経験値
+	WastedExp        int              `json:"wastedExp"`
 	UpdatedResources *UpdatedResource `json:"updatedResources"`
 }
 
@@ -189,6 +156,56 @@ type ConsumeUserItemData struct {
 	GainedExp int   `db:"gained_exp"`
 
 	ConsumeAmount int // 消費量
+	RefundAmount  int // 最高レベルを超える分として消費しなかった量
+}
+
+// loadAddExpTarget 強化対象のカードと消費アイテムを取得し、所持数を確認する
+func loadAddExpTarget(db *sqlx.DB, masters *MasterStore, userID, cardID int64, consumeItems []*ConsumeItem) (*TargetUserCardData, []*ConsumeUserItemData, error) {
+	// get target card
+	userCard := new(UserCard)
+	query := "SELECT * FROM user_cards WHERE id=? AND user_id=? AND deleted_at IS NULL"
+	if err := db.Get(userCard, query, cardID, userID); err != nil {
+		return nil, nil, err
+	}
+	cardMaster, ok := masters.Item(userCard.CardID)
+	if !ok || cardMaster.AmountPerSec == nil || cardMaster.MaxLevel == nil || cardMaster.MaxAmountPerSec == nil || cardMaster.BaseExpPerLevel == nil {
+		return nil, nil, ErrItemNotFound
+	}
+	curve, ok := masters.LevelCurve(cardMaster.LevelCurveID)
+	if !ok {
+		return nil, nil, ErrItemNotFound
+	}
+	card := newTargetUserCardData(userCard, cardMaster, curve)
+
+	// 消費アイテムの所持チェック
+	items := make([]*ConsumeUserItemData, 0)
+	query = "SELECT * FROM user_items WHERE item_type = 3 AND id=? AND user_id=?"
+	for _, v := range consumeItems {
+		userItem := new(UserItem)
+		if err := db.Get(userItem, query, v.ID, userID); err != nil {
+			return nil, nil, err
+		}
+		itemMaster, ok := masters.Item(userItem.ItemID)
+		if !ok || itemMaster.GainedExp == nil {
+			return nil, nil, ErrItemNotFound
+		}
+
+		if v.Amount > userItem.Amount {
+			return nil, nil, ErrNotEnoughExpItem
+		}
+		items = append(items, &ConsumeUserItemData{
+			ID:            userItem.ID,
+			UserID:        userItem.UserID,
+			ItemID:        userItem.ItemID,
+			ItemType:      userItem.ItemType,
+			Amount:        userItem.Amount,
+			CreatedAt:     userItem.CreatedAt,
+			UpdatedAt:     userItem.UpdatedAt,
+			GainedExp:     *itemMaster.GainedExp,
+			ConsumeAmount: v.Amount,
+		})
+	}
+	return card, items, nil
 }
 
 type TargetUserCardData struct {
@@ -207,9 +224,61 @@ type TargetUserCardData struct {
 	MaxAmountPerSec int `db:"max_amount_per_sec"`
 	// lv1 -> lv2に上がるときのexp
 	BaseExpPerLevel int `db:"base_exp_per_level"`
+
+	// 限界突破した段階
+	LimitBreak int `db:"limit_break"`
+	// 1段階ごとに上がる最高レベル
+	LimitBreakLevels int `db:"limit_break_levels"`
+	// 1段階ごとに上がるlv maxのときの生産性
+	LimitBreakAmountPerSec int `db:"limit_break_amount_per_sec"`
+
+	// 必要経験値と生産性の成長曲線
+	Curve *LevelCurveMaster
+}
+
+// newTargetUserCardData 強化対象のカードとマスタの値
+func newTargetUserCardData(userCard *UserCard, cardMaster *ItemMaster, curve *LevelCurveMaster) *TargetUserCardData {
+	return &TargetUserCardData{
+		ID:                     userCard.ID,
+		UserID:                 userCard.UserID,
+		CardID:                 userCard.CardID,
+		AmountPerSec:           userCard.AmountPerSec,
+		Level:                  userCard.Level,
+		TotalExp:               int(userCard.TotalExp),
+		BaseAmountPerSec:       *cardMaster.AmountPerSec,
+		MaxLevel:               *cardMaster.MaxLevel,
+		MaxAmountPerSec:        *cardMaster.MaxAmountPerSec,
+		BaseExpPerLevel:        *cardMaster.BaseExpPerLevel,
+		LimitBreak:             userCard.LimitBreak,
+		LimitBreakLevels:       cardMaster.LimitBreakLevels,
+		LimitBreakAmountPerSec: cardMaster.LimitBreakAmountPerSec,
+		Curve:                  curve,
+	}
+}
+
+// levelUp 累計経験値で上がれるだけレベルを上げる。限界突破を含めた最高レベルで止まる
+func (c *TargetUserCardData) levelUp() {
+	for c.Level < c.levelCap() {
+		if c.expThreshold(c.Level) > c.TotalExp {
+			break
+		}
+
+		// lv up処理
+		c.Level += 1
+		if c.Level <= c.MaxLevel {
+			c.AmountPerSec += c.Curve.amountGain(c.Level, c.BaseAmountPerSec, c.MaxAmountPerSec, c.MaxLevel)
+		} else {
+			// 限界突破で上がったレベルは1段階分の生産性を均等に加算し、割り切れない分は段階の最後のレベルで加算する
+			c.AmountPerSec += c.LimitBreakAmountPerSec / c.LimitBreakLevels
+			if (c.Level-c.MaxLevel)%c.LimitBreakLevels == 0 {
+				c.AmountPerSec += c.LimitBreakAmountPerSec % c.LimitBreakLevels
+			}
+		}
+	}
 }
 
 // updateDeck 装備変更
+// 枠ごとにデッキを上書きし、編成はuser_deck_historiesに残す。slotを省略すると使っている枠を変更する
 // POST /user/{userID}/card
 func (h *Handler) updateDeck(c echo.Context) error {
 
@@ -228,6 +297,12 @@ func (h *Handler) updateDeck(c echo.Context) error {
 	if len(req.CardIDs) != DeckCardNumber {
 		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid number of cards"))
 	}
+	if req.Slot < 0 || req.Slot > DeckSlotCount {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidDeckSlot)
+	}
+	if len(req.Name) > DeckNameMaxLength {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidDeckName)
+	}
 
 	requestAt, err := getRequestTime(c)
 	if err != nil {
@@ -242,8 +317,8 @@ func (h *Handler) updateDeck(c echo.Context) error {
 	}
 
 	// カード所持情報のバリデーション
-	query := "SELECT * FROM user_cards WHERE id IN (?)"
-	query, params, err := sqlx.In(query, req.CardIDs)
+	query := "SELECT * FROM user_cards WHERE id IN (?) AND user_id=? AND deleted_at IS NULL"
+	query, params, err := sqlx.In(query, req.CardIDs, userID)
 	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
@@ -262,27 +337,53 @@ func (h *Handler) updateDeck(c echo.Context) error {
 
 	defer tx.Rollback() //nolint:errcheck
 
-	// update data
-	query = "UPDATE user_decks SET updated_at=?, deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = tx.Exec(query, requestAt, requestAt, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	slot := req.Slot
+	if slot == 0 {
+		if slot, err = getActiveDeckSlot(tx, userID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
 	}
 
-	udID, err := h.generateID()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	// update data
+	deck := new(UserDeck)
+	query = "SELECT * FROM user_decks WHERE user_id=? AND slot=? AND deleted_at IS NULL FOR UPDATE"
+	if err = tx.Get(deck, query, userID, slot); err != nil {
+		if err != sql.ErrNoRows {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+
+		udID, err := h.generateID()
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		deck = &UserDeck{
+			ID:        udID,
+			UserID:    userID,
+			Slot:      slot,
+			Name:      req.Name,
+			CardID1:   req.CardIDs[0],
+			CardID2:   req.CardIDs[1],
+			CardID3:   req.CardIDs[2],
+			CreatedAt: requestAt,
+			UpdatedAt: requestAt,
+		}
+		query = "INSERT INTO user_decks(id, user_id, slot, name, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		if _, err := tx.Exec(query, deck.ID, deck.UserID, deck.Slot, deck.Name, deck.CardID1, deck.CardID2, deck.CardID3, deck.CreatedAt, deck.UpdatedAt); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	} else {
+		deck.Name = req.Name
+		deck.CardID1 = req.CardIDs[0]
+		deck.CardID2 = req.CardIDs[1]
+		deck.CardID3 = req.CardIDs[2]
+		deck.UpdatedAt = requestAt
+		query = "UPDATE user_decks SET name=?, user_card_id_1=?, user_card_id_2=?, user_card_id_3=?, updated_at=? WHERE id=?"
+		if _, err := tx.Exec(query, deck.Name, deck.CardID1, deck.CardID2, deck.CardID3, deck.UpdatedAt, deck.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
 	}
-	newDeck := &UserDeck{
-		ID:        udID,
-		UserID:    userID,
-		CardID1:   req.CardIDs[0],
-		CardID2:   req.CardIDs[1],
-		CardID3:   req.CardIDs[2],
-		CreatedAt: requestAt,
-		UpdatedAt: requestAt,
-	}
-	query = "INSERT INTO user_decks(id, user_id, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err := tx.Exec(query, newDeck.ID, newDeck.UserID, newDeck.CardID1, newDeck.CardID2, newDeck.CardID3, newDeck.CreatedAt, newDeck.UpdatedAt); err != nil {
+
+	if err = h.insertUserDeckHistory(tx, deck, requestAt); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -292,13 +393,16 @@ func (h *Handler) updateDeck(c echo.Context) error {
 	}
 
 	return successResponse(c, &UpdateDeckResponse{
-		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, []*UserDeck{newDeck}, nil, nil, nil),
+		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, []*UserDeck{deck}, nil, nil, nil),
 	})
 }
 
 type UpdateDeckRequest struct {
 	ViewerID string  `json:"viewerId"`
 	CardIDs  []int64 `json:"cardIds"`
+	// Slot 保存する枠(1から)。0なら使っている枠
+	Slot int    `json:"slot"`
+	Name string `json:"name"`
 }
 
 type UpdateDeckResponse struct {
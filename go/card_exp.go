@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// カードの最高レベルを超える経験値の扱い
+const (
+	// ExpOverflowRefund 最高レベルに届くのに要らない分のアイテムは消費しない
+	ExpOverflowRefund string = "refund"
+	// ExpOverflowReject 最高レベルに届くのに要らないアイテムが含まれていたらリクエストを拒否する
+	ExpOverflowReject string = "reject"
+	// ExpOverflowAllow 全て消費し、超えた経験値もTotalExpに貯める
+	ExpOverflowAllow string = "allow"
+)
+
+// parseExpOverflowPolicy ISUCON_EXP_OVERFLOW_POLICYの値を確認する
+func parseExpOverflowPolicy(policy string) (string, error) {
+	switch policy {
+	case ExpOverflowRefund, ExpOverflowReject, ExpOverflowAllow:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown exp overflow policy: %s", policy)
+	}
+}
+
+// expThreshold levelからlevel+1に上がるのに必要な累計経験値
+func (c *TargetUserCardData) expThreshold(level int) int {
+	return c.Curve.expThreshold(c.BaseExpPerLevel, level)
+}
+
+// maxUsefulExp 限界突破を含めた最高レベルに上がるのに必要な累計経験値
+func (c *TargetUserCardData) maxUsefulExp() int {
+	if c.levelCap() <= 1 {
+		return 0
+	}
+	return c.expThreshold(c.levelCap() - 1)
+}
+
+type addExpResult struct {
+	// GainedExp カードに入った経験値
+	GainedExp int
+	// WastedExp 最高レベルを超えて使われなかった経験値
+	WastedExp int
+	// Rejected ExpOverflowRejectで要らないアイテムが含まれていた
+	Rejected bool
+}
+
+// addExp アイテムの経験値をカードに付与してレベルを上げる
+// ExpOverflowAllow以外では、最高レベルに届いた後のアイテムはConsumeAmountから外してRefundAmountにし、超えた経験値は貯めない
+func (c *TargetUserCardData) addExp(items []*ConsumeUserItemData, policy string) *addExpResult {
+	result := new(addExpResult)
+	before := c.TotalExp
+	maxExp := c.maxUsefulExp()
+	for _, v := range items {
+		if policy != ExpOverflowAllow {
+			use := 0
+			if need := maxExp - c.TotalExp; need > 0 && v.GainedExp > 0 {
+				use = (need + v.GainedExp - 1) / v.GainedExp
+			}
+			if use < v.ConsumeAmount {
+				v.RefundAmount = v.ConsumeAmount - use
+				v.ConsumeAmount = use
+				if policy == ExpOverflowReject {
+					result.Rejected = true
+				}
+			}
+		}
+		c.TotalExp += v.GainedExp * v.ConsumeAmount
+	}
+
+	if limit := maxInt(before, maxExp); c.TotalExp > limit {
+		result.WastedExp = c.TotalExp - limit
+		if policy != ExpOverflowAllow {
+			c.TotalExp = limit
+		}
+	}
+	result.GainedExp = c.TotalExp - before
+	if policy == ExpOverflowAllow {
+		result.GainedExp -= result.WastedExp
+	}
+
+	c.levelUp()
+	return result
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// previewAddExpToCard 装備強化のプレビュー。アイテムもワンタイムトークンも消費しない
+// POST /user/{userID}/card/addexp/{cardID}/preview
+func (h *Handler) previewAddExpToCard(c echo.Context) error {
+	cardID, err := strconv.ParseInt(c.Param("cardID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(AddExpToCardRequest)
+	if err = parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	if err = h.checkViewerID(c, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	masters, err := h.masterStore()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	db := c.Get("db").(*sqlx.DB)
+	card, items, err := loadAddExpTarget(db, masters, userID, cardID, req.Items)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows, ErrItemNotFound:
+			return errorResponse(c, http.StatusNotFound, err)
+		case ErrNotEnoughExpItem:
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if card.Level >= card.levelCap() {
+		return errorResponse(c, http.StatusBadRequest, ErrCardMaxLevel)
+	}
+
+	result := card.addExp(items, h.ExpOverflowPolicy)
+	res := &PreviewAddExpToCardResponse{
+		Level:          card.Level,
+		AmountPerSec:   card.AmountPerSec,
+		TotalExp:       card.TotalExp,
+		MaxLevel:       card.levelCap(),
+		GainedExp:      result.GainedExp,
+		WastedExp:      result.WastedExp,
+		OverflowPolicy: h.ExpOverflowPolicy,
+		Rejected:       result.Rejected,
+		Items:          make([]*AddExpPreviewItem, 0, len(items)),
+	}
+	consumed := make(map[int64]int, len(items))
+	for _, v := range items {
+		consumed[v.ID] += v.ConsumeAmount
+		res.Items = append(res.Items, &AddExpPreviewItem{
+			ID:            v.ID,
+			ItemID:        v.ItemID,
+			GainedExp:     v.GainedExp,
+			Amount:        v.ConsumeAmount + v.RefundAmount,
+			ConsumeAmount: v.ConsumeAmount,
+			RefundAmount:  v.RefundAmount,
+		})
+	}
+
+	// 次のレベルまでに必要な経験値と、強化後に持っているアイテムごとの必要数
+	if card.Level < card.levelCap() {
+		next := &AddExpNextLevel{
+			Level:       card.Level + 1,
+			RequiredExp: card.expThreshold(card.Level) - card.TotalExp,
+			Materials:   make([]*AddExpMaterial, 0),
+		}
+		userItems := make([]*UserItem, 0)
+		if err = db.Select(&userItems, "SELECT * FROM user_items WHERE user_id=? AND item_type=3", userID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		for _, v := range userItems {
+			itemMaster, ok := masters.Item(v.ItemID)
+			if !ok || itemMaster.GainedExp == nil || *itemMaster.GainedExp <= 0 {
+				continue
+			}
+			gainedExp := *itemMaster.GainedExp
+			next.Materials = append(next.Materials, &AddExpMaterial{
+				ID:        v.ID,
+				ItemID:    v.ItemID,
+				GainedExp: gainedExp,
+				Amount:    (next.RequiredExp + gainedExp - 1) / gainedExp,
+				Owned:     v.Amount - consumed[v.ID],
+			})
+		}
+		res.NextLevel = next
+	}
+
+	return successResponse(c, res)
+}
+
+type PreviewAddExpToCardResponse struct {
+	Level        int `json:"level"`
+	AmountPerSec int `json:"amountPerSec"`
+	TotalExp     int `json:"totalExp"`
+	// MaxLevel 限界突破を含めた最高レベル
+	MaxLevel int `json:"maxLevel"`
+	// GainedExp カードに入る経験値
+	GainedExp int `json:"gainedExp"`
+	// WastedExp 最高レベルを超えて使われない経験値
+	WastedExp      int    `json:"wastedExp"`
+	OverflowPolicy string `json:"overflowPolicy"`
+	// Rejected 強化するとExpOverflowRejectで拒否される
+	Rejected bool                 `json:"rejected"`
+	Items    []*AddExpPreviewItem `json:"items"`
+	// NextLevel 最高レベルならnil
+	NextLevel *AddExpNextLevel `json:"nextLevel,omitempty"`
+}
+
+type AddExpPreviewItem struct {
+	ID        int64 `json:"id"`
+	ItemID    int64 `json:"itemId"`
+	GainedExp int   `json:"gainedExp"`
+	// Amount リクエストした数
+	Amount        int `json:"amount"`
+	ConsumeAmount int `json:"consumeAmount"`
+	RefundAmount  int `json:"refundAmount"`
+}
+
+type AddExpNextLevel struct {
+	Level       int               `json:"level"`
+	RequiredExp int               `json:"requiredExp"`
+	Materials   []*AddExpMaterial `json:"materials"`
+}
+
+// AddExpMaterial 次のレベルに上がるのに必要なアイテムの最小数
+type AddExpMaterial struct {
+	ID        int64 `json:"id"`
+	ItemID    int64 `json:"itemId"`
+	GainedExp int   `json:"gainedExp"`
+	Amount    int   `json:"amount"`
+	// Owned 強化後に持っている数
+	Owned int `json:"owned"`
+}
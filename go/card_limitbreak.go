@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// levelCap 限界突破を含めた最高レベル
+func (c *TargetUserCardData) levelCap() int {
+	return c.MaxLevel + c.LimitBreak*c.LimitBreakLevels
+}
+
+// amountPerSecCap 限界突破を含めたlv maxのときの生産性
+func (c *TargetUserCardData) amountPerSecCap() int {
+	return c.MaxAmountPerSec + c.LimitBreak*c.LimitBreakAmountPerSec
+}
+
+// limitBreakCard 限界突破
+// 同じカードか素材アイテムを消費して最高レベルとlv maxのときの生産性を上げる
+// POST /user/{userID}/card/limitbreak/{cardID}
+func (h *Handler) limitBreakCard(c echo.Context) error {
+	cardID, err := strconv.ParseInt(c.Param("cardID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(LimitBreakCardRequest)
+	if err = parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.MaterialItemAmount < 0 {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidLimitBreakMaterial)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkViewerID(c, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	masters, err := h.masterStore()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	tx, err := c.Get("db").(*sqlx.DB).Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	userCard := new(UserCard)
+	query := "SELECT * FROM user_cards WHERE id=? AND user_id=? AND deleted_at IS NULL FOR UPDATE"
+	if err = tx.Get(userCard, query, cardID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	cardMaster, ok := masters.Item(userCard.CardID)
+	if !ok || cardMaster.AmountPerSec == nil || cardMaster.MaxLevel == nil || cardMaster.MaxAmountPerSec == nil || cardMaster.BaseExpPerLevel == nil {
+		return errorResponse(c, http.StatusNotFound, ErrItemNotFound)
+	}
+	curve, ok := masters.LevelCurve(cardMaster.LevelCurveID)
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, ErrItemNotFound)
+	}
+	if cardMaster.LimitBreakMax <= 0 {
+		return errorResponse(c, http.StatusBadRequest, ErrCardNotLimitBreakable)
+	}
+
+	// 素材アイテムは1段階分の数の倍数だけ使える
+	itemTiers := 0
+	if req.MaterialItemAmount > 0 {
+		if cardMaster.LimitBreakItemID == 0 || cardMaster.LimitBreakItemAmount <= 0 || req.MaterialItemAmount%cardMaster.LimitBreakItemAmount != 0 {
+			return errorResponse(c, http.StatusBadRequest, ErrInvalidLimitBreakMaterial)
+		}
+		itemTiers = req.MaterialItemAmount / cardMaster.LimitBreakItemAmount
+	}
+	tiers := len(req.MaterialCardIDs) + itemTiers
+	if tiers == 0 {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidLimitBreakMaterial)
+	}
+	if userCard.LimitBreak+tiers > cardMaster.LimitBreakMax {
+		return errorResponse(c, http.StatusBadRequest, ErrLimitBreakExceeded)
+	}
+
+	// 素材にする同じカード。強化対象とデッキのカードは使えない
+	materialCards := make([]*UserCard, 0, len(req.MaterialCardIDs))
+	if len(req.MaterialCardIDs) > 0 {
+		query, params, err := sqlx.In("SELECT * FROM user_cards WHERE id IN (?) AND user_id=? AND deleted_at IS NULL FOR UPDATE", req.MaterialCardIDs, userID)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		if err = tx.Select(&materialCards, query, params...); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if len(materialCards) != len(req.MaterialCardIDs) {
+			return errorResponse(c, http.StatusBadRequest, ErrInvalidLimitBreakMaterial)
+		}
+
+		deckCardIDs, err := getDeckCardIDs(tx, userID)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		for _, v := range materialCards {
+			_, inDeck := deckCardIDs[v.ID]
+			if v.ID == userCard.ID || v.CardID != userCard.CardID || inDeck {
+				return errorResponse(c, http.StatusBadRequest, ErrInvalidLimitBreakMaterial)
+			}
+		}
+	}
+
+	var resultItems []*UserItem
+	if req.MaterialItemAmount > 0 {
+		userItem := new(UserItem)
+		query = "SELECT * FROM user_items WHERE user_id=? AND item_id=? FOR UPDATE"
+		if err = tx.Get(userItem, query, userID, cardMaster.LimitBreakItemID); err != nil {
+			if err == sql.ErrNoRows {
+				return errorResponse(c, http.StatusBadRequest, ErrNotEnoughLimitBreakItem)
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if userItem.Amount < req.MaterialItemAmount {
+			return errorResponse(c, http.StatusBadRequest, ErrNotEnoughLimitBreakItem)
+		}
+		userItem.Amount -= req.MaterialItemAmount
+		userItem.UpdatedAt = requestAt
+		query = "UPDATE user_items SET amount=?, updated_at=? WHERE id=?"
+		if _, err = tx.Exec(query, userItem.Amount, userItem.UpdatedAt, userItem.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		resultItems = []*UserItem{userItem}
+	}
+
+	resultCards := make([]*UserCard, 0, len(materialCards)+1)
+	query = "UPDATE user_cards SET updated_at=?, deleted_at=? WHERE id=?"
+	for _, v := range materialCards {
+		if _, err = tx.Exec(query, requestAt, requestAt, v.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		v.UpdatedAt = requestAt
+		v.DeletedAt = &requestAt
+		resultCards = append(resultCards, v)
+	}
+
+	// 上限が上がったので、貯まっていた経験値でレベルを上げる
+	card := newTargetUserCardData(userCard, cardMaster, curve)
+	card.LimitBreak += tiers
+	card.levelUp()
+
+	query = "UPDATE user_cards SET amount_per_sec=?, level=?, limit_break=?, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, card.AmountPerSec, card.Level, card.LimitBreak, requestAt, card.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	userCard.AmountPerSec = card.AmountPerSec
+	userCard.Level = card.Level
+	userCard.LimitBreak = card.LimitBreak
+	userCard.UpdatedAt = requestAt
+	resultCards = append(resultCards, userCard)
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &LimitBreakCardResponse{
+		MaxLevel:         card.levelCap(),
+		MaxAmountPerSec:  card.amountPerSecCap(),
+		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, resultCards, nil, resultItems, nil, nil),
+	})
+}
+
+type LimitBreakCardRequest struct {
+	ViewerID string `json:"viewerId"`
+	// MaterialCardIDs 素材にする同じカードのuser_cards.id。1枚で1段階
+	MaterialCardIDs []int64 `json:"materialCardIds"`
+	// MaterialItemAmount 素材アイテムの数。limit_break_item_amount個で1段階
+	MaterialItemAmount int `json:"materialItemAmount"`
+}
+
+type LimitBreakCardResponse struct {
+	// MaxLevel 限界突破後の最高レベル
+	MaxLevel int `json:"maxLevel"`
+	// MaxAmountPerSec 限界突破後のlv maxのときの生産性
+	MaxAmountPerSec  int              `json:"maxAmountPerSec"`
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// sellCards カード売却
+// 複数のカードを削除し、マスタに設定されたISU-COINと強化素材を付与する
+// POST /user/{userID}/card/sell
+func (h *Handler) sellCards(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(SellCardsRequest)
+	if err = parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if len(req.CardIDs) == 0 {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidSellCards)
+	}
+	seen := make(map[int64]struct{}, len(req.CardIDs))
+	for _, id := range req.CardIDs {
+		if _, ok := seen[id]; ok {
+			return errorResponse(c, http.StatusBadRequest, ErrInvalidSellCards)
+		}
+		seen[id] = struct{}{}
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkViewerID(c, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	masters, err := h.masterStore()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	tx, err := c.Get("db").(*sqlx.DB).Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	query, params, err := sqlx.In("SELECT * FROM user_cards WHERE id IN (?) AND user_id=? AND deleted_at IS NULL FOR UPDATE", req.CardIDs, userID)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	cards := make([]*UserCard, 0, len(req.CardIDs))
+	if err = tx.Select(&cards, query, params...); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if len(cards) != len(req.CardIDs) {
+		return errorResponse(c, http.StatusNotFound, ErrCardNotFound)
+	}
+
+	deckCardIDs, err := getDeckCardIDs(tx, userID)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// 売却額と強化素材を集計する
+	grantItems := make([]*UserPresent, 0)
+	grantItemMap := make(map[int64]*UserPresent)
+	for _, v := range cards {
+		if _, ok := deckCardIDs[v.ID]; ok {
+			return errorResponse(c, http.StatusBadRequest, ErrCardInDeck)
+		}
+		cardMaster, ok := masters.Item(v.CardID)
+		if !ok {
+			return errorResponse(c, http.StatusNotFound, ErrItemNotFound)
+		}
+		if cardMaster.SellPrice <= 0 && (cardMaster.SellItemID == 0 || cardMaster.SellItemAmount <= 0) {
+			return errorResponse(c, http.StatusBadRequest, ErrCardNotSellable)
+		}
+		if cardMaster.SellItemID != 0 && cardMaster.SellItemAmount > 0 {
+			if g, ok := grantItemMap[cardMaster.SellItemID]; ok {
+				g.Amount += cardMaster.SellItemAmount
+			} else {
+				sellItem, ok := masters.Item(cardMaster.SellItemID)
+				if !ok {
+					return errorResponse(c, http.StatusNotFound, ErrItemNotFound)
+				}
+				g = &UserPresent{
+					UserID:    userID,
+					ItemType:  sellItem.ItemType,
+					ItemID:    cardMaster.SellItemID,
+					Amount:    cardMaster.SellItemAmount,
+					CreatedAt: requestAt,
+					UpdatedAt: requestAt,
+				}
+				grantItemMap[cardMaster.SellItemID] = g
+				grantItems = append(grantItems, g)
+			}
+		}
+	}
+
+	// カードを削除し、1枚ずつ売却額を台帳に記録する
+	coinGranted := false
+	query = "UPDATE user_cards SET updated_at=?, deleted_at=? WHERE id=?"
+	for _, v := range cards {
+		if _, err = tx.Exec(query, requestAt, requestAt, v.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		v.UpdatedAt = requestAt
+		v.DeletedAt = &requestAt
+
+		cardMaster, _ := masters.Item(v.CardID)
+		if cardMaster.SellPrice > 0 {
+			refID := v.ID
+			if _, err = h.creditCoins(tx, userID, int64(cardMaster.SellPrice), CoinReasonCardSell, &refID, requestAt); err != nil {
+				if err == ErrUserNotFound {
+					return errorResponse(c, http.StatusNotFound, err)
+				}
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+			coinGranted = true
+		}
+	}
+
+	var resultItems []*UserItem
+	if len(grantItems) > 0 {
+		if err = h.obtainGems(tx, grantItems); err != nil {
+			if err == ErrItemNotFound {
+				return errorResponse(c, http.StatusNotFound, err)
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		itemIDs := make([]int64, 0, len(grantItems))
+		for _, v := range grantItems {
+			itemIDs = append(itemIDs, v.ItemID)
+		}
+		query, params, err = sqlx.In("SELECT * FROM user_items WHERE user_id=? AND item_id IN (?)", userID, itemIDs)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		resultItems = make([]*UserItem, 0, len(itemIDs))
+		if err = tx.Select(&resultItems, query, params...); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	var user *User
+	if coinGranted {
+		user = new(User)
+		if err = tx.Get(user, "SELECT * FROM users WHERE id=?", userID); err != nil {
+			if err == sql.ErrNoRows {
+				return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &SellCardsResponse{
+		UpdatedResources: makeUpdatedResources(requestAt, user, nil, cards, nil, resultItems, nil, nil),
+	})
+}
+
+// getDeckCardIDs 保存しているいずれかの枠のデッキに入っているカードのuser_cards.id
+func getDeckCardIDs(tx *sqlx.Tx, userID int64) (map[int64]struct{}, error) {
+	decks := make([]*UserDeck, 0)
+	if err := tx.Select(&decks, "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL", userID); err != nil {
+		return nil, err
+	}
+	ids := make(map[int64]struct{}, len(decks)*DeckCardNumber)
+	for _, v := range decks {
+		ids[v.CardID1] = struct{}{}
+		ids[v.CardID2] = struct{}{}
+		ids[v.CardID3] = struct{}{}
+	}
+	return ids, nil
+}
+
+type SellCardsRequest struct {
+	ViewerID string  `json:"viewerId"`
+	CardIDs  []int64 `json:"cardIds"`
+}
+
+type SellCardsResponse struct {
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+}
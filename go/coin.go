@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// listCoinHistory ISU-COINの増減の履歴。新しい順に1ページずつ返す
+// GET /user/{userID}/coins/history?page={n}
+func (h *Handler) listCoinHistory(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	page := 1
+	if v := c.QueryParam("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid page parameter"))
+		}
+	}
+
+	offset := CoinHistoryCountPerPage * (page - 1)
+	transactions := make([]*UserCoinTransaction, 0)
+	query := "SELECT * FROM user_coin_transactions WHERE user_id=? ORDER BY seq DESC LIMIT ? OFFSET ?"
+	if err = c.Get("db").(*sqlx.DB).Select(&transactions, query, userID, CoinHistoryCountPerPage, offset); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	var transactionCount int
+	if err = c.Get("db").(*sqlx.DB).Get(&transactionCount, "SELECT COUNT(*) FROM user_coin_transactions WHERE user_id=?", userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &ListCoinHistoryResponse{
+		Transactions: transactions,
+		IsNext:       transactionCount > offset+CoinHistoryCountPerPage,
+	})
+}
+
+type ListCoinHistoryResponse struct {
+	Transactions []*UserCoinTransaction `json:"transactions"`
+	IsNext       bool                   `json:"isNext"`
+}
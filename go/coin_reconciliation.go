@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+// coinReconciliationIntervalMS ISU-COINの台帳と残高を突き合わせる間隔
+const coinReconciliationIntervalMS int = 10 * 60 * 1000
+
+// CoinDiscrepancy 台帳と残高が合わないユーザ
+type CoinDiscrepancy struct {
+	Shard   int   `json:"shard" db:"-"`
+	UserID  int64 `json:"userId" db:"user_id"`
+	IsuCoin int64 `json:"isuCoin" db:"isu_coin"`
+	// Opening 台帳を付け始める前の残高(1件目の記録の前の残高)
+	Opening    int64 `json:"opening" db:"opening"`
+	TotalDelta int64 `json:"totalDelta" db:"total_delta"`
+	// LastBalance 最後の記録の残高
+	LastBalance int64 `json:"lastBalance" db:"last_balance"`
+	Entries     int64 `json:"entries" db:"entries"`
+	LastSeq     int64 `json:"lastSeq" db:"last_seq"`
+}
+
+// startCoinReconciliation 定期的に全シャードの台帳と残高を突き合わせ、合わないユーザをログに出す
+func (h *Handler) startCoinReconciliation(logger echo.Logger) {
+	t := helpisu.NewTicker(coinReconciliationIntervalMS, func() {
+		discrepancies, err := h.reconcileCoins()
+		if err != nil {
+			logger.Errorf("failed to reconcile coins: %v", err)
+			return
+		}
+		for _, d := range discrepancies {
+			logger.Errorf("coin ledger mismatch: shard=%d user=%d isu_coin=%d ledger=%d last_balance=%d entries=%d last_seq=%d",
+				d.Shard, d.UserID, d.IsuCoin, d.Opening+d.TotalDelta, d.LastBalance, d.Entries, d.LastSeq)
+		}
+	})
+	go t.Start()
+}
+
+// reconcileCoins 台帳を付け始めた後のユーザについて、付け始める前の残高と増減の合計、最後の記録の残高がisu_coinと一致し、連番が欠けていないかを確かめる
+func (h *Handler) reconcileCoins() ([]*CoinDiscrepancy, error) {
+	query := "SELECT u.id AS user_id, u.isu_coin, COALESCE(o.balance_after - o.delta, 0) AS opening, s.total_delta, l.balance_after AS last_balance, s.entries, s.last_seq" +
+		" FROM (SELECT user_id, SUM(delta) AS total_delta, COUNT(*) AS entries, MAX(seq) AS last_seq FROM user_coin_transactions GROUP BY user_id) s" +
+		" JOIN users u ON u.id = s.user_id" +
+		" JOIN user_coin_transactions l ON l.user_id = s.user_id AND l.seq = s.last_seq" +
+		" LEFT JOIN user_coin_transactions o ON o.user_id = s.user_id AND o.seq = 1" +
+		" WHERE o.id IS NULL OR o.balance_after - o.delta + s.total_delta <> u.isu_coin OR l.balance_after <> u.isu_coin OR s.entries <> s.last_seq" +
+		" ORDER BY u.id"
+
+	discrepancies := make([]*CoinDiscrepancy, 0)
+	for i, db := range h.Shards {
+		rows := make([]*CoinDiscrepancy, 0)
+		if err := db.Select(&rows, query); err != nil {
+			return nil, err
+		}
+		for _, v := range rows {
+			v.Shard = i
+		}
+		discrepancies = append(discrepancies, rows...)
+	}
+	return discrepancies, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// UserActiveDeck 報酬とホームの生産性に使うデッキの枠。行が無ければ1枠目
+type UserActiveDeck struct {
+	UserID    int64 `json:"userId" db:"user_id"`
+	Slot      int   `json:"slot" db:"slot"`
+	CreatedAt int64 `json:"createdAt" db:"created_at"`
+	UpdatedAt int64 `json:"updatedAt" db:"updated_at"`
+}
+
+// UserDeckHistory デッキを保存するたびに追記する編成の記録
+type UserDeckHistory struct {
+	ID        int64  `json:"id" db:"id"`
+	UserID    int64  `json:"userId" db:"user_id"`
+	DeckID    int64  `json:"deckId" db:"deck_id"`
+	Slot      int    `json:"slot" db:"slot"`
+	Name      string `json:"name" db:"name"`
+	CardID1   int64  `json:"cardId1" db:"user_card_id_1"`
+	CardID2   int64  `json:"cardId2" db:"user_card_id_2"`
+	CardID3   int64  `json:"cardId3" db:"user_card_id_3"`
+	CreatedAt int64  `json:"createdAt" db:"created_at"`
+}
+
+// getActiveDeckSlot 使っているデッキの枠
+func getActiveDeckSlot(q sqlx.Queryer, userID int64) (int, error) {
+	slot := 1
+	if err := sqlx.Get(q, &slot, "SELECT slot FROM user_active_decks WHERE user_id=?", userID); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return slot, nil
+}
+
+// getActiveDeck 使っている枠のデッキ。無ければsql.ErrNoRows
+func getActiveDeck(q sqlx.Queryer, userID int64) (*UserDeck, error) {
+	deck := new(UserDeck)
+	query := "SELECT d.* FROM user_decks d LEFT JOIN user_active_decks a ON a.user_id=d.user_id" +
+		" WHERE d.user_id=? AND d.deleted_at IS NULL AND d.slot=COALESCE(a.slot, 1)"
+	if err := sqlx.Get(q, deck, query, userID); err != nil {
+		return nil, err
+	}
+	return deck, nil
+}
+
+// insertUserDeckHistory デッキの今の編成を記録する
+func (h *Handler) insertUserDeckHistory(tx *sqlx.Tx, deck *UserDeck, requestAt int64) error {
+	hID, err := h.generateID()
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO user_deck_histories(id, user_id, deck_id, slot, name, user_card_id_1, user_card_id_2, user_card_id_3, created_at)" +
+		" VALUES (:id, :user_id, :deck_id, :slot, :name, :user_card_id_1, :user_card_id_2, :user_card_id_3, :created_at)"
+	_, err = tx.NamedExec(query, &UserDeckHistory{
+		ID:        hID,
+		UserID:    deck.UserID,
+		DeckID:    deck.ID,
+		Slot:      deck.Slot,
+		Name:      deck.Name,
+		CardID1:   deck.CardID1,
+		CardID2:   deck.CardID2,
+		CardID3:   deck.CardID3,
+		CreatedAt: requestAt,
+	})
+	return err
+}
+
+// listDecks 保存しているデッキの一覧
+// GET /user/{userID}/decks
+func (h *Handler) listDecks(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	db := c.Get("db").(*sqlx.DB)
+	activeSlot, err := getActiveDeckSlot(db, userID)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	decks := make([]*UserDeck, 0)
+	if err = db.Select(&decks, "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL ORDER BY slot ASC", userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &ListDecksResponse{
+		ActiveSlot: activeSlot,
+		SlotCount:  DeckSlotCount,
+		Decks:      decks,
+	})
+}
+
+type ListDecksResponse struct {
+	ActiveSlot int `json:"activeSlot"`
+	// SlotCount 保存できるデッキの数
+	SlotCount int         `json:"slotCount"`
+	Decks     []*UserDeck `json:"decks"`
+}
+
+// activateDeck 使うデッキの枠を切り替える
+// POST /user/{userID}/deck/{slot}/activate
+func (h *Handler) activateDeck(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	slot, err := strconv.Atoi(c.Param("slot"))
+	if err != nil || slot < 1 || slot > DeckSlotCount {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidDeckSlot)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(ActivateDeckRequest)
+	if err = parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = h.checkViewerID(c, userID, req.ViewerID); err != nil {
+		if err == ErrUserDeviceNotFound {
+			return errorResponse(c, http.StatusNotFound, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	tx, err := c.Get("db").(*sqlx.DB).Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 空の枠には切り替えられない
+	deck := new(UserDeck)
+	query := "SELECT * FROM user_decks WHERE user_id=? AND slot=? AND deleted_at IS NULL"
+	if err = tx.Get(deck, query, userID, slot); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrDeckNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	query = "INSERT INTO user_active_decks(user_id, slot, created_at, updated_at) VALUES (?, ?, ?, ?)" +
+		" ON DUPLICATE KEY UPDATE slot=VALUES(slot), updated_at=VALUES(updated_at)"
+	if _, err = tx.Exec(query, userID, slot, requestAt, requestAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &ActivateDeckResponse{
+		ActiveSlot:       slot,
+		UpdatedResources: makeUpdatedResources(requestAt, nil, nil, nil, []*UserDeck{deck}, nil, nil, nil),
+	})
+}
+
+type ActivateDeckRequest struct {
+	ViewerID string `json:"viewerId"`
+}
+
+type ActivateDeckResponse struct {
+	ActiveSlot       int              `json:"activeSlot"`
+	UpdatedResources *UpdatedResource `json:"updatedResources"`
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"strconv"
 
@@ -24,65 +23,52 @@ func (h *Handler) listGacha(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	gachaMasterList := []*GachaMaster{}
-	query := "SELECT * FROM gacha_masters WHERE start_at <= ? AND end_at >= ? ORDER BY display_order ASC"
-	err = c.Get("db").(*sqlx.DB).Select(&gachaMasterList, query, requestAt, requestAt)
+	masters, err := h.masterStore()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
+	gachaMasterList := masters.ActiveGachas(requestAt)
 	if len(gachaMasterList) == 0 {
 		return successResponse(c, &ListGachaResponse{
 			Gachas: []*GachaData{},
 		})
 	}
 
+	// ステップアップガチャとボックスガチャの状態
+	states, boxDrawn, err := loadUserGachaModes(c.Get("db").(*sqlx.DB), userID)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
 	// ガチャ排出アイテム取得
 	gachaDataList := make([]*GachaData, 0)
-	query = "SELECT * FROM gacha_item_masters WHERE gacha_id=? ORDER BY id ASC"
 	for _, v := range gachaMasterList {
-		var gachaItem []*GachaItemMaster
-		err = c.Get("db").(*sqlx.DB).Select(&gachaItem, query, v.ID)
-		if err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-
+		gachaItem := masters.GachaItems(v.ID)
 		if len(gachaItem) == 0 {
 			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha item"))
 		}
 
+		state, ok := states[v.ID]
+		if !ok {
+			state = newUserGachaState(userID, v.ID, requestAt)
+		}
+		step, box := gachaModeData(v, gachaItem, state, boxDrawn[v.ID])
 		gachaDataList = append(gachaDataList, &GachaData{
 			Gacha:     v,
 			GachaItem: gachaItem,
+			Rates:     computeGachaRates(v, gachaPool(v, gachaItem, state, boxDrawn[v.ID])),
+			Step:      step,
+			Box:       box,
+			Daily:     gachaDailyData(v, state, requestAt),
 		})
 	}
 
 	// generate one time token
-	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = c.Get("db").(*sqlx.DB).Exec(query, requestAt, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-	tID, err := h.generateID()
+	token, err := h.Tokens.Issue(c.Get("db").(*sqlx.DB), userID, TokenPurposeGacha, requestAt)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	tk, err := generateULID()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-	token := &UserOneTimeToken{
-		ID:        tID,
-		UserID:    userID,
-		Token:     tk,
-		TokenType: 1,
-		CreatedAt: requestAt,
-		UpdatedAt: requestAt,
-		ExpiredAt: requestAt + 600,
-	}
-	query = "INSERT INTO user_one_time_tokens(id, user_id, token, token_type, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err = c.Get("db").(*sqlx.DB).Exec(query, token.ID, token.UserID, token.Token, token.TokenType, token.CreatedAt, token.UpdatedAt, token.ExpiredAt); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
 
 	return successResponse(c, &ListGachaResponse{
 		OneTimeToken: token.Token,
@@ -98,6 +84,62 @@ type ListGachaResponse struct {
 type GachaData struct {
 	Gacha     *GachaMaster       `json:"gacha"`
 	GachaItem []*GachaItemMaster `json:"gachaItemList"`
+	Rates     *GachaRates        `json:"rates"`
+	// Step ステップアップガチャの現在のステップ
+	Step *GachaStepData `json:"step,omitempty"`
+	// Box ボックスガチャの残りの中身
+	Box *GachaBoxData `json:"box,omitempty"`
+	// Daily 1日あたりの回数制限と無料の1回
+	Daily *GachaDailyData `json:"daily,omitempty"`
+}
+
+// getGachaRates ガチャの排出率。ステップアップガチャとボックスガチャはユーザの今の状態での排出率
+// GET /user/{userID}/gacha/{gachaID}/rates
+func (h *Handler) getGachaRates(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	gachaID, err := strconv.ParseInt(c.Param("gachaID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	masters, err := h.masterStore()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	gacha, ok := masters.Gacha(gachaID, requestAt)
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha"))
+	}
+	gachaItems := masters.GachaItems(gachaID)
+	if len(gachaItems) == 0 {
+		return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha item"))
+	}
+
+	states, boxDrawn, err := loadUserGachaModes(c.Get("db").(*sqlx.DB), userID)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	state, ok := states[gachaID]
+	if !ok {
+		state = newUserGachaState(userID, gachaID, requestAt)
+	}
+
+	return successResponse(c, &GetGachaRatesResponse{
+		Rates: computeGachaRates(gacha, gachaPool(gacha, gachaItems, state, boxDrawn[gachaID])),
+	})
+}
+
+type GetGachaRatesResponse struct {
+	Rates *GachaRates `json:"rates"`
 }
 
 // drawGacha ガチャを引く
@@ -108,8 +150,8 @@ func (h *Handler) drawGacha(c echo.Context) error {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
-	gachaID := c.Param("gachaID")
-	if gachaID == "" {
+	gachaID, err := strconv.ParseInt(c.Param("gachaID"), 10, 64)
+	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
 	}
 
@@ -117,8 +159,8 @@ func (h *Handler) drawGacha(c echo.Context) error {
 	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
-	if gachaCount != 1 && gachaCount != 10 {
-		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid draw gacha times"))
+	if gachaCount < 1 {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidDrawCount)
 	}
 
 	defer c.Request().Body.Close()
@@ -132,7 +174,7 @@ func (h *Handler) drawGacha(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	if err = h.checkOneTimeToken(c, req.OneTimeToken, 1, requestAt); err != nil {
+	if err = h.checkOneTimeToken(c, userID, req.OneTimeToken, TokenPurposeGacha, requestAt); err != nil {
 		if err == ErrInvalidToken {
 			return errorResponse(c, http.StatusBadRequest, err)
 		}
@@ -146,9 +188,25 @@ func (h *Handler) drawGacha(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	consumedCoin := int64(gachaCount * 1000)
+	// gachaIDからガチャマスタの取得
+	masters, err := h.masterStore()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	gachaInfo, ok := masters.Gacha(gachaID, requestAt)
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha"))
+	}
+	if !gachaInfo.allowsDrawCount(int(gachaCount)) {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidDrawCount)
+	}
+
+	// gachaItemMasterからアイテムリスト取得
+	gachaItemList := masters.GachaItems(gachaID)
+	if len(gachaItemList) == 0 {
+		return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha item"))
+	}
 
-	// userのisuconが足りるか
 	user := new(User)
 	query := "SELECT * FROM users WHERE id=?"
 	if err := c.Get("db").(*sqlx.DB).Get(user, query, userID); err != nil {
@@ -157,48 +215,76 @@ func (h *Handler) drawGacha(c echo.Context) error {
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	if user.IsuCoin < consumedCoin {
-		return errorResponse(c, http.StatusConflict, fmt.Errorf("not enough isucon"))
-	}
 
-	// gachaIDからガチャマスタの取得
-	query = "SELECT * FROM gacha_masters WHERE id=? AND start_at <= ? AND end_at >= ?"
-	gachaInfo := new(GachaMaster)
-	if err = c.Get("db").(*sqlx.DB).Get(gachaInfo, query, gachaID, requestAt, requestAt); err != nil {
-		if sql.ErrNoRows == err {
-			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha"))
-		}
+	tx, err := c.Get("db").(*sqlx.DB).Beginx()
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	defer tx.Rollback() //nolint:errcheck
 
-	// gachaItemMasterからアイテムリスト取得
-	gachaItemList := make([]*GachaItemMaster, 0)
-	err = c.Get("db").(*sqlx.DB).Select(&gachaItemList, "SELECT * FROM gacha_item_masters WHERE gacha_id=? ORDER BY id ASC", gachaID)
+	// ステップアップガチャとボックスガチャの状態から、今の価格と排出アイテムを決める
+	state, err := getUserGachaStateForUpdate(tx, userID, gachaID, requestAt)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	if len(gachaItemList) == 0 {
+	var boxDrawn map[int64]int
+	if gachaInfo.GachaType == GachaTypeBox {
+		if boxDrawn, err = getUserGachaBoxDrawnForUpdate(tx, userID, gachaID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+	pool := gachaPool(gachaInfo, gachaItemList, state, boxDrawn)
+	if len(pool) == 0 {
 		return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha item"))
 	}
+	if gachaInfo.GachaType == GachaTypeBox && gachaPoolSize(pool) < int(gachaCount) {
+		return errorResponse(c, http.StatusConflict, ErrGachaBoxNotEnough)
+	}
 
-	// weightの合計値を算出
-	var sum int64 = 0
-	for i := range gachaItemList {
-		sum += int64(gachaItemList[i].Weight)
+	// 1日あたりの回数制限と無料の1回
+	if !state.canDraw(gachaInfo, int(gachaCount), requestAt) {
+		return errorResponse(c, http.StatusConflict, ErrDailyDrawLimitExceeded)
+	}
+	if req.Free && (gachaCount != 1 || !state.freeDrawAvailable(gachaInfo, requestAt)) {
+		return errorResponse(c, http.StatusConflict, ErrFreeDrawUnavailable)
+	}
+
+	cost := gachaInfo.drawCost(int(gachaCount), state.Step)
+	if req.Free {
+		cost.Amount = 0
+	}
+
+	// 天井カウンタを見ながら抽選する
+	pity, err := getUserGachaPityForUpdate(tx, userID, gachaID, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	draw, rng, err := h.newUserGachaDraw(userID, gachaInfo, pool, int(gachaCount), cost, req.Free, pity, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	// random値の導出 & 抽選
-	result := make([]*GachaItemMaster, 0, gachaCount)
-	for i := 0; i < int(gachaCount); i++ {
-		random := rand.Int63n(sum)
-		boundary := 0
-		for _, v := range gachaItemList {
-			boundary += v.Weight
-			if random < int64(boundary) {
-				result = append(result, v)
-				break
+	// isuconかガチャチケットをへらす。残高の確認もここで行う
+	if cost.isCoin() {
+		if _, err = h.debitCoins(tx, userID, cost.Amount, CoinReasonGacha, &draw.ID, requestAt); err != nil {
+			if err == ErrNotEnoughCoin {
+				return errorResponse(c, http.StatusConflict, err)
 			}
+			if err == ErrUserNotFound {
+				return errorResponse(c, http.StatusNotFound, err)
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	} else if err = consumeGachaCostItem(tx, userID, cost, requestAt); err != nil {
+		if err == ErrNotEnoughGachaItem {
+			return errorResponse(c, http.StatusConflict, err)
 		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	result := drawGachaItems(gachaInfo, pool, int(gachaCount), pity, rng, requestAt)
+	if err = draw.setResult(result); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	// 直付与 => プレゼントに入れる
@@ -223,22 +309,26 @@ func (h *Handler) drawGacha(c echo.Context) error {
 		presents = append(presents, present)
 	}
 
-	tx, err := c.Get("db").(*sqlx.DB).Beginx()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-	defer tx.Rollback() //nolint:errcheck
-
 	query = "INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, created_at, updated_at)" +
 		" VALUES (:id, :user_id, :sent_at, :item_type, :item_id, :amount, :present_message, :created_at, :updated_at)"
 	if _, err := tx.NamedExec(query, presents); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	// isuconをへらす
-	query = "UPDATE users SET isu_coin=? WHERE id=?"
-	totalCoin := user.IsuCoin - consumedCoin
-	if _, err := tx.Exec(query, totalCoin, user.ID); err != nil {
+	if err = saveUserGachaPity(tx, pity); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if gachaInfo.GachaType == GachaTypeBox {
+		if err = saveUserGachaBoxDrawn(tx, userID, gachaID, result, requestAt); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+	state.advanceStep(gachaInfo, requestAt)
+	state.recordDraws(int(gachaCount), req.Free, requestAt)
+	if err = saveUserGachaState(tx, state); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if err = insertUserGachaDraw(tx, draw, result, presents); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -247,16 +337,183 @@ func (h *Handler) drawGacha(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
+	if boxDrawn != nil {
+		for _, v := range result {
+			boxDrawn[v.ID]++
+		}
+	}
+	step, box := gachaModeData(gachaInfo, gachaItemList, state, boxDrawn)
+
 	return successResponse(c, &DrawGachaResponse{
+		DrawID:   draw.ID,
 		Presents: presents,
+		Pity:     gachaPityData(gachaInfo, pity),
+		Step:     step,
+		Box:      box,
+		Daily:    gachaDailyData(gachaInfo, state, requestAt),
 	})
 }
 
 type DrawGachaRequest struct {
 	ViewerID     string `json:"viewerId"`
 	OneTimeToken string `json:"oneTimeToken"`
+	// Free 今日の無料の1回を使う
+	Free bool `json:"free"`
 }
 
 type DrawGachaResponse struct {
-	Presents []*UserPresent `json:"presents"`
+	DrawID   int64           `json:"drawId"`
+	Presents []*UserPresent  `json:"presents"`
+	Pity     *GachaPityData  `json:"pity"`
+	Step     *GachaStepData  `json:"step,omitempty"`
+	Box      *GachaBoxData   `json:"box,omitempty"`
+	Daily    *GachaDailyData `json:"daily,omitempty"`
+}
+
+// resetGachaBox ボックスガチャの中身を最初の状態に戻す
+// POST /user/{userID}/gacha/{gachaID}/box/reset
+func (h *Handler) resetGachaBox(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	gachaID, err := strconv.ParseInt(c.Param("gachaID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	masters, err := h.masterStore()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	gachaInfo, ok := masters.Gacha(gachaID, requestAt)
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha"))
+	}
+	if gachaInfo.GachaType != GachaTypeBox {
+		return errorResponse(c, http.StatusBadRequest, ErrNotBoxGacha)
+	}
+
+	tx, err := c.Get("db").(*sqlx.DB).Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	state, err := getUserGachaStateForUpdate(tx, userID, gachaID, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	query := "DELETE FROM user_gacha_box_items WHERE user_id=? AND gacha_id=?"
+	if _, err = tx.Exec(query, userID, gachaID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	state.BoxResets++
+	state.UpdatedAt = requestAt
+	if err = saveUserGachaState(tx, state); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	_, box := gachaModeData(gachaInfo, masters.GachaItems(gachaID), state, nil)
+	return successResponse(c, &ResetGachaBoxResponse{
+		Box: box,
+	})
+}
+
+type ResetGachaBoxResponse struct {
+	Box *GachaBoxData `json:"box"`
+}
+
+// listGachaHistory ガチャを引いた履歴。新しい順に1ページずつ返す
+// GET /user/{userID}/gacha/history?page={n}
+func (h *Handler) listGachaHistory(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	page := 1
+	if v := c.QueryParam("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid page parameter"))
+		}
+	}
+
+	offset := GachaHistoryCountPerPage * (page - 1)
+	draws := make([]*UserGachaDraw, 0)
+	query := "SELECT * FROM user_gacha_draws WHERE user_id=? ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?"
+	if err = c.Get("db").(*sqlx.DB).Select(&draws, query, userID, GachaHistoryCountPerPage, offset); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	var drawCount int
+	if err = c.Get("db").(*sqlx.DB).Get(&drawCount, "SELECT COUNT(*) FROM user_gacha_draws WHERE user_id=?", userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	histories := make([]*GachaDrawHistory, 0, len(draws))
+	if len(draws) > 0 {
+		drawIDs := make([]int64, 0, len(draws))
+		byID := make(map[int64]*GachaDrawHistory, len(draws))
+		for _, v := range draws {
+			history := &GachaDrawHistory{
+				ID:           v.ID,
+				GachaID:      v.GachaID,
+				DrawCount:    v.DrawCount,
+				ConsumedCoin: v.ConsumedCoin,
+				CostItemID:   v.CostItemID,
+				ConsumedItem: v.ConsumedItem,
+				IsFree:       v.IsFree,
+				Items:        make([]*UserGachaDrawItem, 0, v.DrawCount),
+				CreatedAt:    v.CreatedAt,
+			}
+			histories = append(histories, history)
+			byID[v.ID] = history
+			drawIDs = append(drawIDs, v.ID)
+		}
+
+		query, params, err := sqlx.In("SELECT * FROM user_gacha_draw_items WHERE draw_id IN (?) ORDER BY draw_id, seq", drawIDs)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		drawItems := make([]*UserGachaDrawItem, 0)
+		if err = c.Get("db").(*sqlx.DB).Select(&drawItems, query, params...); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		for _, v := range drawItems {
+			byID[v.DrawID].Items = append(byID[v.DrawID].Items, v)
+		}
+	}
+
+	return successResponse(c, &ListGachaHistoryResponse{
+		Histories: histories,
+		IsNext:    drawCount > offset+GachaHistoryCountPerPage,
+	})
+}
+
+type ListGachaHistoryResponse struct {
+	Histories []*GachaDrawHistory `json:"histories"`
+	IsNext    bool                `json:"isNext"`
+}
+
+type GachaDrawHistory struct {
+	ID           int64                `json:"id"`
+	GachaID      int64                `json:"gachaId"`
+	DrawCount    int                  `json:"drawCount"`
+	ConsumedCoin int64                `json:"consumedCoin"`
+	CostItemID   *int64               `json:"costItemId,omitempty"`
+	ConsumedItem int64                `json:"consumedItem"`
+	IsFree       bool                 `json:"isFree"`
+	Items        []*UserGachaDrawItem `json:"items"`
+	CreatedAt    int64                `json:"createdAt"`
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// gachaCost ガチャを引くのに必要な通貨と数
+type gachaCost struct {
+	// ItemType 1ならISU-COIN、それ以外はuser_itemsで持つアイテム
+	ItemType int
+	ItemID   int64
+	Amount   int64
+}
+
+// isCoin ISU-COINで払うか
+func (c *gachaCost) isCoin() bool {
+	return c.ItemType == 1
+}
+
+// DrawCounts 1度に引ける回数の一覧。draw_countsの読めない値は無視する
+func (g *GachaMaster) DrawCounts() []int {
+	counts := make([]int, 0)
+	for _, v := range strings.Split(g.DrawCountList, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n <= 0 {
+			continue
+		}
+		counts = append(counts, n)
+	}
+	return counts
+}
+
+// allowsDrawCount 1度にn回引けるか
+func (g *GachaMaster) allowsDrawCount(n int) bool {
+	for _, v := range g.DrawCounts() {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// drawCost stepでn回引くのに必要な通貨と数。2回以上まとめて引くと割引する(端数切り捨て)
+func (g *GachaMaster) drawCost(n int, step int) *gachaCost {
+	amount := int64(g.stepPrice(step)) * int64(n)
+	if n > 1 && g.MultiDrawDiscount > 0 {
+		amount = amount * int64(100-g.MultiDrawDiscount) / 100
+	}
+	return &gachaCost{
+		ItemType: g.CostItemType,
+		ItemID:   g.CostItemID,
+		Amount:   amount,
+	}
+}
+
+// consumeGachaCostItem ガチャチケットなどuser_itemsで持つアイテムを消費する
+func consumeGachaCostItem(tx *sqlx.Tx, userID int64, cost *gachaCost, requestAt int64) error {
+	if cost.Amount <= 0 {
+		return nil
+	}
+
+	item := new(UserItem)
+	query := "SELECT * FROM user_items WHERE user_id=? AND item_id=? FOR UPDATE"
+	if err := tx.Get(item, query, userID, cost.ItemID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotEnoughGachaItem
+		}
+		return err
+	}
+	if int64(item.Amount) < cost.Amount {
+		return ErrNotEnoughGachaItem
+	}
+
+	query = "UPDATE user_items SET amount=amount-?, updated_at=? WHERE id=?"
+	_, err := tx.Exec(query, cost.Amount, requestAt, item.ID)
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import "time"
+
+// GachaDailyData ガチャの1日あたりの回数制限と無料の1回の状態
+type GachaDailyData struct {
+	// DailyDrawLimit 1日に引ける回数。0なら制限なし
+	DailyDrawLimit int `json:"dailyDrawLimit"`
+	// RemainingDraws 今日あと何回引けるか。制限なしなら0
+	RemainingDraws int `json:"remainingDraws"`
+	// FreeDrawAvailable 今日の無料の1回が残っているか
+	FreeDrawAvailable bool `json:"freeDrawAvailable"`
+}
+
+// isToday 最後に引いたのがログインボーナスと同じ日付の区切りで今日か
+func (s *UserGachaState) isToday(requestAt int64) bool {
+	return s.LastDrawnAt != nil && isCompleteTodayLogin(time.Unix(*s.LastDrawnAt, 0), time.Unix(requestAt, 0))
+}
+
+// todayDraws 今日引いた回数
+func (s *UserGachaState) todayDraws(requestAt int64) int {
+	if !s.isToday(requestAt) {
+		return 0
+	}
+	return s.DailyDraws
+}
+
+// canDraw 今日あとn回引けるか
+func (s *UserGachaState) canDraw(gacha *GachaMaster, n int, requestAt int64) bool {
+	return gacha.DailyDrawLimit <= 0 || s.todayDraws(requestAt)+n <= gacha.DailyDrawLimit
+}
+
+// freeDrawAvailable 今日の無料の1回が残っているか
+func (s *UserGachaState) freeDrawAvailable(gacha *GachaMaster, requestAt int64) bool {
+	return gacha.DailyFreeDraw && !(s.isToday(requestAt) && s.DailyFreeDrawn)
+}
+
+// recordDraws 今日引いた回数を加算する。日付が変わっていれば0から数え直す
+func (s *UserGachaState) recordDraws(n int, free bool, requestAt int64) {
+	if !s.isToday(requestAt) {
+		s.DailyDraws = 0
+		s.DailyFreeDrawn = false
+	}
+	s.DailyDraws += n
+	if free {
+		s.DailyFreeDrawn = true
+	}
+	s.LastDrawnAt = &requestAt
+	s.UpdatedAt = requestAt
+}
+
+// gachaDailyData レスポンス用の回数制限と無料の1回の状態。どちらも無いガチャはnil
+func gachaDailyData(gacha *GachaMaster, state *UserGachaState, requestAt int64) *GachaDailyData {
+	if gacha.DailyDrawLimit <= 0 && !gacha.DailyFreeDraw {
+		return nil
+	}
+	data := &GachaDailyData{
+		DailyDrawLimit:    gacha.DailyDrawLimit,
+		FreeDrawAvailable: state.freeDrawAvailable(gacha, requestAt),
+	}
+	if gacha.DailyDrawLimit > 0 {
+		data.RemainingDraws = gacha.DailyDrawLimit - state.todayDraws(requestAt)
+		if data.RemainingDraws < 0 {
+			data.RemainingDraws = 0
+		}
+		// 上限に達していれば無料の1回も引けない
+		if data.RemainingDraws == 0 {
+			data.FreeDrawAvailable = false
+		}
+	}
+	return data
+}
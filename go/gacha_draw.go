@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// UserGachaDraw ガチャを引いた記録。シードと抽選時のマスタから結果を再現できる
+type UserGachaDraw struct {
+	ID        int64 `json:"id" db:"id"`
+	UserID    int64 `json:"userId" db:"user_id"`
+	GachaID   int64 `json:"gachaId" db:"gacha_id"`
+	DrawCount int   `json:"drawCount" db:"draw_count"`
+	// ConsumedCoin 消費したISU-COIN
+	ConsumedCoin int64 `json:"consumedCoin" db:"consumed_coin"`
+	// CostItemID ガチャチケットなどで引いた場合に消費したアイテム
+	CostItemID   *int64 `json:"costItemId,omitempty" db:"cost_item_id"`
+	ConsumedItem int64  `json:"consumedItem" db:"consumed_item"`
+	// IsFree 1日1回の無料で引いたか
+	IsFree bool   `json:"isFree" db:"is_free"`
+	Seed   string `json:"seed" db:"seed"`
+	// Snapshot 抽選時のガチャ、排出アイテム、天井カウンタ(GachaDrawSnapshot)
+	Snapshot string `json:"snapshot" db:"snapshot"`
+	// Result 排出されたガチャアイテムマスタのID
+	Result    string `json:"result" db:"result"`
+	CreatedAt int64  `json:"createdAt" db:"created_at"`
+}
+
+// UserGachaDrawItem ガチャを引いた記録の1回ごとの排出結果
+type UserGachaDrawItem struct {
+	DrawID int64 `json:"drawId" db:"draw_id"`
+	// Seq 何回目の抽選か(0から)
+	Seq         int   `json:"seq" db:"seq"`
+	UserID      int64 `json:"userId" db:"user_id"`
+	GachaItemID int64 `json:"gachaItemId" db:"gacha_item_id"`
+	ItemType    int   `json:"itemType" db:"item_type"`
+	ItemID      int64 `json:"itemId" db:"item_id"`
+	Amount      int   `json:"amount" db:"amount"`
+	// PresentID 付与したプレゼント
+	PresentID int64 `json:"presentId" db:"present_id"`
+	CreatedAt int64 `json:"createdAt" db:"created_at"`
+}
+
+// GachaDrawSnapshot 抽選に使った入力
+type GachaDrawSnapshot struct {
+	Gacha *GachaMaster       `json:"gacha"`
+	Items []*GachaItemMaster `json:"items"`
+	Pity  *UserGachaPity     `json:"pity"`
+}
+
+// newUserGachaDraw 抽選前の状態を記録し、抽選に使う乱数を返す。Resultは抽選後にsetResultで埋める
+func (h *Handler) newUserGachaDraw(userID int64, gacha *GachaMaster, items []*GachaItemMaster, count int, cost *gachaCost, free bool, pity *UserGachaPity, requestAt int64) (*UserGachaDraw, gachaRand, error) {
+	drawID, err := h.generateID()
+	if err != nil {
+		return nil, nil, err
+	}
+	before := *pity
+	snapshot, err := json.Marshal(&GachaDrawSnapshot{
+		Gacha: gacha,
+		Items: items,
+		Pity:  &before,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seed := gachaSeed(h.GachaSecret, drawID)
+	draw := &UserGachaDraw{
+		ID:        drawID,
+		UserID:    userID,
+		GachaID:   gacha.ID,
+		DrawCount: count,
+		Seed:      hex.EncodeToString(seed),
+		Snapshot:  string(snapshot),
+		CreatedAt: requestAt,
+	}
+	if cost.isCoin() {
+		draw.ConsumedCoin = cost.Amount
+	} else {
+		draw.CostItemID = &cost.ItemID
+		draw.ConsumedItem = cost.Amount
+	}
+	return draw, newGachaDRBG(seed), nil
+}
+
+// setResult 排出結果を記録する
+func (d *UserGachaDraw) setResult(items []*GachaItemMaster) error {
+	b, err := json.Marshal(gachaItemIDs(items))
+	if err != nil {
+		return err
+	}
+	d.Result = string(b)
+	return nil
+}
+
+// insertUserGachaDraw 抽選の記録と、1回ごとの排出結果を書き込む。presentsは排出結果と同じ順で付与したプレゼント
+func insertUserGachaDraw(tx *sqlx.Tx, draw *UserGachaDraw, result []*GachaItemMaster, presents []*UserPresent) error {
+	query := "INSERT INTO user_gacha_draws(id, user_id, gacha_id, draw_count, consumed_coin, cost_item_id, consumed_item, is_free, seed, snapshot, result, created_at)" +
+		" VALUES (:id, :user_id, :gacha_id, :draw_count, :consumed_coin, :cost_item_id, :consumed_item, :is_free, :seed, :snapshot, :result, :created_at)"
+	if _, err := tx.NamedExec(query, draw); err != nil {
+		return err
+	}
+
+	drawItems := make([]*UserGachaDrawItem, 0, len(result))
+	for i, v := range result {
+		drawItems = append(drawItems, &UserGachaDrawItem{
+			DrawID:      draw.ID,
+			Seq:         i,
+			UserID:      draw.UserID,
+			GachaItemID: v.ID,
+			ItemType:    v.ItemType,
+			ItemID:      v.ItemID,
+			Amount:      v.Amount,
+			PresentID:   presents[i].ID,
+			CreatedAt:   draw.CreatedAt,
+		})
+	}
+	if len(drawItems) == 0 {
+		return nil
+	}
+	query = "INSERT INTO user_gacha_draw_items(draw_id, seq, user_id, gacha_item_id, item_type, item_id, amount, present_id, created_at)" +
+		" VALUES (:draw_id, :seq, :user_id, :gacha_item_id, :item_type, :item_id, :amount, :present_id, :created_at)"
+	_, err := tx.NamedExec(query, drawItems)
+	return err
+}
+
+// replayGachaDraw 保存されたシードとスナップショットから抽選をやり直す
+func replayGachaDraw(draw *UserGachaDraw) ([]*GachaItemMaster, error) {
+	snapshot := new(GachaDrawSnapshot)
+	if err := json.Unmarshal([]byte(draw.Snapshot), snapshot); err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(draw.Seed)
+	if err != nil {
+		return nil, err
+	}
+	return drawGachaItems(snapshot.Gacha, snapshot.Items, draw.DrawCount, snapshot.Pity, newGachaDRBG(seed), draw.CreatedAt), nil
+}
+
+// gachaItemIDs ガチャアイテムマスタのIDの一覧
+func gachaItemIDs(items []*GachaItemMaster) []int64 {
+	ids := make([]int64, 0, len(items))
+	for _, v := range items {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
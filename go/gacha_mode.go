@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// GachaTypeNormal 毎回同じ排出アイテムから抽選する
+	GachaTypeNormal int = 1
+	// GachaTypeStepUp 引くたびにステップが進み、ステップごとに価格と排出アイテムが変わる
+	GachaTypeStepUp int = 2
+	// GachaTypeBox 排出アイテムごとにユーザごとの在庫があり、引くと減る
+	GachaTypeBox int = 3
+)
+
+// UserGachaState ステップアップガチャ、ボックスガチャ、1日あたりの回数のユーザごとの状態
+type UserGachaState struct {
+	UserID  int64 `json:"userId" db:"user_id"`
+	GachaID int64 `json:"gachaId" db:"gacha_id"`
+	// Step 次に引くステップ(1から)
+	Step int `json:"step" db:"step"`
+	// StepLoops 最後のステップから1に戻った回数
+	StepLoops int `json:"stepLoops" db:"step_loops"`
+	// BoxResets ボックスをリセットした回数
+	BoxResets int `json:"boxResets" db:"box_resets"`
+	// DailyDraws LastDrawnAtの日に引いた回数
+	DailyDraws int `json:"dailyDraws" db:"daily_draws"`
+	// DailyFreeDrawn LastDrawnAtの日に無料の1回を使ったか
+	DailyFreeDrawn bool   `json:"dailyFreeDrawn" db:"daily_free_drawn"`
+	LastDrawnAt    *int64 `json:"lastDrawnAt,omitempty" db:"last_drawn_at"`
+	CreatedAt      int64  `json:"createdAt" db:"created_at"`
+	UpdatedAt      int64  `json:"updatedAt" db:"updated_at"`
+}
+
+// UserGachaBoxItem ボックスガチャの排出アイテムごとに引いた数
+type UserGachaBoxItem struct {
+	UserID      int64 `json:"userId" db:"user_id"`
+	GachaID     int64 `json:"gachaId" db:"gacha_id"`
+	GachaItemID int64 `json:"gachaItemId" db:"gacha_item_id"`
+	Drawn       int   `json:"drawn" db:"drawn"`
+	CreatedAt   int64 `json:"createdAt" db:"created_at"`
+	UpdatedAt   int64 `json:"updatedAt" db:"updated_at"`
+}
+
+// GachaStepData ステップアップガチャの現在のステップ
+type GachaStepData struct {
+	Step  int `json:"step"`
+	Steps int `json:"steps"`
+	// Price 現在のステップの1回あたりの価格
+	Price int `json:"price"`
+}
+
+// GachaBoxData ボックスガチャの残りの中身
+type GachaBoxData struct {
+	Remaining int                 `json:"remaining"`
+	Total     int                 `json:"total"`
+	Resets    int                 `json:"resets"`
+	Items     []*GachaBoxItemData `json:"items"`
+}
+
+type GachaBoxItemData struct {
+	GachaItemID int64 `json:"gachaItemId"`
+	ItemType    int   `json:"itemType"`
+	ItemID      int64 `json:"itemId"`
+	Amount      int   `json:"amount"`
+	Stock       int   `json:"stock"`
+	Remaining   int   `json:"remaining"`
+}
+
+// StepPrices ステップごとの1回あたりの価格。step_pricesの読めない値は無視する
+func (g *GachaMaster) StepPrices() []int {
+	prices := make([]int, 0)
+	if g.StepPriceList == "" {
+		return prices
+	}
+	for _, v := range strings.Split(g.StepPriceList, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			continue
+		}
+		prices = append(prices, n)
+	}
+	return prices
+}
+
+// stepPrice ステップの1回あたりの価格。ステップアップガチャでなければPrice
+func (g *GachaMaster) stepPrice(step int) int {
+	if g.GachaType != GachaTypeStepUp {
+		return g.Price
+	}
+	prices := g.StepPrices()
+	if step < 1 || step > len(prices) {
+		return g.Price
+	}
+	return prices[step-1]
+}
+
+// newUserGachaState まだ引いていないユーザの状態
+func newUserGachaState(userID, gachaID int64, requestAt int64) *UserGachaState {
+	return &UserGachaState{
+		UserID:    userID,
+		GachaID:   gachaID,
+		Step:      1,
+		CreatedAt: requestAt,
+		UpdatedAt: requestAt,
+	}
+}
+
+// getUserGachaStateForUpdate ガチャの状態をロックして取得する。まだ無ければ1ステップ目の状態を返す
+func getUserGachaStateForUpdate(tx *sqlx.Tx, userID, gachaID int64, requestAt int64) (*UserGachaState, error) {
+	state := new(UserGachaState)
+	query := "SELECT * FROM user_gacha_states WHERE user_id=? AND gacha_id=? FOR UPDATE"
+	if err := tx.Get(state, query, userID, gachaID); err != nil {
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+		return newUserGachaState(userID, gachaID, requestAt), nil
+	}
+	return state, nil
+}
+
+// saveUserGachaState ガチャの状態を保存する
+func saveUserGachaState(tx *sqlx.Tx, state *UserGachaState) error {
+	query := "INSERT INTO user_gacha_states(user_id, gacha_id, step, step_loops, box_resets, daily_draws, daily_free_drawn, last_drawn_at, created_at, updated_at)" +
+		" VALUES (:user_id, :gacha_id, :step, :step_loops, :box_resets, :daily_draws, :daily_free_drawn, :last_drawn_at, :created_at, :updated_at)" +
+		" ON DUPLICATE KEY UPDATE step=VALUES(step), step_loops=VALUES(step_loops), box_resets=VALUES(box_resets)," +
+		" daily_draws=VALUES(daily_draws), daily_free_drawn=VALUES(daily_free_drawn), last_drawn_at=VALUES(last_drawn_at), updated_at=VALUES(updated_at)"
+	_, err := tx.NamedExec(query, state)
+	return err
+}
+
+// getUserGachaBoxDrawnForUpdate ボックスガチャの排出アイテムごとに引いた数をロックして取得する
+func getUserGachaBoxDrawnForUpdate(tx *sqlx.Tx, userID, gachaID int64) (map[int64]int, error) {
+	boxItems := make([]*UserGachaBoxItem, 0)
+	query := "SELECT * FROM user_gacha_box_items WHERE user_id=? AND gacha_id=? FOR UPDATE"
+	if err := tx.Select(&boxItems, query, userID, gachaID); err != nil {
+		return nil, err
+	}
+	drawn := make(map[int64]int, len(boxItems))
+	for _, v := range boxItems {
+		drawn[v.GachaItemID] = v.Drawn
+	}
+	return drawn, nil
+}
+
+// saveUserGachaBoxDrawn ボックスガチャから引いたアイテムの数を加算する
+func saveUserGachaBoxDrawn(tx *sqlx.Tx, userID, gachaID int64, result []*GachaItemMaster, requestAt int64) error {
+	counts := map[int64]int{}
+	boxItems := make([]*UserGachaBoxItem, 0, len(result))
+	for _, v := range result {
+		if _, ok := counts[v.ID]; !ok {
+			boxItems = append(boxItems, &UserGachaBoxItem{
+				UserID:      userID,
+				GachaID:     gachaID,
+				GachaItemID: v.ID,
+				CreatedAt:   requestAt,
+				UpdatedAt:   requestAt,
+			})
+		}
+		counts[v.ID]++
+	}
+	if len(boxItems) == 0 {
+		return nil
+	}
+	for _, v := range boxItems {
+		v.Drawn = counts[v.GachaItemID]
+	}
+
+	query := "INSERT INTO user_gacha_box_items(user_id, gacha_id, gacha_item_id, drawn, created_at, updated_at)" +
+		" VALUES (:user_id, :gacha_id, :gacha_item_id, :drawn, :created_at, :updated_at)" +
+		" ON DUPLICATE KEY UPDATE drawn=drawn+VALUES(drawn), updated_at=VALUES(updated_at)"
+	_, err := tx.NamedExec(query, boxItems)
+	return err
+}
+
+// loadUserGachaModes ユーザの全てのガチャの状態と、ボックスガチャの排出アイテムごとに引いた数を取得する
+func loadUserGachaModes(db *sqlx.DB, userID int64) (map[int64]*UserGachaState, map[int64]map[int64]int, error) {
+	states := make([]*UserGachaState, 0)
+	if err := db.Select(&states, "SELECT * FROM user_gacha_states WHERE user_id=?", userID); err != nil {
+		return nil, nil, err
+	}
+	boxItems := make([]*UserGachaBoxItem, 0)
+	if err := db.Select(&boxItems, "SELECT * FROM user_gacha_box_items WHERE user_id=?", userID); err != nil {
+		return nil, nil, err
+	}
+
+	stateMap := make(map[int64]*UserGachaState, len(states))
+	for _, v := range states {
+		stateMap[v.GachaID] = v
+	}
+	drawnMap := map[int64]map[int64]int{}
+	for _, v := range boxItems {
+		if _, ok := drawnMap[v.GachaID]; !ok {
+			drawnMap[v.GachaID] = map[int64]int{}
+		}
+		drawnMap[v.GachaID][v.GachaItemID] = v.Drawn
+	}
+	return stateMap, drawnMap, nil
+}
+
+// gachaPool ユーザの状態に応じた今の排出アイテム
+// ステップアップガチャは今のステップ(stepが0なら全ステップ)のアイテム、ボックスガチャは残りの数をweightにしたアイテムになる
+func gachaPool(gacha *GachaMaster, items []*GachaItemMaster, state *UserGachaState, drawn map[int64]int) []*GachaItemMaster {
+	switch gacha.GachaType {
+	case GachaTypeStepUp:
+		pool := make([]*GachaItemMaster, 0, len(items))
+		for _, v := range items {
+			if v.Step == 0 || v.Step == state.Step {
+				pool = append(pool, v)
+			}
+		}
+		return pool
+	case GachaTypeBox:
+		pool := make([]*GachaItemMaster, 0, len(items))
+		for _, v := range items {
+			if remaining := v.Stock - drawn[v.ID]; remaining > 0 {
+				item := *v
+				item.Weight = remaining
+				pool = append(pool, &item)
+			}
+		}
+		return pool
+	default:
+		return items
+	}
+}
+
+// gachaPoolSize ボックスガチャの残りの数
+func gachaPoolSize(pool []*GachaItemMaster) int {
+	size := 0
+	for _, v := range pool {
+		size += v.Weight
+	}
+	return size
+}
+
+// advanceStep ステップアップガチャのステップを進める。最後のステップの次は1に戻る
+func (s *UserGachaState) advanceStep(gacha *GachaMaster, requestAt int64) {
+	if gacha.GachaType != GachaTypeStepUp {
+		return
+	}
+	s.Step++
+	if s.Step > len(gacha.StepPrices()) {
+		s.Step = 1
+		s.StepLoops++
+	}
+	s.UpdatedAt = requestAt
+}
+
+// gachaModeData レスポンス用のステップアップガチャとボックスガチャの状態
+func gachaModeData(gacha *GachaMaster, items []*GachaItemMaster, state *UserGachaState, drawn map[int64]int) (*GachaStepData, *GachaBoxData) {
+	switch gacha.GachaType {
+	case GachaTypeStepUp:
+		return &GachaStepData{
+			Step:  state.Step,
+			Steps: len(gacha.StepPrices()),
+			Price: gacha.stepPrice(state.Step),
+		}, nil
+	case GachaTypeBox:
+		box := &GachaBoxData{
+			Resets: state.BoxResets,
+			Items:  make([]*GachaBoxItemData, 0, len(items)),
+		}
+		for _, v := range items {
+			remaining := v.Stock - drawn[v.ID]
+			if remaining < 0 {
+				remaining = 0
+			}
+			box.Total += v.Stock
+			box.Remaining += remaining
+			box.Items = append(box.Items, &GachaBoxItemData{
+				GachaItemID: v.ID,
+				ItemType:    v.ItemType,
+				ItemID:      v.ItemID,
+				Amount:      v.Amount,
+				Stock:       v.Stock,
+				Remaining:   remaining,
+			})
+		}
+		return nil, box
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// UserGachaPity ユーザのガチャごとの天井カウンタ
+type UserGachaPity struct {
+	UserID  int64 `json:"userId" db:"user_id"`
+	GachaID int64 `json:"gachaId" db:"gacha_id"`
+	// DrawsSinceRare 最後にレアが出てから引いた回数
+	DrawsSinceRare int    `json:"drawsSinceRare" db:"draws_since_rare"`
+	TotalDraws     int64  `json:"totalDraws" db:"total_draws"`
+	LastRareAt     *int64 `json:"lastRareAt,omitempty" db:"last_rare_at"`
+	CreatedAt      int64  `json:"createdAt" db:"created_at"`
+	UpdatedAt      int64  `json:"updatedAt" db:"updated_at"`
+}
+
+// GachaPityData ガチャを引いた後の天井の状態
+type GachaPityData struct {
+	GachaID        int64 `json:"gachaId"`
+	DrawsSinceRare int   `json:"drawsSinceRare"`
+	TotalDraws     int64 `json:"totalDraws"`
+	// PityDraws 天井の回数。0なら天井なし
+	PityDraws int `json:"pityDraws"`
+	// RemainingDraws 天井まであと何回か。天井なしなら0
+	RemainingDraws int `json:"remainingDraws"`
+}
+
+// getUserGachaPityForUpdate 天井カウンタをロックして取得する。まだ無ければ0回の状態を返す
+func getUserGachaPityForUpdate(tx *sqlx.Tx, userID, gachaID int64, requestAt int64) (*UserGachaPity, error) {
+	pity := new(UserGachaPity)
+	query := "SELECT * FROM user_gacha_pities WHERE user_id=? AND gacha_id=? FOR UPDATE"
+	if err := tx.Get(pity, query, userID, gachaID); err != nil {
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+		return &UserGachaPity{
+			UserID:    userID,
+			GachaID:   gachaID,
+			CreatedAt: requestAt,
+			UpdatedAt: requestAt,
+		}, nil
+	}
+	return pity, nil
+}
+
+// saveUserGachaPity 天井カウンタを保存する
+func saveUserGachaPity(tx *sqlx.Tx, pity *UserGachaPity) error {
+	query := "INSERT INTO user_gacha_pities(user_id, gacha_id, draws_since_rare, total_draws, last_rare_at, created_at, updated_at)" +
+		" VALUES (:user_id, :gacha_id, :draws_since_rare, :total_draws, :last_rare_at, :created_at, :updated_at)" +
+		" ON DUPLICATE KEY UPDATE draws_since_rare=VALUES(draws_since_rare), total_draws=VALUES(total_draws), last_rare_at=VALUES(last_rare_at), updated_at=VALUES(updated_at)"
+	_, err := tx.NamedExec(query, pity)
+	return err
+}
+
+// drawGachaItems 排出アイテムをcount回抽選し、天井カウンタを進める
+// 天井に達した回と、複数回引きでまだレアが出ていない最後の回はレアアイテムだけから抽選する
+// ボックスガチャではitemsのweightを残りの数とし、引くたびに減らす
+func drawGachaItems(gacha *GachaMaster, items []*GachaItemMaster, count int, pity *UserGachaPity, rng gachaRand, requestAt int64) []*GachaItemMaster {
+	isBox := gacha.GachaType == GachaTypeBox
+	if isBox {
+		remaining := make([]*GachaItemMaster, 0, len(items))
+		for _, v := range items {
+			item := *v
+			remaining = append(remaining, &item)
+		}
+		items = remaining
+	}
+
+	result := make([]*GachaItemMaster, 0, count)
+	gotRare := false
+	for i := 0; i < count; i++ {
+		pool := items
+		if isBox {
+			pool = make([]*GachaItemMaster, 0, len(items))
+			for _, v := range items {
+				if v.Weight > 0 {
+					pool = append(pool, v)
+				}
+			}
+		}
+		rares := make([]*GachaItemMaster, 0)
+		for _, v := range pool {
+			if v.IsRare {
+				rares = append(rares, v)
+			}
+		}
+		if len(rares) > 0 {
+			reachedPity := gacha.PityDraws > 0 && pity.DrawsSinceRare+1 >= gacha.PityDraws
+			lastOfMulti := gacha.MultiDrawGuarantee && count > 1 && i == count-1 && !gotRare
+			if reachedPity || lastOfMulti {
+				pool = rares
+			}
+		}
+
+		item := pickGachaItem(pool, rng)
+		if isBox {
+			item.Weight--
+		}
+		result = append(result, item)
+
+		pity.TotalDraws++
+		if item.IsRare {
+			gotRare = true
+			pity.DrawsSinceRare = 0
+			pity.LastRareAt = &requestAt
+		} else {
+			pity.DrawsSinceRare++
+		}
+	}
+	pity.UpdatedAt = requestAt
+
+	return result
+}
+
+// pickGachaItem weightに応じて1つ抽選する
+func pickGachaItem(items []*GachaItemMaster, rng gachaRand) *GachaItemMaster {
+	var sum int64 = 0
+	for _, v := range items {
+		sum += int64(v.Weight)
+	}
+	if sum <= 0 {
+		return items[rng.Int63n(int64(len(items)))]
+	}
+
+	random := rng.Int63n(sum)
+	var boundary int64 = 0
+	for _, v := range items {
+		boundary += int64(v.Weight)
+		if random < boundary {
+			return v
+		}
+	}
+	return items[len(items)-1]
+}
+
+// gachaPityData レスポンス用の天井の状態
+func gachaPityData(gacha *GachaMaster, pity *UserGachaPity) *GachaPityData {
+	data := &GachaPityData{
+		GachaID:        gacha.ID,
+		DrawsSinceRare: pity.DrawsSinceRare,
+		TotalDraws:     pity.TotalDraws,
+		PityDraws:      gacha.PityDraws,
+	}
+	if gacha.PityDraws > 0 {
+		data.RemainingDraws = gacha.PityDraws - pity.DrawsSinceRare
+	}
+	return data
+}
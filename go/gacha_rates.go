@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// gachaRateScale 排出率の最小単位。100%をこの数に分ける(0.001%単位)
+const gachaRateScale int64 = 100000
+
+const (
+	GachaRarityRare   string = "rare"
+	GachaRarityNormal string = "normal"
+)
+
+// GachaRates ガチャの排出率。天井と確定枠を含まない1回ごとの確率
+type GachaRates struct {
+	GachaID            int64              `json:"gachaId"`
+	PityDraws          int                `json:"pityDraws"`
+	MultiDrawGuarantee bool               `json:"multiDrawGuarantee"`
+	Items              []*GachaItemRate   `json:"items"`
+	Rarities           []*GachaRarityRate `json:"rarities"`
+	// Total 排出率の合計(%)。排出アイテムがあれば100になる
+	Total float64 `json:"total"`
+
+	totalUnits int64
+}
+
+type GachaItemRate struct {
+	GachaItemID int64  `json:"gachaItemId"`
+	ItemType    int    `json:"itemType"`
+	ItemID      int64  `json:"itemId"`
+	Amount      int    `json:"amount"`
+	Rarity      string `json:"rarity"`
+	// Rate 排出率(%)。小数第3位まで
+	Rate float64 `json:"rate"`
+
+	weight int
+	units  int64
+}
+
+type GachaRarityRate struct {
+	Rarity string `json:"rarity"`
+	// Rate 排出率(%)。アイテムごとの排出率の合計
+	Rate float64 `json:"rate"`
+}
+
+// computeGachaRates weightから排出率を計算する
+// 最大剰余方式で丸めるので、アイテムごとの排出率の合計は常にちょうど100%になる
+func computeGachaRates(gacha *GachaMaster, items []*GachaItemMaster) *GachaRates {
+	rates := &GachaRates{
+		GachaID:            gacha.ID,
+		PityDraws:          gacha.PityDraws,
+		MultiDrawGuarantee: gacha.MultiDrawGuarantee,
+		Items:              make([]*GachaItemRate, 0, len(items)),
+		Rarities:           make([]*GachaRarityRate, 0, 2),
+	}
+
+	var sum int64 = 0
+	for _, v := range items {
+		if v.Weight > 0 {
+			sum += int64(v.Weight)
+		}
+	}
+
+	units := make([]int64, len(items))
+	if sum > 0 {
+		remainders := make([]int64, len(items))
+		var allocated int64 = 0
+		for i, v := range items {
+			if v.Weight <= 0 {
+				continue
+			}
+			units[i] = int64(v.Weight) * gachaRateScale / sum
+			remainders[i] = int64(v.Weight) * gachaRateScale % sum
+			allocated += units[i]
+		}
+
+		// 端数の大きい順に1単位ずつ配る。同じなら先のアイテムを優先する
+		order := make([]int, len(items))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return remainders[order[a]] > remainders[order[b]]
+		})
+		for i := 0; allocated < gachaRateScale; i++ {
+			units[order[i]]++
+			allocated++
+		}
+	}
+
+	var rareUnits, normalUnits int64 = 0, 0
+	for i, v := range items {
+		rarity := GachaRarityNormal
+		if v.IsRare {
+			rarity = GachaRarityRare
+			rareUnits += units[i]
+		} else {
+			normalUnits += units[i]
+		}
+		rates.totalUnits += units[i]
+		rates.Items = append(rates.Items, &GachaItemRate{
+			GachaItemID: v.ID,
+			ItemType:    v.ItemType,
+			ItemID:      v.ItemID,
+			Amount:      v.Amount,
+			Rarity:      rarity,
+			Rate:        gachaRatePercent(units[i]),
+			weight:      v.Weight,
+			units:       units[i],
+		})
+	}
+	rates.Rarities = append(rates.Rarities,
+		&GachaRarityRate{Rarity: GachaRarityRare, Rate: gachaRatePercent(rareUnits)},
+		&GachaRarityRate{Rarity: GachaRarityNormal, Rate: gachaRatePercent(normalUnits)},
+	)
+	rates.Total = gachaRatePercent(rates.totalUnits)
+
+	return rates
+}
+
+// problems 排出率を開示するうえで問題のある点。無ければ空
+// 負のweight、引けるのに開示する排出率が0%に丸められるアイテム、引けるアイテムが無いことを返す
+func (r *GachaRates) problems() []string {
+	problems := make([]string, 0)
+	for _, v := range r.Items {
+		switch {
+		case v.weight < 0:
+			problems = append(problems, fmt.Sprintf("gacha item %d has a negative weight %d", v.GachaItemID, v.weight))
+		case v.weight > 0 && v.units == 0:
+			problems = append(problems, fmt.Sprintf("gacha item %d can be drawn but its rate rounds to 0.000%%", v.GachaItemID))
+		}
+	}
+	if r.totalUnits == 0 {
+		problems = append(problems, "no item can be drawn")
+	}
+	return problems
+}
+
+// gachaRatePercent 排出率の単位数を%にする
+func gachaRatePercent(units int64) float64 {
+	return math.Round(float64(units)*100000/float64(gachaRateScale)) / 1000
+}
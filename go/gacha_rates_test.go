@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestGachaRatesProblems(t *testing.T) {
+	cases := []struct {
+		name     string
+		weights  []int
+		problems int
+	}{
+		{name: "valid", weights: []int{1, 10, 89}, problems: 0},
+		{name: "negative weight", weights: []int{-5, 10, 90}, problems: 1},
+		{name: "rate rounds to zero", weights: []int{1, 1000000, 1000000, 1000000}, problems: 1},
+		{name: "empty pool", weights: []int{}, problems: 1},
+		{name: "no positive weight", weights: []int{0, -1}, problems: 2},
+	}
+
+	gacha := &GachaMaster{ID: 1, GachaType: GachaTypeNormal}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			items := make([]*GachaItemMaster, 0, len(tc.weights))
+			for i, w := range tc.weights {
+				items = append(items, &GachaItemMaster{ID: int64(i + 1), Weight: w})
+			}
+			if got := computeGachaRates(gacha, items).problems(); len(got) != tc.problems {
+				t.Errorf("got %d problems %v, expected %d", len(got), got, tc.problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+)
+
+// gachaRand ガチャの抽選に使う乱数
+type gachaRand interface {
+	Int63n(n int64) int64
+}
+
+// gachaSeed サーバの秘密鍵と抽選IDから抽選ごとのシードを作る
+func gachaSeed(secret []byte, drawID int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("gacha-draw:" + strconv.FormatInt(drawID, 10)))
+	return mac.Sum(nil)
+}
+
+// verifyGachaSeed 保存されたシードが秘密鍵と抽選IDから作られたものか
+func verifyGachaSeed(secret []byte, drawID int64, seed string) bool {
+	b, err := hex.DecodeString(seed)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(b, gachaSeed(secret, drawID))
+}
+
+// gachaDRBG シードからHMAC-SHA256のカウンタモードで乱数列を作る
+// 同じシードからは常に同じ乱数列になるので、保存したシードから抽選を再現できる
+type gachaDRBG struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func newGachaDRBG(seed []byte) *gachaDRBG {
+	return &gachaDRBG{seed: seed}
+}
+
+// Uint64 次の64bitを返す
+func (r *gachaDRBG) Uint64() uint64 {
+	if len(r.buf) < 8 {
+		var block [8]byte
+		binary.BigEndian.PutUint64(block[:], r.counter)
+		r.counter++
+
+		mac := hmac.New(sha256.New, r.seed)
+		mac.Write(block[:])
+		r.buf = mac.Sum(nil)
+	}
+	v := binary.BigEndian.Uint64(r.buf[:8])
+	r.buf = r.buf[8:]
+	return v
+}
+
+// Int63n [0,n)の一様な乱数。剰余の偏りが出ないよう範囲外の値は引き直す
+func (r *gachaDRBG) Int63n(n int64) int64 {
+	if n <= 0 {
+		panic("invalid argument to Int63n")
+	}
+	max := int64((1 << 63) - 1 - (1<<63)%uint64(n))
+	for {
+		v := int64(r.Uint64() >> 1)
+		if v <= max {
+			return v % n
+		}
+	}
+}
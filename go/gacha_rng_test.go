@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+// chiSquare 観測回数と期待値からカイ二乗値を求める
+func chiSquare(observed []int64, expected []float64) float64 {
+	var x float64
+	for i := range observed {
+		d := float64(observed[i]) - expected[i]
+		x += d * d / expected[i]
+	}
+	return x
+}
+
+func TestPickGachaItemFollowsWeights(t *testing.T) {
+	items := []*GachaItemMaster{
+		{ID: 1, Weight: 1},
+		{ID: 2, Weight: 5},
+		{ID: 3, Weight: 10},
+		{ID: 4, Weight: 30},
+		{ID: 5, Weight: 54},
+	}
+	const draws = 200000
+	// 自由度4、有意水準0.1%のカイ二乗分布の上側点
+	const critical = 18.467
+
+	for drawID := int64(1); drawID <= 3; drawID++ {
+		rng := newGachaDRBG(gachaSeed([]byte("test-secret"), drawID))
+		index := make(map[int64]int, len(items))
+		for i, v := range items {
+			index[v.ID] = i
+		}
+
+		observed := make([]int64, len(items))
+		for i := 0; i < draws; i++ {
+			observed[index[pickGachaItem(items, rng).ID]]++
+		}
+
+		var sum int
+		for _, v := range items {
+			sum += v.Weight
+		}
+		expected := make([]float64, len(items))
+		for i, v := range items {
+			expected[i] = float64(draws) * float64(v.Weight) / float64(sum)
+		}
+
+		if x := chiSquare(observed, expected); x > critical {
+			t.Errorf("drawID=%d: chi-square %.3f exceeds %.3f (observed=%v, expected=%v)", drawID, x, critical, observed, expected)
+		}
+	}
+}
+
+func TestPickGachaItemSkipsZeroWeight(t *testing.T) {
+	items := []*GachaItemMaster{
+		{ID: 1, Weight: 0},
+		{ID: 2, Weight: 3},
+		{ID: 3, Weight: 0},
+	}
+	rng := newGachaDRBG(gachaSeed([]byte("test-secret"), 1))
+	for i := 0; i < 1000; i++ {
+		if got := pickGachaItem(items, rng); got.ID != 2 {
+			t.Fatalf("picked item %d with zero weight", got.ID)
+		}
+	}
+}
+
+func TestGachaDRBGInt63nIsUniform(t *testing.T) {
+	cases := []struct {
+		n        int64
+		critical float64 // 自由度n-1、有意水準0.1%のカイ二乗分布の上側点
+	}{
+		{n: 2, critical: 10.828},
+		{n: 7, critical: 22.458},
+		{n: 10, critical: 27.877},
+	}
+	const draws = 100000
+
+	for _, tc := range cases {
+		rng := newGachaDRBG(gachaSeed([]byte("test-secret"), tc.n))
+		observed := make([]int64, tc.n)
+		for i := 0; i < draws; i++ {
+			v := rng.Int63n(tc.n)
+			if v < 0 || v >= tc.n {
+				t.Fatalf("n=%d: Int63n returned %d", tc.n, v)
+			}
+			observed[v]++
+		}
+		expected := make([]float64, tc.n)
+		for i := range expected {
+			expected[i] = float64(draws) / float64(tc.n)
+		}
+		if x := chiSquare(observed, expected); x > tc.critical {
+			t.Errorf("n=%d: chi-square %.3f exceeds %.3f (observed=%v)", tc.n, x, tc.critical, observed)
+		}
+	}
+}
+
+func TestGachaDRBGIsDeterministic(t *testing.T) {
+	seed := gachaSeed([]byte("test-secret"), 42)
+	a := newGachaDRBG(seed)
+	b := newGachaDRBG(seed)
+	for i := 0; i < 100; i++ {
+		if x, y := a.Uint64(), b.Uint64(); x != y {
+			t.Fatalf("sequence diverged at %d: %d != %d", i, x, y)
+		}
+	}
+
+	other := newGachaDRBG(gachaSeed([]byte("test-secret"), 43))
+	same := true
+	c := newGachaDRBG(seed)
+	for i := 0; i < 10; i++ {
+		if c.Uint64() != other.Uint64() {
+			same = false
+		}
+	}
+	if same {
+		t.Fatal("different draw IDs produced the same sequence")
+	}
+}
+
+func TestReplayGachaDrawReproducesResult(t *testing.T) {
+	secret := []byte("test-secret")
+	cases := []struct {
+		name  string
+		gacha *GachaMaster
+		count int
+		pity  *UserGachaPity
+	}{
+		{
+			name:  "normal",
+			gacha: &GachaMaster{ID: 1, GachaType: GachaTypeNormal},
+			count: 10,
+			pity:  &UserGachaPity{UserID: 100, GachaID: 1},
+		},
+		{
+			name:  "pity and multi draw guarantee",
+			gacha: &GachaMaster{ID: 2, GachaType: GachaTypeNormal, PityDraws: 5, MultiDrawGuarantee: true},
+			count: 10,
+			pity:  &UserGachaPity{UserID: 100, GachaID: 2, DrawsSinceRare: 3, TotalDraws: 3},
+		},
+		{
+			name:  "box",
+			gacha: &GachaMaster{ID: 3, GachaType: GachaTypeBox},
+			count: 6,
+			pity:  &UserGachaPity{UserID: 100, GachaID: 3},
+		},
+	}
+	items := []*GachaItemMaster{
+		{ID: 11, ItemType: 2, ItemID: 1, Amount: 1, Weight: 2, IsRare: true},
+		{ID: 12, ItemType: 3, ItemID: 2, Amount: 3, Weight: 10},
+		{ID: 13, ItemType: 3, ItemID: 3, Amount: 5, Weight: 20},
+		{ID: 14, ItemType: 4, ItemID: 4, Amount: 1, Weight: 30},
+	}
+
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			drawID := int64(1000 + i)
+			before := *tc.pity
+			snapshot, err := json.Marshal(&GachaDrawSnapshot{Gacha: tc.gacha, Items: items, Pity: &before})
+			if err != nil {
+				t.Fatal(err)
+			}
+			seed := gachaSeed(secret, drawID)
+			draw := &UserGachaDraw{
+				ID:        drawID,
+				UserID:    tc.pity.UserID,
+				GachaID:   tc.gacha.ID,
+				DrawCount: tc.count,
+				Seed:      hex.EncodeToString(seed),
+				Snapshot:  string(snapshot),
+				CreatedAt: 1656000000,
+			}
+
+			pity := *tc.pity
+			result := drawGachaItems(tc.gacha, items, tc.count, &pity, newGachaDRBG(seed), draw.CreatedAt)
+			if err := draw.setResult(result); err != nil {
+				t.Fatal(err)
+			}
+
+			// 保存された値だけから再現する
+			stored := *draw
+			replayed, err := replayGachaDraw(&stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorded := make([]int64, 0, tc.count)
+			if err := json.Unmarshal([]byte(stored.Result), &recorded); err != nil {
+				t.Fatal(err)
+			}
+			got := gachaItemIDs(replayed)
+			if len(got) != len(recorded) {
+				t.Fatalf("replayed %d items, recorded %d", len(got), len(recorded))
+			}
+			for j := range recorded {
+				if got[j] != recorded[j] {
+					t.Fatalf("replay differs at %d: got %v, recorded %v", j, got, recorded)
+				}
+			}
+
+			if !verifyGachaSeed(secret, drawID, stored.Seed) {
+				t.Error("seed was not verified with the secret used to draw")
+			}
+			if verifyGachaSeed([]byte("other-secret"), drawID, stored.Seed) {
+				t.Error("seed was verified with a different secret")
+			}
+			if verifyGachaSeed(secret, drawID+1, stored.Seed) {
+				t.Error("seed was verified with a different draw ID")
+			}
+		})
+	}
+}
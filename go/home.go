@@ -22,9 +22,8 @@ func (h *Handler) home(c echo.Context) error {
 	}
 
 	// 装備情報
-	deck := new(UserDeck)
-	query := "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL"
-	if err = c.Get("db").(*sqlx.DB).Get(deck, query, userID); err != nil {
+	deck, err := getActiveDeck(c.Get("db").(*sqlx.DB), userID)
+	if err != nil {
 		if err != sql.ErrNoRows {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
@@ -35,7 +34,7 @@ func (h *Handler) home(c echo.Context) error {
 	cards := make([]*UserCard, 0)
 	if deck != nil {
 		cardIds := []int64{deck.CardID1, deck.CardID2, deck.CardID3}
-		query, params, err := sqlx.In("SELECT * FROM user_cards WHERE id IN (?)", cardIds)
+		query, params, err := sqlx.In("SELECT * FROM user_cards WHERE id IN (?) AND deleted_at IS NULL", cardIds)
 		if err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
@@ -50,7 +49,7 @@ func (h *Handler) home(c echo.Context) error {
 
 	// 経過時間
 	user := new(User)
-	query = "SELECT * FROM users WHERE id=?"
+	query := "SELECT * FROM users WHERE id=?"
 	if err = c.Get("db").(*sqlx.DB).Get(user, query, userID); err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	IdempotencyKeyHeader string = "Idempotency-Key"
+	// idempotencyKeyMaxLength キーの最大長
+	idempotencyKeyMaxLength int = 255
+	// idempotencyKeyTTL キーとレスポンスを保持する秒数
+	idempotencyKeyTTL int64 = 24 * 60 * 60
+)
+
+// UserIdempotencyKey 冪等キーと、そのキーで処理したリクエストのレスポンス
+type UserIdempotencyKey struct {
+	UserID         int64  `json:"userId" db:"user_id"`
+	IdempotencyKey string `json:"idempotencyKey" db:"idempotency_key"`
+	// RequestHash メソッド、パス、ボディのハッシュ
+	RequestHash string `json:"requestHash" db:"request_hash"`
+	// StatusCode 処理中ならnil
+	StatusCode   *int    `json:"statusCode" db:"status_code"`
+	ContentType  *string `json:"contentType" db:"content_type"`
+	ResponseBody []byte  `json:"-" db:"response_body"`
+	CreatedAt    int64   `json:"createdAt" db:"created_at"`
+	ExpiredAt    int64   `json:"expiredAt" db:"expired_at"`
+}
+
+// idempotencyMiddleware Idempotency-Keyヘッダのある更新リクエストのレスポンスをユーザのシャードに保存し、同じキーでの再送には保存したレスポンスを返す
+// 同じキーで違うリクエストが来た場合と、最初のリクエストがまだ処理中の場合は409を返す
+func (h *Handler) idempotencyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(IdempotencyKeyHeader)
+		if key == "" || c.Request().Method == http.MethodGet {
+			return next(c)
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			return errorResponse(c, http.StatusBadRequest, ErrInvalidIdempotencyKey)
+		}
+
+		userID, err := getUserID(c)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		requestAt, err := getRequestTime(c)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+		}
+
+		// ボディは後続のハンドラでも読むので戻しておく
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		c.Request().Body.Close()
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		hash := idempotencyRequestHash(c.Request().Method, c.Request().URL.Path, body)
+
+		db := c.Get("db").(*sqlx.DB)
+		stored, err := claimIdempotencyKey(db, userID, key, hash, requestAt)
+		if err != nil {
+			if err == ErrIdempotencyKeyInProgress {
+				return errorResponse(c, http.StatusConflict, err)
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if stored != nil {
+			if stored.RequestHash != hash {
+				return errorResponse(c, http.StatusConflict, ErrIdempotencyKeyMismatch)
+			}
+			if stored.StatusCode == nil {
+				return errorResponse(c, http.StatusConflict, ErrIdempotencyKeyInProgress)
+			}
+			contentType := echo.MIMEApplicationJSONCharsetUTF8
+			if stored.ContentType != nil {
+				contentType = *stored.ContentType
+			}
+			c.Response().Header().Set("Idempotent-Replayed", "true")
+			return c.Blob(*stored.StatusCode, contentType, stored.ResponseBody)
+		}
+
+		recorder := &idempotencyRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = recorder
+		if err = next(c); err != nil {
+			c.Error(err)
+		}
+
+		// サーバエラーは処理されなかったものとして、同じキーでやり直せるようにする
+		status := c.Response().Status
+		if status >= http.StatusInternalServerError {
+			if _, derr := db.Exec("DELETE FROM user_idempotency_keys WHERE user_id=? AND idempotency_key=?", userID, key); derr != nil {
+				c.Logger().Errorf("failed to release idempotency key: %v", derr)
+			}
+			return nil
+		}
+		query := "UPDATE user_idempotency_keys SET status_code=?, content_type=?, response_body=? WHERE user_id=? AND idempotency_key=?"
+		if _, err = db.Exec(query, status, c.Response().Header().Get(echo.HeaderContentType), recorder.body.Bytes(), userID, key); err != nil {
+			c.Logger().Errorf("failed to save idempotent response: %v", err)
+		}
+		return nil
+	}
+}
+
+// claimIdempotencyKey キーを処理中として登録する。既に有効なキーがあればそれを返す
+func claimIdempotencyKey(db *sqlx.DB, userID int64, key, hash string, requestAt int64) (*UserIdempotencyKey, error) {
+	// 期限切れのキーは使われていないものとして扱う
+	query := "DELETE FROM user_idempotency_keys WHERE user_id=? AND idempotency_key=? AND expired_at <= ?"
+	if _, err := db.Exec(query, userID, key, requestAt); err != nil {
+		return nil, err
+	}
+
+	query = "INSERT INTO user_idempotency_keys(user_id, idempotency_key, request_hash, created_at, expired_at) VALUES (?, ?, ?, ?, ?)"
+	if _, err := db.Exec(query, userID, key, hash, requestAt, requestAt+idempotencyKeyTTL); err == nil {
+		return nil, nil
+	} else if merr, ok := err.(*mysql.MySQLError); !ok || merr.Number != 1062 {
+		return nil, err
+	}
+
+	stored := new(UserIdempotencyKey)
+	query = "SELECT * FROM user_idempotency_keys WHERE user_id=? AND idempotency_key=?"
+	if err := db.Get(stored, query, userID, key); err != nil {
+		if err == sql.ErrNoRows {
+			// 登録しようとした間に最初のリクエストがサーバエラーで取り消された
+			return nil, ErrIdempotencyKeyInProgress
+		}
+		return nil, err
+	}
+	return stored, nil
+}
+
+// idempotencyRequestHash 同じキーで同じリクエストが送られたかを比べるためのハッシュ
+func idempotencyRequestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyRecorder レスポンスを書きながらボディを控える
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// LevelCurveExponential base_exp_per_levelからexp_rateの倍率で必要経験値が増える
+	LevelCurveExponential int = 1
+	// LevelCurveTable exp_tableでレベルごとの必要経験値を直接決める
+	LevelCurveTable int = 2
+	// LevelCurvePiecewise exp_segmentsでレベル帯ごとに倍率を変える
+	LevelCurvePiecewise int = 3
+)
+
+// levelCurveRateScale exp_rateの単位。1000で1倍
+const levelCurveRateScale float64 = 1000
+
+// defaultLevelCurve level_curve_idが0のカードの成長曲線。必要経験値が前のレベルの1.2倍、生産性は線形に上がる
+var defaultLevelCurve = &LevelCurveMaster{
+	CurveType: LevelCurveExponential,
+	ExpRate:   1200,
+}
+
+// LevelCurveMaster カードの必要経験値と生産性の成長曲線
+type LevelCurveMaster struct {
+	ID        int64  `json:"id" db:"id"`
+	Name      string `json:"name" db:"name"`
+	CurveType int    `json:"curveType" db:"curve_type"`
+	// ExpRate LevelCurveExponentialの1レベルごとの倍率(1000で1倍)
+	ExpRate int `json:"expRate" db:"exp_rate"`
+	// ExpTableList LevelCurveTableのlv1 -> lv2から順に必要な累計経験値のカンマ区切り
+	ExpTableList string `json:"expTable" db:"exp_table"`
+	// ExpSegmentList LevelCurvePiecewiseの「開始レベル:倍率」のカンマ区切り
+	ExpSegmentList string `json:"expSegments" db:"exp_segments"`
+	// AmountTableList lv2から順にレベルが上がったときの生産性の増分のカンマ区切り。足りないレベルは線形
+	AmountTableList string `json:"amountTable" db:"amount_table"`
+	CreatedAt       int64  `json:"createdAt" db:"created_at"`
+}
+
+// levelCurveSegment fromLevelから上がるときの必要経験値の倍率
+type levelCurveSegment struct {
+	FromLevel int
+	Rate      int
+}
+
+// parseLevelCurveInts カンマ区切りの0以上の整数。読めない値があればnil
+func parseLevelCurveInts(list string) []int {
+	values := make([]int, 0)
+	if strings.TrimSpace(list) == "" {
+		return values
+	}
+	for _, v := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			return nil
+		}
+		values = append(values, n)
+	}
+	return values
+}
+
+// ExpTable LevelCurveTableの必要な累計経験値。読めなければnil
+func (l *LevelCurveMaster) ExpTable() []int {
+	return parseLevelCurveInts(l.ExpTableList)
+}
+
+// AmountTable レベルごとの生産性の増分。読めなければnil
+func (l *LevelCurveMaster) AmountTable() []int {
+	return parseLevelCurveInts(l.AmountTableList)
+}
+
+// ExpSegments LevelCurvePiecewiseのレベル帯。読めなければnil
+func (l *LevelCurveMaster) ExpSegments() []*levelCurveSegment {
+	segments := make([]*levelCurveSegment, 0)
+	for _, v := range strings.Split(l.ExpSegmentList, ",") {
+		pair := strings.SplitN(strings.TrimSpace(v), ":", 2)
+		if len(pair) != 2 {
+			return nil
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(pair[0]))
+		if err != nil || from < 1 {
+			return nil
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(pair[1]))
+		if err != nil || rate <= 0 {
+			return nil
+		}
+		segments = append(segments, &levelCurveSegment{FromLevel: from, Rate: rate})
+	}
+	return segments
+}
+
+// expThreshold levelからlevel+1に上がるのに必要な累計経験値。上がれないレベルならmath.MaxInt
+func (l *LevelCurveMaster) expThreshold(baseExpPerLevel int, level int) int {
+	switch l.CurveType {
+	case LevelCurveTable:
+		table := l.ExpTable()
+		if level < 1 || level > len(table) {
+			return math.MaxInt
+		}
+		return table[level-1]
+	case LevelCurvePiecewise:
+		// lv1 -> lv2はbase_exp_per_levelで、以降はそのレベルが入る帯の倍率を掛けていく
+		segments := l.ExpSegments()
+		exp := float64(baseExpPerLevel)
+		for lv := 2; lv <= level; lv++ {
+			rate := levelCurveRateScale
+			for _, s := range segments {
+				if s.FromLevel <= lv {
+					rate = float64(s.Rate)
+				}
+			}
+			exp *= rate / levelCurveRateScale
+		}
+		return int(exp)
+	default:
+		return int(float64(baseExpPerLevel) * math.Pow(float64(l.ExpRate)/levelCurveRateScale, float64(level-1)))
+	}
+}
+
+// amountGain levelに上がったときの生産性の増分。amount_tableに無いレベルはlv1からlv maxまで線形
+func (l *LevelCurveMaster) amountGain(level int, baseAmountPerSec, maxAmountPerSec, maxLevel int) int {
+	if table := l.AmountTable(); level >= 2 && level-2 < len(table) {
+		return table[level-2]
+	}
+	if maxLevel <= 1 {
+		return 0
+	}
+	return (maxAmountPerSec - baseAmountPerSec) / (maxLevel - 1)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDefaultLevelCurveMatchesLegacyFormula(t *testing.T) {
+	cases := []struct {
+		name             string
+		baseExpPerLevel  int
+		baseAmountPerSec int
+		maxAmountPerSec  int
+		maxLevel         int
+	}{
+		{name: "small", baseExpPerLevel: 10, baseAmountPerSec: 1, maxAmountPerSec: 10, maxLevel: 10},
+		{name: "uneven amount", baseExpPerLevel: 300, baseAmountPerSec: 15, maxAmountPerSec: 100, maxLevel: 13},
+		{name: "large", baseExpPerLevel: 5000, baseAmountPerSec: 100, maxAmountPerSec: 5000, maxLevel: 50},
+		{name: "single level", baseExpPerLevel: 100, baseAmountPerSec: 7, maxAmountPerSec: 7, maxLevel: 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for level := 1; level <= tc.maxLevel; level++ {
+				want := int(float64(tc.baseExpPerLevel) * math.Pow(1.2, float64(level-1)))
+				if got := defaultLevelCurve.expThreshold(tc.baseExpPerLevel, level); got != want {
+					t.Errorf("expThreshold(lv%d)=%d, expected %d", level, got, want)
+				}
+			}
+			for level := 2; level <= tc.maxLevel; level++ {
+				want := (tc.maxAmountPerSec - tc.baseAmountPerSec) / (tc.maxLevel - 1)
+				if got := defaultLevelCurve.amountGain(level, tc.baseAmountPerSec, tc.maxAmountPerSec, tc.maxLevel); got != want {
+					t.Errorf("amountGain(lv%d)=%d, expected %d", level, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLevelCurveExpThreshold(t *testing.T) {
+	cases := []struct {
+		name  string
+		curve *LevelCurveMaster
+		base  int
+		want  []int // lv1から順の必要な累計経験値
+	}{
+		{
+			name:  "exponential",
+			curve: &LevelCurveMaster{CurveType: LevelCurveExponential, ExpRate: 1500},
+			base:  100,
+			want:  []int{100, 150, 225, 337},
+		},
+		{
+			name:  "table",
+			curve: &LevelCurveMaster{CurveType: LevelCurveTable, ExpTableList: "10, 30,60,100"},
+			base:  999,
+			want:  []int{10, 30, 60, 100, math.MaxInt},
+		},
+		{
+			name:  "piecewise",
+			curve: &LevelCurveMaster{CurveType: LevelCurvePiecewise, ExpSegmentList: "2:2000,4:1000,5:1500"},
+			base:  100,
+			want:  []int{100, 200, 400, 400, 600, 900},
+		},
+		{
+			name:  "piecewise starting later",
+			curve: &LevelCurveMaster{CurveType: LevelCurvePiecewise, ExpSegmentList: "3:3000"},
+			base:  10,
+			want:  []int{10, 10, 30, 90},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i, want := range tc.want {
+				if got := tc.curve.expThreshold(tc.base, i+1); got != want {
+					t.Errorf("expThreshold(lv%d)=%d, expected %d", i+1, got, want)
+				}
+			}
+			if got := tc.curve.expThreshold(tc.base, 0); tc.curve.CurveType == LevelCurveTable && got != math.MaxInt {
+				t.Errorf("expThreshold(lv0)=%d, expected math.MaxInt", got)
+			}
+		})
+	}
+}
+
+func TestLevelCurveAmountGain(t *testing.T) {
+	cases := []struct {
+		name  string
+		curve *LevelCurveMaster
+		want  []int // lv2から順の生産性の増分
+	}{
+		{
+			name:  "linear",
+			curve: &LevelCurveMaster{CurveType: LevelCurveExponential, ExpRate: 1200},
+			want:  []int{10, 10, 10, 10},
+		},
+		{
+			name:  "table",
+			curve: &LevelCurveMaster{CurveType: LevelCurveTable, ExpTableList: "1,2,3,4", AmountTableList: "5,15,20,0"},
+			want:  []int{5, 15, 20, 0},
+		},
+		{
+			name:  "table shorter than max level falls back to linear",
+			curve: &LevelCurveMaster{CurveType: LevelCurvePiecewise, ExpSegmentList: "2:1100", AmountTableList: "1,2"},
+			want:  []int{1, 2, 10, 10},
+		},
+	}
+
+	const baseAmountPerSec, maxAmountPerSec, maxLevel = 10, 50, 5
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i, want := range tc.want {
+				if got := tc.curve.amountGain(i+2, baseAmountPerSec, maxAmountPerSec, maxLevel); got != want {
+					t.Errorf("amountGain(lv%d)=%d, expected %d", i+2, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseLevelCurveLists(t *testing.T) {
+	cases := []struct {
+		name     string
+		curve    *LevelCurveMaster
+		table    bool
+		segments bool
+	}{
+		{name: "valid", curve: &LevelCurveMaster{ExpTableList: "1, 2,3", ExpSegmentList: "1:1000, 3:1200"}, table: true, segments: true},
+		{name: "negative exp", curve: &LevelCurveMaster{ExpTableList: "1,-2", ExpSegmentList: "1:1000"}, table: false, segments: true},
+		{name: "broken segment", curve: &LevelCurveMaster{ExpTableList: "1", ExpSegmentList: "1-1000"}, table: true, segments: false},
+		{name: "zero rate", curve: &LevelCurveMaster{ExpTableList: "x", ExpSegmentList: "2:0"}, table: false, segments: false},
+		{name: "level zero", curve: &LevelCurveMaster{ExpSegmentList: "0:1000"}, table: true, segments: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.curve.ExpTable() != nil; got != tc.table {
+				t.Errorf("ExpTable() parsed=%v, expected %v", got, tc.table)
+			}
+			if got := tc.curve.ExpSegments() != nil; got != tc.segments {
+				t.Errorf("ExpSegments() parsed=%v, expected %v", got, tc.segments)
+			}
+		})
+	}
+}
+
+func TestLevelUpWithLimitBreak(t *testing.T) {
+	cases := []struct {
+		name       string
+		limitBreak int
+		levels     int
+		amount     int
+		wantLevel  int
+		wantAmount int
+	}{
+		{name: "no limit break", limitBreak: 0, levels: 3, amount: 10, wantLevel: 5, wantAmount: 50},
+		{name: "divisible", limitBreak: 1, levels: 2, amount: 10, wantLevel: 7, wantAmount: 60},
+		{name: "remainder is added on the last level", limitBreak: 2, levels: 3, amount: 10, wantLevel: 11, wantAmount: 70},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &TargetUserCardData{
+				AmountPerSec:           10,
+				Level:                  1,
+				TotalExp:               math.MaxInt32,
+				BaseAmountPerSec:       10,
+				MaxLevel:               5,
+				MaxAmountPerSec:        50,
+				BaseExpPerLevel:        1,
+				LimitBreak:             tc.limitBreak,
+				LimitBreakLevels:       tc.levels,
+				LimitBreakAmountPerSec: tc.amount,
+				Curve:                  defaultLevelCurve,
+			}
+			c.levelUp()
+			if c.Level != tc.wantLevel {
+				t.Errorf("level=%d, expected %d", c.Level, tc.wantLevel)
+			}
+			if c.AmountPerSec != tc.wantAmount {
+				t.Errorf("amountPerSec=%d, expected %d", c.AmountPerSec, tc.wantAmount)
+			}
+			if c.AmountPerSec != c.amountPerSecCap() {
+				t.Errorf("amountPerSec=%d, cap is %d", c.AmountPerSec, c.amountPerSecCap())
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -20,34 +21,98 @@ import (
 )
 
 var (
-	ErrInvalidRequestBody       error = fmt.Errorf("invalid request body")
-	ErrInvalidMasterVersion     error = fmt.Errorf("invalid master version")
-	ErrInvalidItemType          error = fmt.Errorf("invalid item type")
-	ErrInvalidToken             error = fmt.Errorf("invalid token")
-	ErrGetRequestTime           error = fmt.Errorf("failed to get request time")
-	ErrExpiredSession           error = fmt.Errorf("session expired")
-	ErrUserNotFound             error = fmt.Errorf("not found user")
-	ErrUserDeviceNotFound       error = fmt.Errorf("not found user device")
-	ErrItemNotFound             error = fmt.Errorf("not found item")
-	ErrLoginBonusRewardNotFound error = fmt.Errorf("not found login bonus reward")
-	ErrNoFormFile               error = fmt.Errorf("no such file")
-	ErrUnauthorized             error = fmt.Errorf("unauthorized user")
-	ErrForbidden                error = fmt.Errorf("forbidden")
-	ErrGeneratePassword         error = fmt.Errorf("failed to password hash") //nolint:deadcode
+	ErrInvalidRequestBody          error = fmt.Errorf("invalid request body")
+	ErrInvalidMasterVersion        error = fmt.Errorf("invalid master version")
+	ErrInvalidItemType             error = fmt.Errorf("invalid item type")
+	ErrInvalidToken                error = fmt.Errorf("invalid token")
+	ErrGetRequestTime              error = fmt.Errorf("failed to get request time")
+	ErrExpiredSession              error = fmt.Errorf("session expired")
+	ErrUserNotFound                error = fmt.Errorf("not found user")
+	ErrUserDeviceNotFound          error = fmt.Errorf("not found user device")
+	ErrItemNotFound                error = fmt.Errorf("not found item")
+	ErrLoginBonusRewardNotFound    error = fmt.Errorf("not found login bonus reward")
+	ErrNoFormFile                  error = fmt.Errorf("no such file")
+	ErrUnauthorized                error = fmt.Errorf("unauthorized user")
+	ErrForbidden                   error = fmt.Errorf("forbidden")
+	ErrGeneratePassword            error = fmt.Errorf("failed to password hash") //nolint:deadcode
+	ErrActiveMasterVersionNotFound error = fmt.Errorf("active master version is not found")
+	ErrActivationNotFound          error = fmt.Errorf("not found master activation")
+	ErrMasterUpdateNotFound        error = fmt.Errorf("not found master update")
+	ErrMasterUpdateNotRepairable   error = fmt.Errorf("master update is not waiting for repair")
+	ErrMasterTableNotFound         error = fmt.Errorf("not found master table")
+	ErrMasterVersionNotFound       error = fmt.Errorf("not found master version")
+	ErrInvalidExportFormat         error = fmt.Errorf("invalid export format")
+	ErrMasterVersionAlreadyActive  error = fmt.Errorf("master version is already active")
+	ErrInvalidMasterCSV            error = fmt.Errorf("invalid master csv")
+	ErrInvalidShard                error = fmt.Errorf("invalid shard")
+	ErrMigrationNotFound           error = fmt.Errorf("not found shard migration")
+	ErrMigrationInProgress         error = fmt.Errorf("shard migration is in progress")
+	ErrMigrationConflict           error = fmt.Errorf("user has been moved to another shard")
+	ErrMigrationLockTimeout        error = fmt.Errorf("timed out waiting for shard migration")
+	ErrMigrationBarrierTimeout     error = fmt.Errorf("timed out waiting for nodes to acknowledge shard migration")
+	ErrGachaDrawNotFound           error = fmt.Errorf("not found gacha draw")
+	ErrInvalidDrawCount            error = fmt.Errorf("invalid draw gacha times")
+	ErrNotEnoughGachaItem          error = fmt.Errorf("not enough gacha cost item")
+	ErrGachaBoxNotEnough           error = fmt.Errorf("not enough items left in gacha box")
+	ErrNotBoxGacha                 error = fmt.Errorf("gacha is not a box gacha")
+	ErrDailyDrawLimitExceeded      error = fmt.Errorf("daily draw limit exceeded")
+	ErrFreeDrawUnavailable         error = fmt.Errorf("free draw is not available")
+	ErrNotEnoughCoin               error = fmt.Errorf("not enough isucon")
+	ErrInvalidIdempotencyKey       error = fmt.Errorf("invalid idempotency key")
+	ErrIdempotencyKeyMismatch      error = fmt.Errorf("idempotency key is already used for a different request")
+	ErrIdempotencyKeyInProgress    error = fmt.Errorf("request with the same idempotency key is in progress")
+	ErrCardNotLimitBreakable       error = fmt.Errorf("target card can not be limit broken")
+	ErrLimitBreakExceeded          error = fmt.Errorf("limit break exceeds the max")
+	ErrInvalidLimitBreakMaterial   error = fmt.Errorf("invalid limit break material")
+	ErrNotEnoughLimitBreakItem     error = fmt.Errorf("not enough limit break item")
+	ErrCardMaxLevel                error = fmt.Errorf("target card is max level")
+	ErrNotEnoughExpItem            error = fmt.Errorf("item not enough")
+	ErrExpOverflow                 error = fmt.Errorf("items exceed the exp needed for max level")
+	ErrCardNotFound                error = fmt.Errorf("not found card")
+	ErrInvalidSellCards            error = fmt.Errorf("invalid card ids")
+	ErrCardInDeck                  error = fmt.Errorf("card is in the deck")
+	ErrCardNotSellable             error = fmt.Errorf("card can not be sold")
+	ErrInvalidDeckSlot             error = fmt.Errorf("invalid deck slot")
+	ErrInvalidDeckName             error = fmt.Errorf("invalid deck name")
+	ErrDeckNotFound                error = fmt.Errorf("not found deck")
 )
 
 const (
 	DeckCardNumber      int = 3
 	PresentCountPerPage int = 100
+	// DeckSlotCount ユーザが保存できるデッキの数
+	DeckSlotCount int = 5
+	// DeckNameMaxLength デッキ名の最大バイト数
+	DeckNameMaxLength int = 64
+	// GachaHistoryCountPerPage ガチャ履歴の1ページの件数
+	GachaHistoryCountPerPage int = 100
+	// CoinHistoryCountPerPage ISU-COINの履歴の1ページの件数
+	CoinHistoryCountPerPage int = 100
 
 	SQLDirectory string = "../sql/"
 )
 
 type Handler struct {
-	DB  *sqlx.DB
-	DB2 *sqlx.DB
-	DB3 *sqlx.DB
-	DB4 *sqlx.DB
+	// DB 管理系のテーブルを持つプライマリ(Shards[0]と同じ)
+	DB       *sqlx.DB
+	Shards   []*sqlx.DB
+	Router   ShardRouter
+	Migrator *shardMigrator
+
+	// Sessions セッションIDからユーザとシャードを引くディレクトリ
+	Sessions SessionStore
+	// SessionFallback ディレクトリとユーザのシャードの両方で見つからない場合に全シャードを探す
+	SessionFallback  bool
+	sessionFallbacks int64
+	// sessionRevocationSeq ディレクトリに反映したuser_session_revocationsの最後のID
+	sessionRevocationSeq int64
+
+	// GachaSecret ガチャの抽選ごとのシードを作る秘密鍵
+	GachaSecret []byte
+	// Tokens ワンタイムトークンの発行と消費
+	Tokens *TokenService
+	// ExpOverflowPolicy カードの最高レベルを超える経験値の扱い
+	ExpOverflowPolicy string
 }
 
 var d = helpisu.NewDBDisconnectDetector(5, 80)
@@ -64,78 +129,97 @@ func main() {
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"*"},
 		AllowMethods: []string{http.MethodGet, http.MethodPost},
-		AllowHeaders: []string{"Content-Type", "x-master-version", "x-session"},
+		AllowHeaders: []string{"Content-Type", "x-master-version", "x-session", IdempotencyKeyHeader},
 	}))
 
 	e.JSONSerializer = helpisu.NewSonicSerializer()
 
 	// connect db
-	dbx1, err := connectDB(false, 1)
+	shardConfig, err := loadShardConfig()
 	if err != nil {
-		e.Logger.Fatalf("failed to connect to db: %v", err)
+		e.Logger.Fatalf("failed to load shard config: %v", err)
 	}
-	defer dbx1.Close()
-
-	helpisu.WaitDBStartUp(dbx1.DB)
-
-	dbx2, err := connectDB(false, 2)
-	if err != nil {
-		e.Logger.Fatalf("failed to connect to db: %v", err)
+	if err := validateShardHosts(shardConfig); err != nil {
+		e.Logger.Fatalf("invalid shard config: %v", err)
 	}
-	defer dbx2.Close()
-
-	helpisu.WaitDBStartUp(dbx2.DB)
-
-	dbx3, err := connectDB(false, 3)
+	router, err := newShardRouter(shardConfig)
 	if err != nil {
-		e.Logger.Fatalf("failed to connect to db: %v", err)
+		e.Logger.Fatalf("failed to create shard router: %v", err)
 	}
-	defer dbx3.Close()
-
-	helpisu.WaitDBStartUp(dbx3.DB)
 
-	dbx4, err := connectDB(false, 4)
-	if err != nil {
-		e.Logger.Fatalf("failed to connect to db: %v", err)
-	}
-	defer dbx4.Close()
+	shards := make([]*sqlx.DB, 0, shardConfig.Shards)
+	for i := 1; i <= shardConfig.Shards; i++ {
+		dbx, err := connectDB(false, i)
+		if err != nil {
+			e.Logger.Fatalf("failed to connect to db: %v", err)
+		}
+		defer dbx.Close()
 
-	helpisu.WaitDBStartUp(dbx3.DB)
+		helpisu.WaitDBStartUp(dbx.DB)
 
-	d.RegisterDB(dbx1.DB)
-	d.RegisterDB(dbx2.DB)
-	d.RegisterDB(dbx3.DB)
-	d.RegisterDB(dbx4.DB)
+		d.RegisterDB(dbx.DB)
+		shards = append(shards, dbx)
+	}
 	go d.Start()
 
 	// setting server
 	e.Server.Addr = fmt.Sprintf(":%v", "8080")
+	sessions, err := newSessionStore()
+	if err != nil {
+		e.Logger.Fatalf("failed to create session store: %v", err)
+	}
+
+	overrideRouter := newOverrideShardRouter(router)
 	h := &Handler{
-		DB:  dbx1,
-		DB2: dbx2,
-		DB3: dbx3,
-		DB4: dbx4,
+		DB:              shards[0],
+		Shards:          shards,
+		Router:          overrideRouter,
+		Sessions:        sessions,
+		SessionFallback: getEnv("ISUCON_SESSION_FALLBACK", "false") == "true",
+	}
+	// 既定値があると誰でもシードを計算できてしまうので、必ず設定してもらう
+	if h.GachaSecret = []byte(os.Getenv("ISUCON_GACHA_SECRET")); len(h.GachaSecret) == 0 {
+		e.Logger.Fatalf("ISUCON_GACHA_SECRET is required")
+	}
+	if h.ExpOverflowPolicy, err = parseExpOverflowPolicy(getEnv("ISUCON_EXP_OVERFLOW_POLICY", ExpOverflowRefund)); err != nil {
+		e.Logger.Fatalf("failed to read exp overflow policy: %v", err)
+	}
+	h.Migrator = newShardMigrator(h, overrideRouter)
+	if h.Tokens, err = newTokenService(h.generateID); err != nil {
+		e.Logger.Fatalf("failed to create token service: %v", err)
+	}
+	if err := h.Migrator.load(); err != nil {
+		e.Logger.Fatalf("failed to load shard overrides: %v", err)
 	}
 
 	// e.Use(middleware.CORS())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{}))
 
 	// utility
-	e.POST("/initialize", initialize)
+	e.POST("/initialize", h.initialize)
 	e.GET("/health", h.health)
 
 	// feature
 	API := e.Group("", h.apiMiddleware)
 	API.POST("/user", h.createUser)
 	API.POST("/login", h.login)
-	sessCheckAPI := API.Group("", h.selectDBMiddleware, h.checkSessionMiddleware)
+	sessCheckAPI := API.Group("", h.selectDBMiddleware, h.checkSessionMiddleware, h.idempotencyMiddleware)
 	sessCheckAPI.GET("/user/:userID/gacha/index", h.listGacha)
 	sessCheckAPI.POST("/user/:userID/gacha/draw/:gachaID/:n", h.drawGacha)
+	sessCheckAPI.GET("/user/:userID/gacha/history", h.listGachaHistory)
+	sessCheckAPI.GET("/user/:userID/gacha/:gachaID/rates", h.getGachaRates)
+	sessCheckAPI.POST("/user/:userID/gacha/:gachaID/box/reset", h.resetGachaBox)
 	sessCheckAPI.GET("/user/:userID/present/index/:n", h.listPresent)
 	sessCheckAPI.POST("/user/:userID/present/receive", h.receivePresent)
 	sessCheckAPI.GET("/user/:userID/item", h.listItem)
+	sessCheckAPI.GET("/user/:userID/coins/history", h.listCoinHistory)
 	sessCheckAPI.POST("/user/:userID/card/addexp/:cardID", h.addExpToCard)
+	sessCheckAPI.POST("/user/:userID/card/addexp/:cardID/preview", h.previewAddExpToCard)
+	sessCheckAPI.POST("/user/:userID/card/limitbreak/:cardID", h.limitBreakCard)
+	sessCheckAPI.POST("/user/:userID/card/sell", h.sellCards)
 	sessCheckAPI.POST("/user/:userID/card", h.updateDeck)
+	sessCheckAPI.GET("/user/:userID/decks", h.listDecks)
+	sessCheckAPI.POST("/user/:userID/deck/:slot/activate", h.activateDeck)
 	sessCheckAPI.POST("/user/:userID/reward", h.reward)
 	sessCheckAPI.GET("/user/:userID/home", h.home)
 
@@ -146,8 +230,34 @@ func main() {
 	adminAuthAPI.DELETE("/admin/logout", h.adminLogout)
 	adminAuthAPI.GET("/admin/master", h.adminListMaster)
 	adminAuthAPI.PUT("/admin/master", h.adminUpdateMaster)
+	adminAuthAPI.GET("/admin/master/export", h.adminExportMaster)
+	adminAuthAPI.GET("/admin/master/versions", h.adminListMasterVersions)
+	adminAuthAPI.GET("/admin/master/versions/:masterVersion/tables/:table", h.adminShowMasterVersionTable)
+	adminAuthAPI.POST("/admin/master/versions/:masterVersion/rollback", h.adminRollbackMaster)
+	adminAuthAPI.GET("/admin/master/updates", h.adminListMasterUpdates)
+	adminAuthAPI.POST("/admin/master/updates/:updateID/repair", h.adminRepairMasterUpdate)
+	adminAuthAPI.GET("/admin/master/consistency", h.adminCheckMasterConsistency)
+	adminAuthAPI.GET("/admin/gacha/rates", h.adminValidateGachaRates)
+	adminAuthAPI.GET("/admin/master/activations", h.adminListMasterActivations)
+	adminAuthAPI.POST("/admin/master/activations", h.adminScheduleMasterActivation)
+	adminAuthAPI.DELETE("/admin/master/activations/:activationID", h.adminCancelMasterActivation)
 	adminAuthAPI.GET("/admin/user/:userID", h.adminUser, h.selectDBMiddleware)
 	adminAuthAPI.POST("/admin/user/:userID/ban", h.adminBanUser, h.selectDBMiddleware)
+	adminAuthAPI.POST("/admin/user/:userID/gacha/draws/:drawID/replay", h.adminReplayGachaDraw, h.selectDBMiddleware)
+	adminAuthAPI.POST("/admin/user/:userID/coins", h.adminGrantCoins, h.selectDBMiddleware)
+	adminAuthAPI.GET("/admin/coins/reconciliation", h.adminReconcileCoins)
+	adminAuthAPI.GET("/admin/session/stats", h.adminSessionStats)
+	adminAuthAPI.GET("/admin/shard/migrations", h.adminListShardMigrations)
+	adminAuthAPI.POST("/admin/shard/migrations", h.adminStartShardMigration)
+	adminAuthAPI.GET("/admin/shard/migrations/:migrationID", h.adminShowShardMigration)
+	adminAuthAPI.POST("/admin/shard/migrations/:migrationID/rollback", h.adminRollbackShardMigration)
+
+	h.recoverMasterUpdates(e.Logger)
+	h.startSessionRevocation(e.Logger)
+	h.startMasterStoreRefresh(e.Logger)
+	h.startMasterActivationScheduler(e.Logger)
+	h.startCoinReconciliation(e.Logger)
+	h.Migrator.startRefresh(e.Logger)
 
 	e.Logger.Infof("Start server: address=%s", e.Server.Addr)
 	e.Logger.Error(e.StartServer(e.Server))
@@ -162,21 +272,17 @@ func (h *Handler) selectDBMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 
 		h.setDB(c, userID)
 
-		return next(c)
+		return h.Migrator.guard(c, userID, next)
 	}
 }
 
 func (h *Handler) setDB(c echo.Context, userID int64) {
-	switch userID % 7 {
-	case 0, 1:
-		c.Set("db", h.DB)
-	case 2, 3:
-		c.Set("db", h.DB2)
-	case 4, 5:
-		c.Set("db", h.DB3)
-	case 6:
-		c.Set("db", h.DB4)
-	}
+	c.Set("db", h.shardDB(userID))
+}
+
+// shardDB ユーザが所属するシャードのDBを取得する
+func (h *Handler) shardDB(userID int64) *sqlx.DB {
+	return h.Shards[h.Router.Shard(userID)]
 }
 
 func connectDB(batch bool, index int) (*sqlx.DB, error) {
@@ -230,18 +336,19 @@ func (h *Handler) apiMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 		c.Set("requestTime", requestAt.Unix())
 
-		// マスタ確認
-		query := "SELECT * FROM version_masters WHERE status=1"
-		masterVersion := new(VersionMaster)
-		if err := c.Get("db").(*sqlx.DB).Get(masterVersion, query); err != nil {
-			if err == sql.ErrNoRows {
-				return errorResponse(c, http.StatusNotFound, fmt.Errorf("active master version is not found"))
+		// マスタ確認。一致しなければ他のノードで更新されている可能性があるので確認し直す
+		if masters, err := h.masterStore(); err != nil {
+			if err == ErrActiveMasterVersionNotFound {
+				return errorResponse(c, http.StatusNotFound, err)
 			}
 			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-
-		if masterVersion.MasterVersion != c.Request().Header.Get("x-master-version") {
-			return errorResponse(c, http.StatusUnprocessableEntity, ErrInvalidMasterVersion)
+		} else if !acceptsMasterVersion(masters, c.Request().Header.Get("x-master-version")) {
+			if masters, err = h.refreshMasterStore(); err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+			if !acceptsMasterVersion(masters, c.Request().Header.Get("x-master-version")) {
+				return errorResponse(c, http.StatusUnprocessableEntity, ErrInvalidMasterVersion)
+			}
 		}
 
 		// check ban
@@ -281,45 +388,59 @@ func (h *Handler) checkSessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc
 			return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 		}
 
-		hit := true
-		userSession := new(Session)
-		query := "SELECT * FROM user_sessions WHERE session_id=? AND expired_at > ?"
-		if err := c.Get("db").(*sqlx.DB).Get(userSession, query, sessID, requestAt); err != nil {
-			if err == sql.ErrNoRows {
-				hit = false
-			} else {
-				return errorResponse(c, http.StatusInternalServerError, err)
-			}
+		// セッションディレクトリを引く。シャード移行前のエントリは使わない
+		entry, ok := h.Sessions.Get(sessID)
+		if ok && entry.Shard != h.Router.Shard(entry.UserID) {
+			h.Sessions.Delete(sessID)
+			ok = false
 		}
 
-		if !hit {
-			for _, db := range []*sqlx.DB{h.DB, h.DB2, h.DB3, h.DB4} {
-				if err := db.Get(userSession, query, sessID, requestAt); err != nil {
-					if err == sql.ErrNoRows {
-						continue
-					}
+		if !ok {
+			hit := true
+			userSession := new(Session)
+			query := "SELECT * FROM user_sessions WHERE session_id=? AND expired_at > ?"
+			if err := c.Get("db").(*sqlx.DB).Get(userSession, query, sessID, requestAt); err != nil {
+				if err == sql.ErrNoRows {
+					hit = false
+				} else {
 					return errorResponse(c, http.StatusInternalServerError, err)
 				}
-				hit = true
-				break
 			}
+
+			if !hit && h.SessionFallback {
+				atomic.AddInt64(&h.sessionFallbacks, 1)
+				for _, db := range h.Shards {
+					if err := db.Get(userSession, query, sessID, requestAt); err != nil {
+						if err == sql.ErrNoRows {
+							continue
+						}
+						return errorResponse(c, http.StatusInternalServerError, err)
+					}
+					hit = true
+					break
+				}
+			}
+			if !hit {
+				return errorResponse(c, http.StatusUnauthorized, ErrUnauthorized)
+			}
+
+			entry = &SessionEntry{
+				UserID:    userSession.UserID,
+				Shard:     h.Router.Shard(userSession.UserID),
+				ExpiredAt: userSession.ExpiredAt,
+			}
+			h.Sessions.Set(sessID, entry)
 		}
-		if !hit {
+
+		if entry.ExpiredAt <= requestAt {
+			h.Sessions.Delete(sessID)
 			return errorResponse(c, http.StatusUnauthorized, ErrUnauthorized)
 		}
 
-		if userSession.UserID != userID {
+		if entry.UserID != userID {
 			return errorResponse(c, http.StatusForbidden, ErrForbidden)
 		}
 
-		// if userSession.ExpiredAt < requestAt {
-		// 	query = "DELETE FROM user_sessions WHERE session_id=?"
-		// 	if _, err = c.Get("db").(*sqlx.DB).Exec(query, sessID); err != nil {
-		// 		return errorResponse(c, http.StatusInternalServerError, err)
-		// 	}
-		// 	return errorResponse(c, http.StatusUnauthorized, ErrExpiredSession)
-		// }
-
 		// next
 		if err := next(c); err != nil {
 			c.Error(err)
@@ -328,32 +449,9 @@ func (h *Handler) checkSessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc
 	}
 }
 
-// checkOneTimeToken
-func (h *Handler) checkOneTimeToken(c echo.Context, token string, tokenType int, requestAt int64) error {
-	tk := new(UserOneTimeToken)
-	query := "SELECT * FROM user_one_time_tokens WHERE token=? AND token_type=? AND deleted_at IS NULL"
-	if err := c.Get("db").(*sqlx.DB).Get(tk, query, token, tokenType); err != nil {
-		if err == sql.ErrNoRows {
-			return ErrInvalidToken
-		}
-		return err
-	}
-
-	if tk.ExpiredAt < requestAt {
-		query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=?"
-		if _, err := c.Get("db").(*sqlx.DB).Exec(query, requestAt, token); err != nil {
-			return err
-		}
-		return ErrInvalidToken
-	}
-
-	// 使ったトークンを失効する
-	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=?"
-	if _, err := c.Get("db").(*sqlx.DB).Exec(query, requestAt, token); err != nil {
-		return err
-	}
-
-	return nil
+// checkOneTimeToken トークンを消費する
+func (h *Handler) checkOneTimeToken(c echo.Context, userID int64, token string, purpose TokenPurpose, requestAt int64) error {
+	return h.Tokens.Consume(c.Get("db").(*sqlx.DB), userID, token, purpose, requestAt)
 }
 
 // checkViewerID
@@ -394,11 +492,14 @@ func getRequestTime(c echo.Context) (int64, error) {
 
 // initialize 初期化処理
 // POST /initialize
-func initialize(c echo.Context) error {
+func (h *Handler) initialize(c echo.Context) error {
 	helpisu.ResetAllCache()
+	resetMasterStore()
+	h.Sessions.Reset()
+	atomic.StoreInt64(&h.sessionFallbacks, 0)
 
 	wg := sync.WaitGroup{}
-	for i := 1; i <= 4; i++ {
+	for i := 1; i <= len(h.Shards); i++ {
 		wg.Add(1)
 		go func(index int) {
 			defer wg.Done()
@@ -409,7 +510,7 @@ func initialize(c echo.Context) error {
 			}
 			defer dbx.Close()
 
-			out, err := exec.Command("/bin/sh", "-c", SQLDirectory+fmt.Sprintf("init%d.sh", index)).CombinedOutput()
+			out, err := exec.Command("/bin/sh", SQLDirectory+"init.sh", strconv.Itoa(index)).CombinedOutput()
 			if err != nil {
 				c.Logger().Errorf("Failed to initialize %s: %v", string(out), err)
 				return
@@ -429,6 +530,11 @@ func initialize(c echo.Context) error {
 
 	wg.Wait()
 
+	// 初期化でuser_shard_overridesが空になっている
+	if err := h.Migrator.refresh(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
 	d.Pause()
 
 	return successResponse(c, &InitializeResponse{
@@ -579,6 +685,7 @@ type UserCard struct {
 	AmountPerSec int    `json:"amountPerSec" db:"amount_per_sec"`
 	Level        int    `json:"level" db:"level"`
 	TotalExp     int64  `json:"totalExp" db:"total_exp"`
+	LimitBreak   int    `json:"limitBreak" db:"limit_break"`
 	CreatedAt    int64  `json:"createdAt" db:"created_at"`
 	UpdatedAt    int64  `json:"updatedAt" db:"updated_at"`
 	DeletedAt    *int64 `json:"deletedAt,omitempty" db:"deleted_at"`
@@ -587,6 +694,8 @@ type UserCard struct {
 type UserDeck struct {
 	ID        int64  `json:"id" db:"id"`
 	UserID    int64  `json:"userId" db:"user_id"`
+	Slot      int    `json:"slot" db:"slot"`
+	Name      string `json:"name" db:"name"`
 	CardID1   int64  `json:"cardId1" db:"user_card_id_1"`
 	CardID2   int64  `json:"cardId2" db:"user_card_id_2"`
 	CardID3   int64  `json:"cardId3" db:"user_card_id_3"`
@@ -671,6 +780,27 @@ type GachaMaster struct {
 	EndAt        int64  `json:"endAt" db:"end_at"`
 	DisplayOrder int    `json:"displayOrder" db:"display_order"`
 	CreatedAt    int64  `json:"createdAt" db:"created_at"`
+	// PityDraws 天井。この回数目までにレアが出なければレアを確定で出す。0なら天井なし
+	PityDraws int `json:"pityDraws" db:"pity_draws"`
+	// MultiDrawGuarantee 複数回引きでレアが1つも出なければ最後の1回をレア確定にする
+	MultiDrawGuarantee bool `json:"multiDrawGuarantee" db:"multi_draw_guarantee"`
+	// CostItemType 引くのに使う通貨。1ならISU-COIN、それ以外はCostItemIDのアイテム(ガチャチケット)
+	CostItemType int   `json:"costItemType" db:"cost_item_type"`
+	CostItemID   int64 `json:"costItemId" db:"cost_item_id"`
+	// Price 1回あたりの価格
+	Price int `json:"price" db:"price"`
+	// DrawCountList 1度に引ける回数のカンマ区切り
+	DrawCountList string `json:"drawCounts" db:"draw_counts"`
+	// MultiDrawDiscount 2回以上まとめて引いたときの割引率(%)
+	MultiDrawDiscount int `json:"multiDrawDiscount" db:"multi_draw_discount"`
+	// GachaType 1:通常 2:ステップアップ 3:ボックス
+	GachaType int `json:"gachaType" db:"gacha_type"`
+	// StepPriceList ステップアップガチャのステップごとの1回あたりの価格のカンマ区切り
+	StepPriceList string `json:"stepPrices" db:"step_prices"`
+	// DailyDrawLimit 1ユーザが1日に引ける回数。0なら制限なし
+	DailyDrawLimit int `json:"dailyDrawLimit" db:"daily_draw_limit"`
+	// DailyFreeDraw 1日1回、単発を無料で引けるか
+	DailyFreeDraw bool `json:"dailyFreeDraw" db:"daily_free_draw"`
 }
 
 type GachaItemMaster struct {
@@ -681,6 +811,12 @@ type GachaItemMaster struct {
 	Amount    int   `json:"amount" db:"amount"`
 	Weight    int   `json:"weight" db:"weight"`
 	CreatedAt int64 `json:"createdAt" db:"created_at"`
+	// IsRare 天井と確定枠で排出されるアイテムか
+	IsRare bool `json:"isRare" db:"is_rare"`
+	// Step ステップアップガチャで排出されるステップ。0なら全てのステップ
+	Step int `json:"step" db:"step"`
+	// Stock ボックスガチャでのユーザごとの在庫
+	Stock int `json:"stock" db:"stock"`
 }
 
 type ItemMaster struct {
@@ -694,6 +830,22 @@ type ItemMaster struct {
 	BaseExpPerLevel *int   `json:"baseExpPerLevel" db:"base_exp_per_level"`
 	GainedExp       *int   `json:"gainedExp" db:"gained_exp"`
 	ShorteningMin   *int64 `json:"shorteningMin" db:"shortening_min"`
+	// LimitBreakMax 限界突破できる段階数。0なら限界突破できない
+	LimitBreakMax int `json:"limitBreakMax" db:"limit_break_max"`
+	// LimitBreakLevels 1段階ごとに上がる最高レベル
+	LimitBreakLevels int `json:"limitBreakLevels" db:"limit_break_levels"`
+	// LimitBreakAmountPerSec 1段階ごとに上がるlv maxのときの生産性
+	LimitBreakAmountPerSec int `json:"limitBreakAmountPerSec" db:"limit_break_amount_per_sec"`
+	// LimitBreakItemID 同じカードの代わりに使える素材アイテム。0なら素材なし
+	LimitBreakItemID     int64 `json:"limitBreakItemId" db:"limit_break_item_id"`
+	LimitBreakItemAmount int   `json:"limitBreakItemAmount" db:"limit_break_item_amount"`
+	// LevelCurveID 成長曲線。0なら既定の曲線
+	LevelCurveID int64 `json:"levelCurveId" db:"level_curve_id"`
+	// SellPrice 売却したときのISU-COIN
+	SellPrice int `json:"sellPrice" db:"sell_price"`
+	// SellItemID 売却したときにもらえる強化素材。0ならなし
+	SellItemID     int64 `json:"sellItemId" db:"sell_item_id"`
+	SellItemAmount int   `json:"sellItemAmount" db:"sell_item_amount"`
 	// CreatedAt       int64 `json:"createdAt"`
 }
 
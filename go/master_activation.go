@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+const (
+	ActivationStatusPending   int = 1
+	ActivationStatusActivated int = 2
+	ActivationStatusCancelled int = 3
+	ActivationStatusFailed    int = 4
+	// ActivationStatusActivating 切り替え中。切り替え済みにする前に止まったものはやり直す
+	ActivationStatusActivating int = 5
+
+	masterActivationIntervalMS int = 1000
+	// masterActivationRetrySeconds 切り替え中のまま更新されない予約をやり直すまでの秒数
+	masterActivationRetrySeconds int64 = 60
+)
+
+// masterVersionGrace 切り替え前のマスタバージョンを受け付ける猶予
+type masterVersionGrace struct {
+	Version string
+	Until   int64
+}
+
+// activeMasterGrace 有効なマスタバージョンに切り替わった際の猶予
+var activeMasterGrace atomic.Pointer[masterVersionGrace]
+
+// acceptsMasterVersion クライアントのマスタバージョンを受け付けるか。切り替え直後は猶予期間内なら前のバージョンも受け付ける
+func acceptsMasterVersion(masters *MasterStore, version string) bool {
+	if masters.Version.MasterVersion == version {
+		return true
+	}
+	grace := activeMasterGrace.Load()
+	return grace != nil && grace.Version == version && time.Now().Unix() <= grace.Until
+}
+
+// loadMasterVersionGrace 有効なマスタバージョンを切り替えた予約から猶予を読み込む
+func loadMasterVersionGrace(db *sqlx.DB, version *VersionMaster) error {
+	act := new(MasterVersionActivation)
+	query := "SELECT * FROM master_version_activations WHERE version_master_id=? AND status=? ORDER BY activated_at DESC LIMIT 1"
+	if err := db.Get(act, query, version.ID, ActivationStatusActivated); err != nil {
+		if err == sql.ErrNoRows {
+			activeMasterGrace.Store(nil)
+			return nil
+		}
+		return err
+	}
+	if act.PreviousMasterVersion == "" || act.ActivatedAt == nil {
+		activeMasterGrace.Store(nil)
+		return nil
+	}
+
+	activeMasterGrace.Store(&masterVersionGrace{
+		Version: act.PreviousMasterVersion,
+		Until:   *act.ActivatedAt + act.GraceSeconds,
+	})
+	return nil
+}
+
+// startMasterActivationScheduler 予約されたマスタバージョンの切り替えを定期的に実行する
+func (h *Handler) startMasterActivationScheduler(logger echo.Logger) {
+	t := helpisu.NewTicker(masterActivationIntervalMS, func() {
+		if err := h.runMasterActivations(time.Now().Unix()); err != nil {
+			logger.Errorf("failed to activate master version: %v", err)
+		}
+	})
+	go t.Start()
+}
+
+// runMasterActivations 時刻を過ぎた予約と、切り替え中のまま止まった予約を古い順に実行する
+// 切り替えてから切り替え済みにするので、途中で止まっても切り替え中のまま残り、やり直される
+func (h *Handler) runMasterActivations(now int64) error {
+	acts := make([]*MasterVersionActivation, 0)
+	query := "SELECT * FROM master_version_activations WHERE (status=? AND activate_at <= ?) OR (status=? AND updated_at <= ?) ORDER BY activate_at ASC, id ASC"
+	if err := h.DB.Select(&acts, query, ActivationStatusPending, now, ActivationStatusActivating, now-masterActivationRetrySeconds); err != nil {
+		return err
+	}
+
+	for _, act := range acts {
+		// 複数台で動いている場合に備えて、予約を確保できたものだけを実行する
+		query = "UPDATE master_version_activations SET status=?, updated_at=? WHERE id=? AND status=? AND updated_at=?"
+		res, err := h.DB.Exec(query, ActivationStatusActivating, now, act.ID, act.Status, act.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+
+		prev, err := h.activateMasterVersion(act.VersionMasterID)
+		if err != nil {
+			query = "UPDATE master_version_activations SET status=?, message=?, updated_at=? WHERE id=? AND status=?"
+			if _, uerr := h.DB.Exec(query, ActivationStatusFailed, err.Error(), now, act.ID, ActivationStatusActivating); uerr != nil {
+				return uerr
+			}
+			return err
+		}
+
+		// 猶予は切り替え終わった時刻から数える。各ノードはマスタの定期確認で同じ猶予を読み込む
+		activatedAt := time.Now().Unix()
+		query = "UPDATE master_version_activations SET status=?, previous_master_version=?, activated_at=?, updated_at=? WHERE id=? AND status=?"
+		if _, err = h.DB.Exec(query, ActivationStatusActivated, prev, activatedAt, activatedAt, act.ID, ActivationStatusActivating); err != nil {
+			return err
+		}
+
+		if _, err = h.reloadMasterStore(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// activateMasterVersion 全シャードで有効なマスタバージョンを切り替え、切り替え前のバージョンを返す
+// 他のマスタ更新と同じく全シャードで更新できてからコミットし、履歴を残す
+func (h *Handler) activateMasterVersion(versionMasterID int64) (string, error) {
+	versions, err := loadMasterRows(context.Background(), h.DB, versionMasterTable)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := versions[versionMasterID]; !ok {
+		return "", fmt.Errorf("version master %d is not found", versionMasterID)
+	}
+
+	data := make([]map[string]interface{}, 0, len(versions))
+	for id, row := range versions {
+		status := int64(2)
+		if id == versionMasterID {
+			status = 1
+		}
+		if row.Int("status") == status {
+			continue
+		}
+		v := make(map[string]interface{}, len(row))
+		for name, value := range row {
+			v[name] = value
+		}
+		v["status"] = status
+		data = append(data, v)
+	}
+
+	if len(data) == 0 {
+		// やり直しで既に切り替わっていれば、切り替えた更新から切り替え前のバージョンを返す
+		var prev string
+		query := "SELECT previous_master_version FROM master_update_logs WHERE status=? AND master_version=? ORDER BY seq DESC LIMIT 1"
+		if err = h.DB.Get(&prev, query, MasterUpdateStatusCommitted, versions[versionMasterID]["master_version"]); err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		return prev, nil
+	}
+
+	stmts := []*masterUpdateStatement{{Table: versionMasterTable, Data: data}}
+	update, err := h.applyMasterUpdate(stmts, "", time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	return update.PreviousMasterVersion, nil
+}
+
+type MasterVersionActivation struct {
+	ID                    int64  `json:"id" db:"id"`
+	VersionMasterID       int64  `json:"versionMasterId" db:"version_master_id"`
+	MasterVersion         string `json:"masterVersion" db:"master_version"`
+	PreviousMasterVersion string `json:"previousMasterVersion" db:"previous_master_version"`
+	ActivateAt            int64  `json:"activateAt" db:"activate_at"`
+	GraceSeconds          int64  `json:"graceSeconds" db:"grace_seconds"`
+	Status                int    `json:"status" db:"status"`
+	Message               string `json:"message" db:"message"`
+	ActivatedAt           *int64 `json:"activatedAt,omitempty" db:"activated_at"`
+	CreatedAt             int64  `json:"createdAt" db:"created_at"`
+	UpdatedAt             int64  `json:"updatedAt" db:"updated_at"`
+}
@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type masterColumnKind int
+
+const (
+	masterColumnInt masterColumnKind = iota
+	masterColumnNullableInt
+	masterColumnString
+	// masterColumnBool CSVではTRUE/FALSE、DBでは1/0
+	masterColumnBool
+)
+
+type masterColumn struct {
+	Name string
+	Kind masterColumnKind
+}
+
+// masterTable 管理画面からCSVで更新できるマスタテーブル。Columnsの並びはCSVの列順
+type masterTable struct {
+	FormName string
+	Table    string
+	Columns  []masterColumn
+	// Defaults 後から追加した列の既定値。CSVで省略できるのは末尾にあるこれらの列だけ
+	Defaults map[string]interface{}
+}
+
+// masterRow 型変換済みのマスタの1行。値はint64、string、nilのいずれか
+type masterRow map[string]interface{}
+
+var (
+	versionMasterTable = &masterTable{
+		FormName: "versionMaster",
+		Table:    "version_masters",
+		Columns: []masterColumn{
+			{"id", masterColumnInt},
+			{"status", masterColumnInt},
+			{"master_version", masterColumnString},
+		},
+	}
+	itemMasterTable = &masterTable{
+		FormName: "itemMaster",
+		Table:    "item_masters",
+		Columns: []masterColumn{
+			{"id", masterColumnInt},
+			{"item_type", masterColumnInt},
+			{"name", masterColumnString},
+			{"description", masterColumnString},
+			{"amount_per_sec", masterColumnNullableInt},
+			{"max_level", masterColumnNullableInt},
+			{"max_amount_per_sec", masterColumnNullableInt},
+			{"base_exp_per_level", masterColumnNullableInt},
+			{"gained_exp", masterColumnNullableInt},
+			{"shortening_min", masterColumnNullableInt},
+			{"limit_break_max", masterColumnInt},
+			{"limit_break_levels", masterColumnInt},
+			{"limit_break_amount_per_sec", masterColumnInt},
+			{"limit_break_item_id", masterColumnInt},
+			{"limit_break_item_amount", masterColumnInt},
+			{"level_curve_id", masterColumnInt},
+			{"sell_price", masterColumnInt},
+			{"sell_item_id", masterColumnInt},
+			{"sell_item_amount", masterColumnInt},
+		},
+		Defaults: map[string]interface{}{
+			"limit_break_max":            int64(0),
+			"limit_break_levels":         int64(0),
+			"limit_break_amount_per_sec": int64(0),
+			"limit_break_item_id":        int64(0),
+			"limit_break_item_amount":    int64(1),
+			"level_curve_id":             int64(0),
+			"sell_price":                 int64(0),
+			"sell_item_id":               int64(0),
+			"sell_item_amount":           int64(0),
+		},
+	}
+	levelCurveMasterTable = &masterTable{
+		FormName: "levelCurveMaster",
+		Table:    "level_curve_masters",
+		Columns: []masterColumn{
+			{"id", masterColumnInt},
+			{"name", masterColumnString},
+			{"curve_type", masterColumnInt},
+			{"exp_rate", masterColumnInt},
+			{"exp_table", masterColumnString},
+			{"exp_segments", masterColumnString},
+			{"amount_table", masterColumnString},
+			{"created_at", masterColumnInt},
+		},
+	}
+	gachaMasterTable = &masterTable{
+		FormName: "gachaMaster",
+		Table:    "gacha_masters",
+		Columns: []masterColumn{
+			{"id", masterColumnInt},
+			{"name", masterColumnString},
+			{"start_at", masterColumnInt},
+			{"end_at", masterColumnInt},
+			{"display_order", masterColumnInt},
+			{"created_at", masterColumnInt},
+			{"pity_draws", masterColumnInt},
+			{"multi_draw_guarantee", masterColumnBool},
+			{"cost_item_type", masterColumnInt},
+			{"cost_item_id", masterColumnInt},
+			{"price", masterColumnInt},
+			{"draw_counts", masterColumnString},
+			{"multi_draw_discount", masterColumnInt},
+			{"gacha_type", masterColumnInt},
+			{"step_prices", masterColumnString},
+			{"daily_draw_limit", masterColumnInt},
+			{"daily_free_draw", masterColumnBool},
+		},
+		Defaults: map[string]interface{}{
+			"pity_draws":           int64(0),
+			"multi_draw_guarantee": int64(0),
+			"cost_item_type":       int64(1),
+			"cost_item_id":         int64(0),
+			"price":                int64(1000),
+			"draw_counts":          "1,10",
+			"multi_draw_discount":  int64(0),
+			"gacha_type":           int64(GachaTypeNormal),
+			"step_prices":          "",
+			"daily_draw_limit":     int64(0),
+			"daily_free_draw":      int64(0),
+		},
+	}
+	gachaItemMasterTable = &masterTable{
+		FormName: "gachaItemMaster",
+		Table:    "gacha_item_masters",
+		Columns: []masterColumn{
+			{"id", masterColumnInt},
+			{"gacha_id", masterColumnInt},
+			{"item_type", masterColumnInt},
+			{"item_id", masterColumnInt},
+			{"amount", masterColumnInt},
+			{"weight", masterColumnInt},
+			{"created_at", masterColumnInt},
+			{"is_rare", masterColumnBool},
+			{"step", masterColumnInt},
+			{"stock", masterColumnInt},
+		},
+		Defaults: map[string]interface{}{
+			"is_rare": int64(0),
+			"step":    int64(0),
+			"stock":   int64(0),
+		},
+	}
+	presentAllMasterTable = &masterTable{
+		FormName: "presentAllMaster",
+		Table:    "present_all_masters",
+		Columns: []masterColumn{
+			{"id", masterColumnInt},
+			{"registered_start_at", masterColumnInt},
+			{"registered_end_at", masterColumnInt},
+			{"item_type", masterColumnInt},
+			{"item_id", masterColumnInt},
+			{"amount", masterColumnInt},
+			{"present_message", masterColumnString},
+			{"created_at", masterColumnInt},
+		},
+	}
+	loginBonusMasterTable = &masterTable{
+		FormName: "loginBonusMaster",
+		Table:    "login_bonus_masters",
+		Columns: []masterColumn{
+			{"id", masterColumnInt},
+			{"start_at", masterColumnInt},
+			{"end_at", masterColumnInt},
+			{"column_count", masterColumnInt},
+			{"looped", masterColumnBool},
+			{"created_at", masterColumnInt},
+		},
+	}
+	loginBonusRewardMasterTable = &masterTable{
+		FormName: "loginBonusRewardMaster",
+		Table:    "login_bonus_reward_masters",
+		Columns: []masterColumn{
+			{"id", masterColumnInt},
+			{"login_bonus_id", masterColumnInt},
+			{"reward_sequence", masterColumnInt},
+			{"item_type", masterColumnInt},
+			{"item_id", masterColumnInt},
+			{"amount", masterColumnInt},
+			{"created_at", masterColumnInt},
+		},
+	}
+
+	// masterTables 更新する順に並べたマスタテーブル
+	masterTables = []*masterTable{
+		versionMasterTable,
+		levelCurveMasterTable,
+		itemMasterTable,
+		gachaMasterTable,
+		gachaItemMasterTable,
+		presentAllMasterTable,
+		loginBonusMasterTable,
+		loginBonusRewardMasterTable,
+	}
+)
+
+// columnNames 列名をCSVの列順で返す
+func (t *masterTable) columnNames() []string {
+	names := make([]string, 0, len(t.Columns))
+	for _, col := range t.Columns {
+		names = append(names, col.Name)
+	}
+	return names
+}
+
+// findMasterTable フォーム名かテーブル名でマスタテーブルを探す
+func findMasterTable(name string) (*masterTable, bool) {
+	for _, t := range masterTables {
+		if t.FormName == name || t.Table == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// csvColumns CSVの列数に対応する列。省略された列は含めない
+func (t *masterTable) csvColumns(n int) ([]masterColumn, error) {
+	if n >= len(t.Columns) {
+		return t.Columns, nil
+	}
+	for _, col := range t.Columns[n:] {
+		if _, ok := t.Defaults[col.Name]; !ok {
+			return nil, fmt.Errorf("%s: expected %d columns, got %d", t.Table, len(t.Columns), n)
+		}
+	}
+	return t.Columns[:n], nil
+}
+
+// upsertQuery CSVの行をまとめて書き込むクエリ。columnsがnilなら全ての列を書き込む
+func (t *masterTable) upsertQuery(columns []masterColumn) string {
+	if columns == nil {
+		columns = t.Columns
+	}
+	names := make([]string, 0, len(columns))
+	params := make([]string, 0, len(columns))
+	updates := make([]string, 0, len(columns))
+	for _, col := range columns {
+		name := col.Name
+		names = append(names, name)
+		params = append(params, ":"+name)
+		if name != "id" {
+			updates = append(updates, fmt.Sprintf("%s=VALUES(%s)", name, name))
+		}
+	}
+
+	return strings.Join([]string{
+		fmt.Sprintf("INSERT INTO %s(%s)", t.Table, strings.Join(names, ", ")),
+		fmt.Sprintf("VALUES (%s)", strings.Join(params, ", ")),
+		"ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", "),
+	}, " ")
+}
+
+// MasterValidationError CSVの検証エラー。LineはCSVの行番号(ヘッダが1行目)
+type MasterValidationError struct {
+	Table   string `json:"table"`
+	Line    int    `json:"line,omitempty"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// masterUpload アップロードされた1テーブル分のCSV
+type masterUpload struct {
+	Table *masterTable
+	// Columns CSVに含まれていた列
+	Columns []masterColumn
+	Rows    []masterRow
+	// Lines IDごとのCSVの行番号
+	Lines map[int64]int
+}
+
+// parseMasterCSV CSVレコードを列の型に合わせて変換する。1行目はヘッダとして読み飛ばす
+func parseMasterCSV(t *masterTable, records [][]string) (*masterUpload, []*MasterValidationError) {
+	upload := &masterUpload{
+		Table: t,
+		Rows:  make([]masterRow, 0, len(records)),
+		Lines: map[int64]int{},
+	}
+	errs := make([]*MasterValidationError, 0)
+
+	upload.Columns = t.Columns
+	if len(records) > 0 {
+		columns, err := t.csvColumns(len(records[0]))
+		if err != nil {
+			errs = append(errs, &MasterValidationError{Table: t.Table, Line: 1, Message: err.Error()})
+			return upload, errs
+		}
+		upload.Columns = columns
+	}
+
+	for i, v := range records {
+		if i == 0 {
+			continue
+		}
+		line := i + 1
+		if len(v) != len(upload.Columns) {
+			errs = append(errs, &MasterValidationError{
+				Table:   t.Table,
+				Line:    line,
+				Message: fmt.Sprintf("expected %d columns, got %d", len(upload.Columns), len(v)),
+			})
+			continue
+		}
+
+		row := masterRow{}
+		valid := true
+		for j, col := range upload.Columns {
+			value, err := parseMasterValue(col.Kind, v[j])
+			if err != nil {
+				errs = append(errs, &MasterValidationError{Table: t.Table, Line: line, Column: col.Name, Message: err.Error()})
+				valid = false
+				continue
+			}
+			row[col.Name] = value
+		}
+		if !valid {
+			continue
+		}
+
+		id := row.Int("id")
+		if prev, ok := upload.Lines[id]; ok {
+			errs = append(errs, &MasterValidationError{
+				Table:   t.Table,
+				Line:    line,
+				Column:  "id",
+				Message: fmt.Sprintf("duplicate id %d (line %d)", id, prev),
+			})
+			continue
+		}
+		upload.Lines[id] = line
+		upload.Rows = append(upload.Rows, row)
+	}
+
+	return upload, errs
+}
+
+// parseMasterValue CSVの値を列の型に変換する
+func parseMasterValue(kind masterColumnKind, s string) (interface{}, error) {
+	switch kind {
+	case masterColumnInt:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q", s)
+		}
+		return n, nil
+	case masterColumnNullableInt:
+		if s == "" || s == "NULL" {
+			return nil, nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q", s)
+		}
+		return n, nil
+	case masterColumnBool:
+		switch s {
+		case "TRUE":
+			return int64(1), nil
+		case "FALSE":
+			return int64(0), nil
+		}
+		return nil, fmt.Errorf("invalid boolean %q, must be TRUE or FALSE", s)
+	default:
+		return s, nil
+	}
+}
+
+// formatMasterValue 値をparseMasterValueで読み戻せるCSVの値にする
+func formatMasterValue(kind masterColumnKind, v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case int64:
+		if kind == masterColumnBool {
+			if value != 0 {
+				return "TRUE"
+			}
+			return "FALSE"
+		}
+		return strconv.FormatInt(value, 10)
+	case string:
+		return value
+	}
+	return fmt.Sprint(v)
+}
+
+// Int 整数の列の値を取得する。NULLは0になる
+func (r masterRow) Int(name string) int64 {
+	n, _ := r[name].(int64)
+	return n
+}
+
+// loadMasterRows テーブルの全行をIDごとに読み込む
+func loadMasterRows(ctx context.Context, db sqlx.QueryerContext, t *masterTable) (map[int64]masterRow, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(t.columnNames(), ", "), t.Table)
+	rows, err := db.QueryxContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := map[int64]masterRow{}
+	for rows.Next() {
+		raw := map[string]interface{}{}
+		if err = rows.MapScan(raw); err != nil {
+			return nil, err
+		}
+		row := masterRow{}
+		for _, col := range t.Columns {
+			if row[col.Name], err = normalizeMasterValue(col.Kind, raw[col.Name]); err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", t.Table, col.Name, err)
+			}
+		}
+		res[row.Int("id")] = row
+	}
+	return res, rows.Err()
+}
+
+// normalizeMasterValue DBから読んだ値をCSVから変換した値と比較できる形に揃える
+func normalizeMasterValue(kind masterColumnKind, v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		if kind == masterColumnString {
+			return string(value), nil
+		}
+		return strconv.ParseInt(string(value), 10, 64)
+	case string:
+		if kind == masterColumnString {
+			return value, nil
+		}
+		return strconv.ParseInt(value, 10, 64)
+	case int64:
+		return value, nil
+	case bool:
+		if value {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return nil, fmt.Errorf("unexpected value type %T", v)
+}
+
+// MasterTableDiff 1テーブル分のアップロード前後の差分
+type MasterTableDiff struct {
+	Table     string             `json:"table"`
+	Inserted  []masterRow        `json:"inserted"`
+	Updated   []*MasterRowChange `json:"updated"`
+	Unchanged []int64            `json:"unchanged"`
+}
+
+type MasterRowChange struct {
+	ID      int64                         `json:"id"`
+	Changes map[string]*MasterValueChange `json:"changes"`
+}
+
+type MasterValueChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// diffMasterRows 現在の行とアップロードされた行を比較する
+func diffMasterRows(upload *masterUpload, current map[int64]masterRow) *MasterTableDiff {
+	diff := &MasterTableDiff{
+		Table:     upload.Table.Table,
+		Inserted:  make([]masterRow, 0),
+		Updated:   make([]*MasterRowChange, 0),
+		Unchanged: make([]int64, 0),
+	}
+
+	for _, row := range upload.Rows {
+		id := row.Int("id")
+		before, ok := current[id]
+		if !ok {
+			diff.Inserted = append(diff.Inserted, row)
+			continue
+		}
+
+		changes := map[string]*MasterValueChange{}
+		for _, col := range upload.Columns {
+			if before[col.Name] != row[col.Name] {
+				changes[col.Name] = &MasterValueChange{Before: before[col.Name], After: row[col.Name]}
+			}
+		}
+		if len(changes) == 0 {
+			diff.Unchanged = append(diff.Unchanged, id)
+			continue
+		}
+		diff.Updated = append(diff.Updated, &MasterRowChange{ID: id, Changes: changes})
+	}
+
+	return diff
+}
+
+// mergeMasterRows 現在の行にアップロードされた行を上書きした、更新後の状態を返す
+func mergeMasterRows(current map[int64]masterRow, upload *masterUpload) map[int64]masterRow {
+	merged := make(map[int64]masterRow, len(current))
+	for id, row := range current {
+		merged[id] = row
+	}
+	if upload != nil {
+		for _, row := range upload.Rows {
+			// CSVで省略された列は、既存の行なら今の値、新しい行なら既定値になる
+			m := masterRow{}
+			if before, ok := current[row.Int("id")]; ok {
+				for name, value := range before {
+					m[name] = value
+				}
+			} else {
+				for name, value := range upload.Table.Defaults {
+					m[name] = value
+				}
+			}
+			for name, value := range row {
+				m[name] = value
+			}
+			merged[row.Int("id")] = m
+		}
+	}
+	return merged
+}
+
+// validateMasterRows 更新後のマスタの整合性を検証する。検証するのはアップロードされたテーブルに関わるものだけ
+// current は更新前の全行、merged は更新後の全行、uploads はアップロードされたテーブル
+func validateMasterRows(current, merged map[*masterTable]map[int64]masterRow, uploads map[*masterTable]*masterUpload) []*MasterValidationError {
+	errs := make([]*MasterValidationError, 0)
+	lineOf := func(t *masterTable, id int64) int {
+		if u, ok := uploads[t]; ok {
+			return u.Lines[id]
+		}
+		return 0
+	}
+	uploaded := func(t *masterTable) []masterRow {
+		if u, ok := uploads[t]; ok {
+			return u.Rows
+		}
+		return nil
+	}
+	items := merged[itemMasterTable]
+
+	// アイテムの参照先と種別
+	checkItem := func(t *masterTable, row masterRow) {
+		id := row.Int("id")
+		item, ok := items[row.Int("item_id")]
+		if !ok {
+			errs = append(errs, &MasterValidationError{
+				Table: t.Table, Line: lineOf(t, id), Column: "item_id",
+				Message: fmt.Sprintf("item_masters.id %d is not found", row.Int("item_id")),
+			})
+			return
+		}
+		if item.Int("item_type") != row.Int("item_type") {
+			errs = append(errs, &MasterValidationError{
+				Table: t.Table, Line: lineOf(t, id), Column: "item_type",
+				Message: fmt.Sprintf("item_type %d does not match item_masters.item_type %d", row.Int("item_type"), item.Int("item_type")),
+			})
+		}
+	}
+	checkCostItem := func(row masterRow) {
+		item, ok := items[row.Int("cost_item_id")]
+		if !ok {
+			errs = append(errs, &MasterValidationError{
+				Table: gachaMasterTable.Table, Line: lineOf(gachaMasterTable, row.Int("id")), Column: "cost_item_id",
+				Message: fmt.Sprintf("item_masters.id %d is not found", row.Int("cost_item_id")),
+			})
+			return
+		}
+		if t := item.Int("item_type"); t != row.Int("cost_item_type") || t == 2 {
+			errs = append(errs, &MasterValidationError{
+				Table: gachaMasterTable.Table, Line: lineOf(gachaMasterTable, row.Int("id")), Column: "cost_item_type",
+				Message: fmt.Sprintf("cost_item_type %d must match item_masters.item_type %d and not be a card", row.Int("cost_item_type"), t),
+			})
+		}
+	}
+	checkPeriod := func(t *masterTable, row masterRow, start, end string) {
+		if row.Int(start) > row.Int(end) {
+			errs = append(errs, &MasterValidationError{
+				Table: t.Table, Line: lineOf(t, row.Int("id")), Column: end,
+				Message: fmt.Sprintf("%s must not be before %s", end, start),
+			})
+		}
+	}
+
+	// 有効なマスタバージョンは1つだけ
+	if _, ok := uploads[versionMasterTable]; ok {
+		active := 0
+		for _, row := range uploaded(versionMasterTable) {
+			if s := row.Int("status"); s != 1 && s != 2 {
+				errs = append(errs, &MasterValidationError{
+					Table: versionMasterTable.Table, Line: lineOf(versionMasterTable, row.Int("id")), Column: "status",
+					Message: fmt.Sprintf("invalid status %d", s),
+				})
+			}
+		}
+		for _, row := range merged[versionMasterTable] {
+			if row.Int("status") == 1 {
+				active++
+			}
+		}
+		if active != 1 {
+			errs = append(errs, &MasterValidationError{
+				Table:   versionMasterTable.Table,
+				Column:  "status",
+				Message: fmt.Sprintf("exactly one active master version is required, got %d", active),
+			})
+		}
+	}
+
+	for _, row := range uploaded(levelCurveMasterTable) {
+		id := row.Int("id")
+		curve := levelCurveFromRow(row)
+		if id == 0 {
+			errs = append(errs, &MasterValidationError{
+				Table: levelCurveMasterTable.Table, Line: lineOf(levelCurveMasterTable, id), Column: "id",
+				Message: "id 0 is reserved for the default level curve",
+			})
+		}
+		switch curve.CurveType {
+		case LevelCurveExponential:
+			if curve.ExpRate <= 0 {
+				errs = append(errs, &MasterValidationError{
+					Table: levelCurveMasterTable.Table, Line: lineOf(levelCurveMasterTable, id), Column: "exp_rate",
+					Message: "exp_rate must be greater than 0",
+				})
+			}
+		case LevelCurveTable:
+			table := curve.ExpTable()
+			if len(table) == 0 {
+				errs = append(errs, &MasterValidationError{
+					Table: levelCurveMasterTable.Table, Line: lineOf(levelCurveMasterTable, id), Column: "exp_table",
+					Message: fmt.Sprintf("exp_table %q has no valid exp", curve.ExpTableList),
+				})
+			}
+			for i := 1; i < len(table); i++ {
+				if table[i] < table[i-1] {
+					errs = append(errs, &MasterValidationError{
+						Table: levelCurveMasterTable.Table, Line: lineOf(levelCurveMasterTable, id), Column: "exp_table",
+						Message: "exp_table must not decrease",
+					})
+					break
+				}
+			}
+		case LevelCurvePiecewise:
+			segments := curve.ExpSegments()
+			if len(segments) == 0 {
+				errs = append(errs, &MasterValidationError{
+					Table: levelCurveMasterTable.Table, Line: lineOf(levelCurveMasterTable, id), Column: "exp_segments",
+					Message: fmt.Sprintf("exp_segments %q must be level:rate pairs", curve.ExpSegmentList),
+				})
+			}
+			for i := 1; i < len(segments); i++ {
+				if segments[i].FromLevel <= segments[i-1].FromLevel {
+					errs = append(errs, &MasterValidationError{
+						Table: levelCurveMasterTable.Table, Line: lineOf(levelCurveMasterTable, id), Column: "exp_segments",
+						Message: "levels of exp_segments must be in ascending order",
+					})
+					break
+				}
+			}
+		default:
+			errs = append(errs, &MasterValidationError{
+				Table: levelCurveMasterTable.Table, Line: lineOf(levelCurveMasterTable, id), Column: "curve_type",
+				Message: fmt.Sprintf("invalid curve_type %d", curve.CurveType),
+			})
+		}
+		if curve.AmountTable() == nil {
+			errs = append(errs, &MasterValidationError{
+				Table: levelCurveMasterTable.Table, Line: lineOf(levelCurveMasterTable, id), Column: "amount_table",
+				Message: fmt.Sprintf("amount_table %q has an invalid amount", curve.AmountTableList),
+			})
+		}
+	}
+
+	// カードの成長曲線は、アイテムか成長曲線が更新されたら全て確認する
+	_, curvesUploaded := uploads[levelCurveMasterTable]
+	if _, ok := uploads[itemMasterTable]; ok || curvesUploaded {
+		for _, row := range sortedMasterRows(items) {
+			curveID := row.Int("level_curve_id")
+			if curveID == 0 {
+				continue
+			}
+			id := row.Int("id")
+			curveRow, ok := merged[levelCurveMasterTable][curveID]
+			if !ok {
+				errs = append(errs, &MasterValidationError{
+					Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: "level_curve_id",
+					Message: fmt.Sprintf("level_curve_masters.id %d is not found", curveID),
+				})
+				continue
+			}
+			// 表で決める曲線は、限界突破を含めた最高レベルまでの必要経験値が要る
+			maxLevel := row.Int("max_level") + row.Int("limit_break_max")*row.Int("limit_break_levels")
+			if curve := levelCurveFromRow(curveRow); curve.CurveType == LevelCurveTable && int64(len(curve.ExpTable())) < maxLevel-1 {
+				errs = append(errs, &MasterValidationError{
+					Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: "level_curve_id",
+					Message: fmt.Sprintf("exp_table of level_curve_masters.id %d must cover level %d", curveID, maxLevel),
+				})
+			}
+		}
+	}
+
+	for _, row := range uploaded(itemMasterTable) {
+		id := row.Int("id")
+		for _, name := range []string{"limit_break_max", "limit_break_levels", "limit_break_amount_per_sec", "sell_price", "sell_item_amount"} {
+			if row.Int(name) < 0 {
+				errs = append(errs, &MasterValidationError{
+					Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: name,
+					Message: fmt.Sprintf("%s must not be negative", name),
+				})
+			}
+		}
+		if (row.Int("sell_price") > 0 || row.Int("sell_item_id") != 0) && row.Int("item_type") != 2 {
+			errs = append(errs, &MasterValidationError{
+				Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: "sell_price",
+				Message: "only cards can be sold",
+			})
+		}
+		if itemID := row.Int("sell_item_id"); itemID != 0 {
+			if item, ok := items[itemID]; !ok {
+				errs = append(errs, &MasterValidationError{
+					Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: "sell_item_id",
+					Message: fmt.Sprintf("item_masters.id %d is not found", itemID),
+				})
+			} else if t := item.Int("item_type"); t != 3 {
+				errs = append(errs, &MasterValidationError{
+					Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: "sell_item_id",
+					Message: fmt.Sprintf("sell item must be an enhancement item, got item_type %d", t),
+				})
+			}
+		}
+		if row.Int("limit_break_max") == 0 {
+			continue
+		}
+		if row.Int("item_type") != 2 {
+			errs = append(errs, &MasterValidationError{
+				Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: "limit_break_max",
+				Message: "only cards can be limit broken",
+			})
+		}
+		// 限界突破で上がったレベルは1段階分の生産性を均等に割るので、レベルが上がらない段階は作れない
+		if row.Int("limit_break_levels") <= 0 {
+			errs = append(errs, &MasterValidationError{
+				Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: "limit_break_levels",
+				Message: "limit_break_levels must be greater than 0",
+			})
+		}
+		if itemID := row.Int("limit_break_item_id"); itemID != 0 {
+			if item, ok := items[itemID]; !ok {
+				errs = append(errs, &MasterValidationError{
+					Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: "limit_break_item_id",
+					Message: fmt.Sprintf("item_masters.id %d is not found", itemID),
+				})
+			} else if t := item.Int("item_type"); t == 1 || t == 2 {
+				errs = append(errs, &MasterValidationError{
+					Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: "limit_break_item_id",
+					Message: fmt.Sprintf("limit break item must not be ISU-COIN or a card, got item_type %d", t),
+				})
+			}
+			if row.Int("limit_break_item_amount") <= 0 {
+				errs = append(errs, &MasterValidationError{
+					Table: itemMasterTable.Table, Line: lineOf(itemMasterTable, id), Column: "limit_break_item_amount",
+					Message: "limit_break_item_amount must be greater than 0",
+				})
+			}
+		}
+	}
+
+	for _, row := range uploaded(gachaMasterTable) {
+		checkPeriod(gachaMasterTable, row, "start_at", "end_at")
+		if row.Int("pity_draws") < 0 {
+			errs = append(errs, &MasterValidationError{
+				Table: gachaMasterTable.Table, Line: lineOf(gachaMasterTable, row.Int("id")), Column: "pity_draws",
+				Message: "pity_draws must not be negative",
+			})
+		}
+		if row.Int("daily_draw_limit") < 0 {
+			errs = append(errs, &MasterValidationError{
+				Table: gachaMasterTable.Table, Line: lineOf(gachaMasterTable, row.Int("id")), Column: "daily_draw_limit",
+				Message: "daily_draw_limit must not be negative",
+			})
+		}
+		if row.Int("price") < 0 {
+			errs = append(errs, &MasterValidationError{
+				Table: gachaMasterTable.Table, Line: lineOf(gachaMasterTable, row.Int("id")), Column: "price",
+				Message: "price must not be negative",
+			})
+		}
+		if d := row.Int("multi_draw_discount"); d < 0 || d > 100 {
+			errs = append(errs, &MasterValidationError{
+				Table: gachaMasterTable.Table, Line: lineOf(gachaMasterTable, row.Int("id")), Column: "multi_draw_discount",
+				Message: fmt.Sprintf("multi_draw_discount must be between 0 and 100, got %d", d),
+			})
+		}
+		drawCounts, _ := row["draw_counts"].(string)
+		if len((&GachaMaster{DrawCountList: drawCounts}).DrawCounts()) == 0 {
+			errs = append(errs, &MasterValidationError{
+				Table: gachaMasterTable.Table, Line: lineOf(gachaMasterTable, row.Int("id")), Column: "draw_counts",
+				Message: fmt.Sprintf("draw_counts %q has no valid draw count", drawCounts),
+			})
+		}
+		switch row.Int("gacha_type") {
+		case int64(GachaTypeNormal), int64(GachaTypeBox):
+		case int64(GachaTypeStepUp):
+			stepPrices, _ := row["step_prices"].(string)
+			if len((&GachaMaster{GachaType: GachaTypeStepUp, StepPriceList: stepPrices}).StepPrices()) == 0 {
+				errs = append(errs, &MasterValidationError{
+					Table: gachaMasterTable.Table, Line: lineOf(gachaMasterTable, row.Int("id")), Column: "step_prices",
+					Message: fmt.Sprintf("step_prices %q has no valid step price", stepPrices),
+				})
+			}
+		default:
+			errs = append(errs, &MasterValidationError{
+				Table: gachaMasterTable.Table, Line: lineOf(gachaMasterTable, row.Int("id")), Column: "gacha_type",
+				Message: fmt.Sprintf("invalid gacha_type %d", row.Int("gacha_type")),
+			})
+		}
+		// ISU-COIN以外はuser_itemsで持つアイテムで払う
+		if row.Int("cost_item_type") != 1 {
+			checkCostItem(row)
+		}
+	}
+
+	// ガチャ排出アイテムは、アイテムかガチャが更新されたら全て確認する
+	_, itemsUploaded := uploads[itemMasterTable]
+	_, gachasUploaded := uploads[gachaMasterTable]
+	_, gachaItemsUploaded := uploads[gachaItemMasterTable]
+	if itemsUploaded || gachasUploaded || gachaItemsUploaded {
+		for _, row := range sortedMasterRows(merged[gachaItemMasterTable]) {
+			id := row.Int("id")
+			if _, ok := merged[gachaMasterTable][row.Int("gacha_id")]; !ok {
+				errs = append(errs, &MasterValidationError{
+					Table: gachaItemMasterTable.Table, Line: lineOf(gachaItemMasterTable, id), Column: "gacha_id",
+					Message: fmt.Sprintf("gacha_masters.id %d is not found", row.Int("gacha_id")),
+				})
+			}
+			if row.Int("weight") <= 0 {
+				errs = append(errs, &MasterValidationError{
+					Table: gachaItemMasterTable.Table, Line: lineOf(gachaItemMasterTable, id), Column: "weight",
+					Message: "weight must be greater than 0",
+				})
+			}
+			checkItem(gachaItemMasterTable, row)
+
+			gacha, ok := merged[gachaMasterTable][row.Int("gacha_id")]
+			if !ok {
+				continue
+			}
+			if gacha.Int("gacha_type") == int64(GachaTypeBox) && row.Int("stock") <= 0 {
+				errs = append(errs, &MasterValidationError{
+					Table: gachaItemMasterTable.Table, Line: lineOf(gachaItemMasterTable, id), Column: "stock",
+					Message: "stock of box gacha item must be greater than 0",
+				})
+			}
+			stepPrices, _ := gacha["step_prices"].(string)
+			steps := int64(len((&GachaMaster{StepPriceList: stepPrices}).StepPrices()))
+			if st := row.Int("step"); st < 0 || (gacha.Int("gacha_type") == int64(GachaTypeStepUp) && st > steps) {
+				errs = append(errs, &MasterValidationError{
+					Table: gachaItemMasterTable.Table, Line: lineOf(gachaItemMasterTable, id), Column: "step",
+					Message: fmt.Sprintf("step must be between 0 and %d, got %d", steps, st),
+				})
+			}
+		}
+
+		// 開示する排出率に問題が無いこと。ステップアップガチャはステップごと、ボックスガチャは在庫で確認する
+		gachaItems := map[int64][]*GachaItemMaster{}
+		for _, row := range sortedMasterRows(merged[gachaItemMasterTable]) {
+			gachaID := row.Int("gacha_id")
+			gachaItems[gachaID] = append(gachaItems[gachaID], &GachaItemMaster{
+				ID:     row.Int("id"),
+				Weight: int(row.Int("weight")),
+				IsRare: row.Int("is_rare") != 0,
+				Step:   int(row.Int("step")),
+				Stock:  int(row.Int("stock")),
+			})
+		}
+		for _, row := range sortedMasterRows(merged[gachaMasterTable]) {
+			stepPrices, _ := row["step_prices"].(string)
+			gacha := &GachaMaster{ID: row.Int("id"), GachaType: int(row.Int("gacha_type")), StepPriceList: stepPrices}
+			steps := 1
+			if gacha.GachaType == GachaTypeStepUp && len(gacha.StepPrices()) > 0 {
+				steps = len(gacha.StepPrices())
+			}
+			for step := 1; step <= steps; step++ {
+				pool := gachaPool(gacha, gachaItems[gacha.ID], &UserGachaState{Step: step}, nil)
+				for _, problem := range computeGachaRates(gacha, pool).problems() {
+					errs = append(errs, &MasterValidationError{
+						Table: gachaMasterTable.Table, Line: lineOf(gachaMasterTable, gacha.ID), Column: "id",
+						Message: fmt.Sprintf("drop rates of gacha %d (step %d): %s", gacha.ID, step, problem),
+					})
+				}
+			}
+		}
+	}
+
+	if _, ok := uploads[presentAllMasterTable]; ok || itemsUploaded {
+		for _, row := range sortedMasterRows(merged[presentAllMasterTable]) {
+			checkItem(presentAllMasterTable, row)
+		}
+	}
+	for _, row := range uploaded(presentAllMasterTable) {
+		checkPeriod(presentAllMasterTable, row, "registered_start_at", "registered_end_at")
+	}
+
+	for _, row := range uploaded(loginBonusMasterTable) {
+		checkPeriod(loginBonusMasterTable, row, "start_at", "end_at")
+	}
+
+	// ログインボーナスの報酬は1日目からcolumn_count日目まで欠けなく揃っていること
+	_, bonusesUploaded := uploads[loginBonusMasterTable]
+	_, rewardsUploaded := uploads[loginBonusRewardMasterTable]
+	if itemsUploaded || bonusesUploaded || rewardsUploaded {
+		sequences := map[int64][]int64{}
+		for _, row := range sortedMasterRows(merged[loginBonusRewardMasterTable]) {
+			bonusID := row.Int("login_bonus_id")
+			if _, ok := merged[loginBonusMasterTable][bonusID]; !ok {
+				errs = append(errs, &MasterValidationError{
+					Table: loginBonusRewardMasterTable.Table, Line: lineOf(loginBonusRewardMasterTable, row.Int("id")), Column: "login_bonus_id",
+					Message: fmt.Sprintf("login_bonus_masters.id %d is not found", bonusID),
+				})
+				continue
+			}
+			sequences[bonusID] = append(sequences[bonusID], row.Int("reward_sequence"))
+			checkItem(loginBonusRewardMasterTable, row)
+		}
+
+		// 報酬の並びを確認するのは、アップロードで変わりうるログインボーナスだけ
+		affected := map[int64]bool{}
+		for _, row := range uploaded(loginBonusMasterTable) {
+			affected[row.Int("id")] = true
+		}
+		for _, row := range uploaded(loginBonusRewardMasterTable) {
+			affected[row.Int("login_bonus_id")] = true
+			if before, ok := current[loginBonusRewardMasterTable][row.Int("id")]; ok {
+				affected[before.Int("login_bonus_id")] = true
+			}
+		}
+		for _, bonus := range sortedMasterRows(merged[loginBonusMasterTable]) {
+			bonusID := bonus.Int("id")
+			if !affected[bonusID] {
+				continue
+			}
+			seqs := sequences[bonusID]
+			sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+			columnCount := bonus.Int("column_count")
+			contiguous := int64(len(seqs)) == columnCount
+			for i, seq := range seqs {
+				if seq != int64(i+1) {
+					contiguous = false
+					break
+				}
+			}
+			if !contiguous {
+				errs = append(errs, &MasterValidationError{
+					Table: loginBonusMasterTable.Table, Line: lineOf(loginBonusMasterTable, bonusID), Column: "column_count",
+					Message: fmt.Sprintf("login bonus %d requires reward_sequence 1..%d, got %v", bonusID, columnCount, seqs),
+				})
+			}
+		}
+	}
+
+	return errs
+}
+
+// sortedMasterRows 行をIDの昇順で返す
+func sortedMasterRows(rows map[int64]masterRow) []masterRow {
+	res := make([]masterRow, 0, len(rows))
+	for _, row := range rows {
+		res = append(res, row)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Int("id") < res[j].Int("id") })
+	return res
+}
+
+// levelCurveFromRow 検証用に成長曲線の行を構造体にする
+func levelCurveFromRow(row masterRow) *LevelCurveMaster {
+	expTable, _ := row["exp_table"].(string)
+	expSegments, _ := row["exp_segments"].(string)
+	amountTable, _ := row["amount_table"].(string)
+	return &LevelCurveMaster{
+		ID:              row.Int("id"),
+		CurveType:       int(row.Int("curve_type")),
+		ExpRate:         int(row.Int("exp_rate")),
+		ExpTableList:    expTable,
+		ExpSegmentList:  expSegments,
+		AmountTableList: amountTable,
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const masterHistoryInsertChunkSize = 1000
+
+// MasterHistory マスタの1行の変更履歴(プライマリのみ)。追加ではBeforeDataが、削除ではAfterDataがnilになる
+type MasterHistory struct {
+	ID            int64   `json:"id" db:"id"`
+	UpdateID      int64   `json:"updateId" db:"update_id"`
+	UpdateSeq     int64   `json:"updateSeq" db:"update_seq"`
+	MasterVersion string  `json:"masterVersion" db:"master_version"`
+	TableName     string  `json:"tableName" db:"table_name"`
+	RowID         int64   `json:"rowId" db:"row_id"`
+	BeforeData    *string `json:"beforeData" db:"before_data"`
+	AfterData     *string `json:"afterData" db:"after_data"`
+	CreatedAt     int64   `json:"createdAt" db:"created_at"`
+}
+
+// appendMasterHistories 更新前後で変わった行を履歴に追加する
+func appendMasterHistories(histories []*MasterHistory, update *MasterUpdateLog, t *masterTable, before, after map[int64]masterRow) ([]*MasterHistory, error) {
+	ids := make([]int64, 0, len(after))
+	for id := range before {
+		ids = append(ids, id)
+	}
+	for id := range after {
+		if _, ok := before[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		b, a := before[id], after[id]
+		if b != nil && a != nil && masterRowEqual(t, b, a) {
+			continue
+		}
+
+		mh := &MasterHistory{
+			UpdateID:  update.ID,
+			UpdateSeq: update.Seq,
+			TableName: t.Table,
+			RowID:     id,
+			CreatedAt: update.CreatedAt,
+		}
+		var err error
+		if mh.BeforeData, err = encodeMasterRow(t, b); err != nil {
+			return nil, err
+		}
+		if mh.AfterData, err = encodeMasterRow(t, a); err != nil {
+			return nil, err
+		}
+		histories = append(histories, mh)
+	}
+
+	return histories, nil
+}
+
+// insertMasterHistories 履歴をまとめて書き込む
+func insertMasterHistories(ctx context.Context, db *sqlx.DB, conn *sqlx.Conn, histories []*MasterHistory) error {
+	query := "INSERT INTO master_histories(update_id, update_seq, master_version, table_name, row_id, before_data, after_data, created_at)" +
+		" VALUES (:update_id, :update_seq, :master_version, :table_name, :row_id, :before_data, :after_data, :created_at)"
+	for start := 0; start < len(histories); start += masterHistoryInsertChunkSize {
+		end := start + masterHistoryInsertChunkSize
+		if end > len(histories) {
+			end = len(histories)
+		}
+		q, args, err := db.BindNamed(query, histories[start:end])
+		if err != nil {
+			return err
+		}
+		if _, err = conn.ExecContext(ctx, q, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// masterRowEqual 全ての列の値が等しいか
+func masterRowEqual(t *masterTable, a, b masterRow) bool {
+	for _, col := range t.Columns {
+		if a[col.Name] != b[col.Name] {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeMasterRow 行をJSONにする。nilの行はnilのまま
+func encodeMasterRow(t *masterTable, row masterRow) (*string, error) {
+	if row == nil {
+		return nil, nil
+	}
+	v := make(map[string]interface{}, len(t.Columns))
+	for _, col := range t.Columns {
+		v[col.Name] = row[col.Name]
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	return &s, nil
+}
+
+// decodeMasterRow encodeMasterRowで作ったJSONを行に戻す
+func decodeMasterRow(t *masterTable, s string) (masterRow, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	v := map[string]interface{}{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	row := masterRow{}
+	for _, col := range t.Columns {
+		// 列を追加する前の履歴には既定値を使う
+		if _, ok := v[col.Name]; !ok {
+			if value, ok := t.Defaults[col.Name]; ok {
+				row[col.Name] = value
+				continue
+			}
+		}
+		switch value := v[col.Name].(type) {
+		case nil:
+			row[col.Name] = nil
+		case json.Number:
+			n, err := value.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", t.Table, col.Name, err)
+			}
+			row[col.Name] = n
+		case string:
+			row[col.Name] = value
+		default:
+			return nil, fmt.Errorf("%s.%s: unexpected value type %T", t.Table, col.Name, value)
+		}
+	}
+	return row, nil
+}
+
+// activeMasterVersionName 有効なマスタバージョン。無ければ空文字
+func activeMasterVersionName(ctx context.Context, q sqlx.QueryerContext) (string, error) {
+	var version string
+	if err := sqlx.GetContext(ctx, q, &version, "SELECT master_version FROM version_masters WHERE status=1"); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return version, nil
+}
+
+// masterVersionPoint マスタバージョンが最後に有効だった時点を、その時点より後の最初の更新のseqで返す
+// 更新IDはランダムで順序を持たないので、時点は必ずseqで比べる
+// 有効なマスタバージョンであれば現在の内容を指すmath.MaxInt64を返す
+func masterVersionPoint(ctx context.Context, q sqlx.QueryerContext, version string) (int64, error) {
+	active, err := activeMasterVersionName(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	if version == active {
+		return math.MaxInt64, nil
+	}
+
+	// そのバージョンにした更新の直後か、そのバージョンから切り替えた更新の直前のうち新しい方
+	var madeBy, leftBy sql.NullInt64
+	query := "SELECT MAX(seq) FROM master_update_logs WHERE status=? AND master_version=?"
+	if err = sqlx.GetContext(ctx, q, &madeBy, query, MasterUpdateStatusCommitted, version); err != nil {
+		return 0, err
+	}
+	query = "SELECT MAX(seq) FROM master_update_logs WHERE status=? AND previous_master_version=?"
+	if err = sqlx.GetContext(ctx, q, &leftBy, query, MasterUpdateStatusCommitted, version); err != nil {
+		return 0, err
+	}
+
+	var point int64
+	if madeBy.Valid {
+		point = madeBy.Int64 + 1
+	}
+	if leftBy.Valid && leftBy.Int64 > point {
+		point = leftBy.Int64
+	}
+	if point == 0 {
+		return 0, ErrMasterVersionNotFound
+	}
+	return point, nil
+}
+
+// masterRowsAsOf seqがuntil未満の更新だけを反映した時点のテーブルの内容
+// 現在の内容から、until以降に変わった行をその最初の変更前の内容に戻して求める
+func masterRowsAsOf(ctx context.Context, q sqlx.QueryerContext, t *masterTable, until int64) (map[int64]masterRow, error) {
+	rows, err := loadMasterRows(ctx, q, t)
+	if err != nil {
+		return nil, err
+	}
+	if until == math.MaxInt64 {
+		return rows, nil
+	}
+
+	histories := make([]*MasterHistory, 0)
+	query := "SELECT * FROM master_histories WHERE table_name=? AND update_seq>=? ORDER BY update_seq ASC, id ASC"
+	if err = sqlx.SelectContext(ctx, q, &histories, query, t.Table, until); err != nil {
+		return nil, err
+	}
+
+	reverted := map[int64]bool{}
+	for _, mh := range histories {
+		if reverted[mh.RowID] {
+			continue
+		}
+		reverted[mh.RowID] = true
+
+		if mh.BeforeData == nil {
+			delete(rows, mh.RowID)
+			continue
+		}
+		if rows[mh.RowID], err = decodeMasterRow(t, *mh.BeforeData); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
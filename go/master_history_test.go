@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+)
+
+// randomIDSeeds 次のgenerateIDがfirst、secondの順に小さくなる2つのシード
+func randomIDSeeds() (int64, int64) {
+	first := int64(1)
+	firstID := rand.New(rand.NewSource(first)).Intn(9223370036854775807)
+	for second := int64(2); ; second++ {
+		if rand.New(rand.NewSource(second)).Intn(9223370036854775807) < firstID {
+			return first, second
+		}
+	}
+}
+
+func TestMasterHistoryOrdersUpdatesBySeq(t *testing.T) {
+	db := openTestDB(t)
+	h := newTestHandler(t, db)
+	ctx := context.Background()
+
+	if _, err := db.Exec("INSERT INTO version_masters(id, status, master_version) VALUES (1, 1, 'v0')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO item_masters(id, item_type, name) VALUES (1, 3, 'initial')"); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(seed int64, version, name string) *MasterUpdateLog {
+		rand.Seed(seed)
+		stmts := []*masterUpdateStatement{
+			{
+				Table: versionMasterTable,
+				Data:  []map[string]interface{}{{"id": 1, "status": 1, "master_version": version}},
+			},
+			{
+				Table:   itemMasterTable,
+				Columns: itemMasterTable.Columns[:3],
+				Data:    []map[string]interface{}{{"id": 1, "item_type": 3, "name": name}},
+			},
+		}
+		u, err := h.applyMasterUpdate(stmts, "", 1656000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	// 後の更新ほどIDが小さくなるようにする
+	first, second := randomIDSeeds()
+	a := update(first, "v1", "a")
+	b := update(second, "v2", "b")
+	if a.ID <= b.ID {
+		t.Fatalf("update IDs are not in reverse order: %d, %d", a.ID, b.ID)
+	}
+	if a.Seq >= b.Seq {
+		t.Fatalf("seq is not increasing: %d, %d", a.Seq, b.Seq)
+	}
+
+	cases := []struct {
+		version string
+		want    string
+	}{
+		{version: "v0", want: "initial"},
+		{version: "v1", want: "a"},
+		{version: "v2", want: "b"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.version, func(t *testing.T) {
+			until, err := masterVersionPoint(ctx, db, tc.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := masterRowsAsOf(ctx, db, itemMasterTable, until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rows[1]["name"]; got != tc.want {
+				t.Errorf("item name as of %s is %v, expected %s", tc.version, got, tc.want)
+			}
+		})
+	}
+
+	var latest []*MasterUpdateLog
+	if err := db.Select(&latest, "SELECT * FROM master_update_logs ORDER BY seq DESC"); err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 2 || latest[0].ID != b.ID {
+		t.Errorf("latest update is not the last applied one")
+	}
+}
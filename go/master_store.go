@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+// masterStoreRefreshIntervalMS 他のノードでのマスタ更新を確認する間隔
+const masterStoreRefreshIntervalMS int = 1000
+
+// masterStoreCache コミット済みのマスタ更新のseqごとに読み込んだマスタデータ
+// 同じマスタバージョンのまま内容を変えた更新やロールバックもseqが変わるので読み直す
+var masterStoreCache = helpisu.NewCache[int64, *MasterStore]()
+
+var (
+	// activeMasterStore 有効なマスタバージョンのマスタデータ
+	activeMasterStore atomic.Pointer[MasterStore]
+	masterStoreLoadMu sync.Mutex
+)
+
+// MasterStore 1つのマスタバージョンのマスタデータ。読み込み後は変更しないこと
+type MasterStore struct {
+	Version *VersionMaster
+	// UpdateSeq 読み込んだ時点でコミット済みの最後のマスタ更新のseq
+	UpdateSeq int64
+
+	items             map[int64]*ItemMaster
+	gachas            []*GachaMaster
+	gachaItems        map[int64][]*GachaItemMaster
+	loginBonuses      []*LoginBonusMaster
+	loginBonusRewards map[int64]map[int]*LoginBonusRewardMaster
+	presentAlls       []*PresentAllMaster
+	levelCurves       map[int64]*LevelCurveMaster
+}
+
+// Item アイテムマスタをIDで取得する
+func (s *MasterStore) Item(itemID int64) (*ItemMaster, bool) {
+	item, ok := s.items[itemID]
+	return item, ok
+}
+
+// LevelCurve 成長曲線をIDで取得する。0なら既定の曲線
+func (s *MasterStore) LevelCurve(curveID int64) (*LevelCurveMaster, bool) {
+	if curveID == 0 {
+		return defaultLevelCurve, true
+	}
+	curve, ok := s.levelCurves[curveID]
+	return curve, ok
+}
+
+// Gacha 開催中のガチャをIDで取得する
+func (s *MasterStore) Gacha(gachaID int64, requestAt int64) (*GachaMaster, bool) {
+	for _, g := range s.gachas {
+		if g.ID == gachaID && g.StartAt <= requestAt && g.EndAt >= requestAt {
+			return g, true
+		}
+	}
+	return nil, false
+}
+
+// ActiveGachas 開催中のガチャを表示順で取得する
+func (s *MasterStore) ActiveGachas(requestAt int64) []*GachaMaster {
+	gachas := make([]*GachaMaster, 0)
+	for _, g := range s.gachas {
+		if g.StartAt <= requestAt && g.EndAt >= requestAt {
+			gachas = append(gachas, g)
+		}
+	}
+	return gachas
+}
+
+// Gachas 開催期間に関わらず全てのガチャを表示順で取得する
+func (s *MasterStore) Gachas() []*GachaMaster {
+	return s.gachas
+}
+
+// GachaItems ガチャの排出アイテムをID順で取得する
+func (s *MasterStore) GachaItems(gachaID int64) []*GachaItemMaster {
+	return s.gachaItems[gachaID]
+}
+
+// ActiveLoginBonuses 開催中のログインボーナスを取得する
+func (s *MasterStore) ActiveLoginBonuses(requestAt int64) []*LoginBonusMaster {
+	bonuses := make([]*LoginBonusMaster, 0)
+	for _, b := range s.loginBonuses {
+		if b.StartAt <= requestAt && b.EndAt >= requestAt {
+			bonuses = append(bonuses, b)
+		}
+	}
+	return bonuses
+}
+
+// LoginBonusReward ログインボーナスの報酬を何日目かで取得する
+func (s *MasterStore) LoginBonusReward(loginBonusID int64, rewardSequence int) (*LoginBonusRewardMaster, bool) {
+	reward, ok := s.loginBonusRewards[loginBonusID][rewardSequence]
+	return reward, ok
+}
+
+// ActivePresentAlls 配布中の全員プレゼントを取得する
+func (s *MasterStore) ActivePresentAlls(requestAt int64) []*PresentAllMaster {
+	presents := make([]*PresentAllMaster, 0)
+	for _, p := range s.presentAlls {
+		if p.RegisteredStartAt <= requestAt && p.RegisteredEndAt >= requestAt {
+			presents = append(presents, p)
+		}
+	}
+	return presents
+}
+
+// masterStore 有効なマスタデータを取得する。未読み込みであればプライマリから読み込む
+func (h *Handler) masterStore() (*MasterStore, error) {
+	if s := activeMasterStore.Load(); s != nil {
+		return s, nil
+	}
+
+	masterStoreLoadMu.Lock()
+	defer masterStoreLoadMu.Unlock()
+
+	if s := activeMasterStore.Load(); s != nil {
+		return s, nil
+	}
+	return h.reloadMasterStoreLocked(false)
+}
+
+// refreshMasterStore 有効なマスタバージョンとコミット済みのマスタ更新を確認し、変わっていれば差し替える
+func (h *Handler) refreshMasterStore() (*MasterStore, error) {
+	masterStoreLoadMu.Lock()
+	defer masterStoreLoadMu.Unlock()
+
+	return h.reloadMasterStoreLocked(false)
+}
+
+// reloadMasterStore マスタ更新後にマスタデータを読み直して差し替える
+func (h *Handler) reloadMasterStore() (*MasterStore, error) {
+	masterStoreLoadMu.Lock()
+	defer masterStoreLoadMu.Unlock()
+
+	return h.reloadMasterStoreLocked(true)
+}
+
+// reloadMasterStoreLocked 有効なマスタバージョンのマスタデータに差し替える。forceでなければ読み込み済みのものを使う
+func (h *Handler) reloadMasterStoreLocked(force bool) (*MasterStore, error) {
+	// マスタより先に読むので、読み込んだマスタはseqの時点かそれより新しい
+	var seq int64
+	query := "SELECT COALESCE(MAX(seq), 0) FROM master_update_logs WHERE status=?"
+	if err := h.DB.Get(&seq, query, MasterUpdateStatusCommitted); err != nil {
+		return nil, err
+	}
+
+	version := new(VersionMaster)
+	if err := h.DB.Get(version, "SELECT * FROM version_masters WHERE status=1"); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrActiveMasterVersionNotFound
+		}
+		return nil, err
+	}
+
+	s, ok := masterStoreCache.Get(seq)
+	if !ok || force || s.Version.MasterVersion != version.MasterVersion {
+		var err error
+		if s, err = loadMasterStore(h.DB, version); err != nil {
+			return nil, err
+		}
+		s.UpdateSeq = seq
+		// 古い時点のマスタデータは使わないので捨てる
+		masterStoreCache.Reset()
+		masterStoreCache.Set(seq, s)
+	}
+
+	if err := loadMasterVersionGrace(h.DB, version); err != nil {
+		return nil, err
+	}
+
+	activeMasterStore.Store(s)
+	return s, nil
+}
+
+// startMasterStoreRefresh 他のノードでのマスタ更新を定期的に確認して差し替える
+func (h *Handler) startMasterStoreRefresh(logger echo.Logger) {
+	t := helpisu.NewTicker(masterStoreRefreshIntervalMS, func() {
+		if _, err := h.refreshMasterStore(); err != nil && err != ErrActiveMasterVersionNotFound {
+			logger.Errorf("failed to refresh master store: %v", err)
+		}
+	})
+	go t.Start()
+}
+
+// resetMasterStore 読み込んだマスタデータを捨てる
+func resetMasterStore() {
+	masterStoreLoadMu.Lock()
+	defer masterStoreLoadMu.Unlock()
+
+	masterStoreCache.Reset()
+	activeMasterStore.Store(nil)
+	activeMasterGrace.Store(nil)
+}
+
+// loadMasterStore マスタデータを全て読み込んで索引を作る
+func loadMasterStore(db *sqlx.DB, version *VersionMaster) (*MasterStore, error) {
+	s := &MasterStore{
+		Version:           version,
+		items:             map[int64]*ItemMaster{},
+		gachaItems:        map[int64][]*GachaItemMaster{},
+		loginBonusRewards: map[int64]map[int]*LoginBonusRewardMaster{},
+		levelCurves:       map[int64]*LevelCurveMaster{},
+	}
+
+	items := make([]*ItemMaster, 0)
+	if err := db.Select(&items, "SELECT * FROM item_masters"); err != nil {
+		return nil, fmt.Errorf("failed to load item_masters: %w", err)
+	}
+	for _, v := range items {
+		s.items[v.ID] = v
+	}
+
+	levelCurves := make([]*LevelCurveMaster, 0)
+	if err := db.Select(&levelCurves, "SELECT * FROM level_curve_masters"); err != nil {
+		return nil, fmt.Errorf("failed to load level_curve_masters: %w", err)
+	}
+	for _, v := range levelCurves {
+		s.levelCurves[v.ID] = v
+	}
+
+	s.gachas = make([]*GachaMaster, 0)
+	if err := db.Select(&s.gachas, "SELECT * FROM gacha_masters ORDER BY display_order ASC"); err != nil {
+		return nil, fmt.Errorf("failed to load gacha_masters: %w", err)
+	}
+
+	gachaItems := make([]*GachaItemMaster, 0)
+	if err := db.Select(&gachaItems, "SELECT * FROM gacha_item_masters ORDER BY id ASC"); err != nil {
+		return nil, fmt.Errorf("failed to load gacha_item_masters: %w", err)
+	}
+	for _, v := range gachaItems {
+		s.gachaItems[v.GachaID] = append(s.gachaItems[v.GachaID], v)
+	}
+
+	s.loginBonuses = make([]*LoginBonusMaster, 0)
+	if err := db.Select(&s.loginBonuses, "SELECT * FROM login_bonus_masters ORDER BY id ASC"); err != nil {
+		return nil, fmt.Errorf("failed to load login_bonus_masters: %w", err)
+	}
+
+	rewards := make([]*LoginBonusRewardMaster, 0)
+	if err := db.Select(&rewards, "SELECT * FROM login_bonus_reward_masters"); err != nil {
+		return nil, fmt.Errorf("failed to load login_bonus_reward_masters: %w", err)
+	}
+	for _, v := range rewards {
+		if _, ok := s.loginBonusRewards[v.LoginBonusID]; !ok {
+			s.loginBonusRewards[v.LoginBonusID] = map[int]*LoginBonusRewardMaster{}
+		}
+		s.loginBonusRewards[v.LoginBonusID][v.RewardSequence] = v
+	}
+
+	s.presentAlls = make([]*PresentAllMaster, 0)
+	if err := db.Select(&s.presentAlls, "SELECT * FROM present_all_masters ORDER BY id ASC"); err != nil {
+		return nil, fmt.Errorf("failed to load present_all_masters: %w", err)
+	}
+
+	// 同じ表示順のガチャはIDの昇順に並べる
+	sort.SliceStable(s.gachas, func(i, j int) bool {
+		if s.gachas[i].DisplayOrder == s.gachas[j].DisplayOrder {
+			return s.gachas[i].ID < s.gachas[j].ID
+		}
+		return s.gachas[i].DisplayOrder < s.gachas[j].DisplayOrder
+	})
+
+	return s, nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	MasterUpdateStatusPreparing  int = 1
+	MasterUpdateStatusCommitting int = 2
+	MasterUpdateStatusCommitted  int = 3
+	MasterUpdateStatusAborted    int = 4
+	// MasterUpdateStatusFailed 一部のシャードだけコミットされた。修復が必要
+	MasterUpdateStatusFailed int = 5
+)
+
+// masterUpdateMu マスタ更新は同時に1つだけ行う
+var masterUpdateMu sync.Mutex
+
+// masterUpdateStatement 1テーブル分の更新内容
+type masterUpdateStatement struct {
+	Table *masterTable
+	// Columns 書き込む列。nilなら全ての列
+	Columns []masterColumn
+	Data    []map[string]interface{}
+	// Deletes 削除する行のID
+	Deletes []int64
+}
+
+// applyMasterUpdate 全シャードのマスタをXAトランザクションで更新する
+// 全シャードでPREPAREできた場合だけコミットし、途中で失敗したものは更新ログから修復できる
+// rollbackToはロールバックの場合に戻し先のマスタバージョンを指定する
+func (h *Handler) applyMasterUpdate(stmts []*masterUpdateStatement, rollbackTo string, requestAt int64) (*MasterUpdateLog, error) {
+	masterUpdateMu.Lock()
+	defer masterUpdateMu.Unlock()
+
+	id, err := h.generateID()
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]string, 0, len(stmts))
+	for _, s := range stmts {
+		tables = append(tables, s.Table.Table)
+	}
+	update := &MasterUpdateLog{
+		ID:         id,
+		Xid:        fmt.Sprintf("master-update-%d", id),
+		Status:     MasterUpdateStatusPreparing,
+		Tables:     strings.Join(tables, ","),
+		RollbackTo: rollbackTo,
+		CreatedAt:  requestAt,
+		UpdatedAt:  requestAt,
+	}
+	query := "INSERT INTO master_update_logs(id, xid, status, tables, master_version, previous_master_version, rollback_to, committed_shards, message, created_at, updated_at)" +
+		" VALUES (:id, :xid, :status, :tables, :master_version, :previous_master_version, :rollback_to, :committed_shards, :message, :created_at, :updated_at)"
+	res, err := h.DB.NamedExec(query, update)
+	if err != nil {
+		return nil, err
+	}
+	if update.Seq, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+
+	// リクエストが切断されても途中で止めないよう、リクエストのcontextは使わない
+	ctx := context.Background()
+	eg := errgroup.Group{}
+	for i, db := range h.Shards {
+		i, db := i, db
+		eg.Go(func() error {
+			// 履歴はプライマリにだけ、マスタの更新と同じトランザクションで書き込む
+			var history *MasterUpdateLog
+			if i == 0 {
+				history = update
+			}
+			if err := prepareMasterUpdate(ctx, db, update.Xid, stmts, history); err != nil {
+				return fmt.Errorf("shard %d: %w", i, err)
+			}
+			return nil
+		})
+	}
+	if err = eg.Wait(); err != nil {
+		if aerr := h.abortMasterUpdate(update, err.Error()); aerr != nil {
+			return update, aerr
+		}
+		return update, err
+	}
+
+	// 全シャードでPREPAREできたので、ここからはコミットすると決める
+	if err = h.updateMasterUpdateStatus(update, MasterUpdateStatusCommitting, ""); err != nil {
+		if aerr := h.abortMasterUpdate(update, err.Error()); aerr != nil {
+			return update, aerr
+		}
+		return update, err
+	}
+
+	return update, h.commitMasterUpdate(update)
+}
+
+// prepareMasterUpdate 1シャードでXAトランザクションを開始し、更新してPREPAREまで進める
+// historyを指定した場合は、変わった行をマスタの履歴に書き込み、更新前後のマスタバージョンをhistoryに設定する
+func prepareMasterUpdate(ctx context.Context, db *sqlx.DB, xid string, stmts []*masterUpdateStatement, history *MasterUpdateLog) (err error) {
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer func() {
+		// PREPARE前のXAトランザクションが残った接続をプールに戻さないよう、接続ごと捨てる
+		// 切断されたXAトランザクションはロールバックされる
+		if err != nil {
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn }) //nolint:errcheck
+		}
+	}()
+
+	if _, err = conn.ExecContext(ctx, fmt.Sprintf("XA START '%s'", xid)); err != nil {
+		return err
+	}
+
+	histories := make([]*MasterHistory, 0)
+	if history != nil {
+		if history.PreviousMasterVersion, err = activeMasterVersionName(ctx, conn); err != nil {
+			return err
+		}
+	}
+	for _, s := range stmts {
+		var before map[int64]masterRow
+		if history != nil {
+			if before, err = loadMasterRows(ctx, conn, s.Table); err != nil {
+				return err
+			}
+		}
+
+		if len(s.Data) > 0 {
+			query, args, err := db.BindNamed(s.Table.upsertQuery(s.Columns), s.Data)
+			if err != nil {
+				return err
+			}
+			if _, err = conn.ExecContext(ctx, query, args...); err != nil {
+				return fmt.Errorf("%s: %w", s.Table.Table, err)
+			}
+		}
+		if len(s.Deletes) > 0 {
+			query, args, err := sqlx.In(fmt.Sprintf("DELETE FROM %s WHERE id IN (?)", s.Table.Table), s.Deletes)
+			if err != nil {
+				return err
+			}
+			if _, err = conn.ExecContext(ctx, query, args...); err != nil {
+				return fmt.Errorf("%s: %w", s.Table.Table, err)
+			}
+		}
+
+		if history != nil {
+			after, err := loadMasterRows(ctx, conn, s.Table)
+			if err != nil {
+				return err
+			}
+			if histories, err = appendMasterHistories(histories, history, s.Table, before, after); err != nil {
+				return err
+			}
+		}
+	}
+
+	if history != nil {
+		if history.MasterVersion, err = activeMasterVersionName(ctx, conn); err != nil {
+			return err
+		}
+		for _, mh := range histories {
+			mh.MasterVersion = history.MasterVersion
+		}
+		if err = insertMasterHistories(ctx, db, conn, histories); err != nil {
+			return err
+		}
+	}
+
+	if _, err = conn.ExecContext(ctx, fmt.Sprintf("XA END '%s'", xid)); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("XA PREPARE '%s'", xid))
+	return err
+}
+
+// commitMasterUpdate PREPARE済みのシャードを順にコミットする。失敗したら修復待ちにする
+func (h *Handler) commitMasterUpdate(update *MasterUpdateLog) error {
+	committed := update.committedShards()
+	for i, db := range h.Shards {
+		if committed[i] {
+			continue
+		}
+
+		prepared, err := xaPrepared(db, update.Xid)
+		if err == nil && !prepared {
+			err = fmt.Errorf("xa transaction %s is not prepared on shard %d", update.Xid, i)
+		}
+		if err == nil {
+			_, err = db.Exec(fmt.Sprintf("XA COMMIT '%s'", update.Xid))
+		}
+		if err != nil {
+			if uerr := h.updateMasterUpdateStatus(update, MasterUpdateStatusFailed, err.Error()); uerr != nil {
+				return uerr
+			}
+			return err
+		}
+
+		committed[i] = true
+		update.setCommittedShards(committed)
+		if err = h.updateMasterUpdateStatus(update, update.Status, update.Message); err != nil {
+			return err
+		}
+	}
+
+	return h.updateMasterUpdateStatus(update, MasterUpdateStatusCommitted, "")
+}
+
+// abortMasterUpdate PREPARE済みのシャードをロールバックする
+func (h *Handler) abortMasterUpdate(update *MasterUpdateLog, message string) error {
+	for i, db := range h.Shards {
+		prepared, err := xaPrepared(db, update.Xid)
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+		if !prepared {
+			continue
+		}
+		if _, err = db.Exec(fmt.Sprintf("XA ROLLBACK '%s'", update.Xid)); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+
+	return h.updateMasterUpdateStatus(update, MasterUpdateStatusAborted, message)
+}
+
+// recoverMasterUpdates 再起動で中断されたマスタ更新を片付ける
+// コミットすると決める前のものはロールバックし、決めた後のものはコミットを続ける
+func (h *Handler) recoverMasterUpdates(logger echo.Logger) {
+	updates := make([]*MasterUpdateLog, 0)
+	query := "SELECT * FROM master_update_logs WHERE status IN (?, ?) ORDER BY seq ASC"
+	if err := h.DB.Select(&updates, query, MasterUpdateStatusPreparing, MasterUpdateStatusCommitting); err != nil {
+		logger.Errorf("failed to load master updates: %v", err)
+		return
+	}
+
+	for _, update := range updates {
+		var err error
+		if update.Status == MasterUpdateStatusPreparing {
+			err = h.abortMasterUpdate(update, "interrupted by server restart")
+		} else {
+			err = h.commitMasterUpdate(update)
+		}
+		if err != nil {
+			logger.Errorf("failed to recover master update %d: %v", update.ID, err)
+		}
+	}
+}
+
+func (h *Handler) updateMasterUpdateStatus(update *MasterUpdateLog, status int, message string) error {
+	update.Status = status
+	update.Message = message
+	update.UpdatedAt = time.Now().Unix()
+
+	query := "UPDATE master_update_logs SET status=?, master_version=?, previous_master_version=?, committed_shards=?, message=?, updated_at=? WHERE id=?"
+	_, err := h.DB.Exec(query, update.Status, update.MasterVersion, update.PreviousMasterVersion, update.CommittedShards, update.Message, update.UpdatedAt, update.ID)
+	return err
+}
+
+type xaRecoverRow struct {
+	FormatID    int64  `db:"formatID"`
+	GtridLength int64  `db:"gtrid_length"`
+	BqualLength int64  `db:"bqual_length"`
+	Data        string `db:"data"`
+}
+
+// xaPrepared PREPARE済みのXAトランザクションが残っているか
+func xaPrepared(db *sqlx.DB, xid string) (bool, error) {
+	rows := make([]*xaRecoverRow, 0)
+	if err := db.Select(&rows, "XA RECOVER"); err != nil {
+		return false, err
+	}
+	for _, r := range rows {
+		if r.Data == xid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// masterTableChecksum テーブルの全行をIDの昇順に並べたハッシュと行数
+func masterTableChecksum(ctx context.Context, db *sqlx.DB, t *masterTable) (string, int, error) {
+	rows, err := loadMasterRows(ctx, db, t)
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash := sha256.New()
+	enc := json.NewEncoder(hash)
+	for _, row := range sortedMasterRows(rows) {
+		values := make([]interface{}, 0, len(t.Columns))
+		for _, col := range t.Columns {
+			values = append(values, row[col.Name])
+		}
+		if err = enc.Encode(values); err != nil {
+			return "", 0, err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), len(rows), nil
+}
+
+type MasterUpdateLog struct {
+	ID int64 `json:"id" db:"id"`
+	// Seq 更新を始めた順の連番。IDはランダムなので順序にはこちらを使う
+	Seq    int64  `json:"seq" db:"seq"`
+	Xid    string `json:"xid" db:"xid"`
+	Status int    `json:"status" db:"status"`
+	// Tables 更新したテーブル(カンマ区切り)
+	Tables string `json:"tables" db:"tables"`
+	// MasterVersion 更新後に有効なマスタバージョン
+	MasterVersion         string `json:"masterVersion" db:"master_version"`
+	PreviousMasterVersion string `json:"previousMasterVersion" db:"previous_master_version"`
+	// RollbackTo ロールバックの場合の戻し先のマスタバージョン
+	RollbackTo string `json:"rollbackTo" db:"rollback_to"`
+	// CommittedShards コミット済みのシャード(カンマ区切り)
+	CommittedShards string `json:"committedShards" db:"committed_shards"`
+	Message         string `json:"message" db:"message"`
+	CreatedAt       int64  `json:"createdAt" db:"created_at"`
+	UpdatedAt       int64  `json:"updatedAt" db:"updated_at"`
+}
+
+func (u *MasterUpdateLog) committedShards() map[int]bool {
+	shards := map[int]bool{}
+	for _, s := range strings.Split(u.CommittedShards, ",") {
+		if n, err := strconv.Atoi(s); err == nil {
+			shards[n] = true
+		}
+	}
+	return shards
+}
+
+func (u *MasterUpdateLog) setCommittedShards(shards map[int]bool) {
+	list := make([]int, 0, len(shards))
+	for n := range shards {
+		list = append(list, n)
+	}
+	sort.Ints(list)
+
+	s := make([]string, 0, len(list))
+	for _, n := range list {
+		s = append(s, strconv.Itoa(n))
+	}
+	u.CommittedShards = strings.Join(s, ",")
+}
@@ -76,14 +76,14 @@ func (h *Handler) createUser(c echo.Context) error {
 	}
 
 	// 初期デッキ付与
-	initCard := new(ItemMaster)
-	query = "SELECT * FROM item_masters WHERE id=?"
-	if err = tx.Get(initCard, query, 2); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, ErrItemNotFound)
-		}
+	masters, err := h.masterStore()
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	initCard, ok := masters.Item(2)
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, ErrItemNotFound)
+	}
 
 	initCards := make([]*UserCard, 0, 3)
 	for i := 0; i < 3; i++ {
@@ -115,14 +115,18 @@ func (h *Handler) createUser(c echo.Context) error {
 	initDeck := &UserDeck{
 		ID:        deckID,
 		UserID:    user.ID,
+		Slot:      1,
 		CardID1:   initCards[0].ID,
 		CardID2:   initCards[1].ID,
 		CardID3:   initCards[2].ID,
 		CreatedAt: requestAt,
 		UpdatedAt: requestAt,
 	}
-	query = "INSERT INTO user_decks(id, user_id, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err := tx.Exec(query, initDeck.ID, initDeck.UserID, initDeck.CardID1, initDeck.CardID2, initDeck.CardID3, initDeck.CreatedAt, initDeck.UpdatedAt); err != nil {
+	query = "INSERT INTO user_decks(id, user_id, slot, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	if _, err := tx.Exec(query, initDeck.ID, initDeck.UserID, initDeck.Slot, initDeck.CardID1, initDeck.CardID2, initDeck.CardID3, initDeck.CreatedAt, initDeck.UpdatedAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if err = h.insertUserDeckHistory(tx, initDeck, requestAt); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -165,6 +169,12 @@ func (h *Handler) createUser(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
+	h.Sessions.Set(sess.SessionID, &SessionEntry{
+		UserID:    sess.UserID,
+		Shard:     h.Router.Shard(sess.UserID),
+		ExpiredAt: sess.ExpiredAt,
+	})
+
 	return successResponse(c, &CreateUserResponse{
 		UserID:           user.ID,
 		ViewerID:         req.ViewerID,
@@ -198,6 +208,13 @@ func (h *Handler) login(c echo.Context) error {
 
 	h.setDB(c, req.UserID)
 
+	return h.Migrator.guard(c, req.UserID, func(c echo.Context) error {
+		return h.loginUser(c, req)
+	})
+}
+
+// loginUser ログイン処理の本体
+func (h *Handler) loginUser(c echo.Context, req *LoginRequest) error {
 	requestAt, err := getRequestTime(c)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
@@ -275,6 +292,9 @@ func (h *Handler) login(c echo.Context) error {
 		if err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
+		if err = h.storeLoginSession(sess); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
 
 		return successResponse(c, &LoginResponse{
 			ViewerID:         req.ViewerID,
@@ -299,6 +319,9 @@ func (h *Handler) login(c echo.Context) error {
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	if err = h.storeLoginSession(sess); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
 
 	return successResponse(c, &LoginResponse{
 		ViewerID:         req.ViewerID,
@@ -307,6 +330,19 @@ func (h *Handler) login(c echo.Context) error {
 	})
 }
 
+// storeLoginSession 既存のセッションを全ノードで無効化してディレクトリに登録する
+func (h *Handler) storeLoginSession(sess *Session) error {
+	if err := h.revokeUserSessions(sess.UserID); err != nil {
+		return err
+	}
+	h.Sessions.Set(sess.SessionID, &SessionEntry{
+		UserID:    sess.UserID,
+		Shard:     h.Router.Shard(sess.UserID),
+		ExpiredAt: sess.ExpiredAt,
+	})
+	return nil
+}
+
 type LoginRequest struct {
 	ViewerID string `json:"viewerId"`
 	UserID   int64  `json:"userId"`
@@ -369,14 +405,13 @@ func isCompleteTodayLogin(lastActivatedAt, requestAt time.Time) bool {
 // obtainLoginBonus
 func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) ([]*UserLoginBonus, error) {
 	// login bonus masterから有効なログインボーナスを取得
-	loginBonuses := make([]*LoginBonusMaster, 0)
-	query := "SELECT * FROM login_bonus_masters WHERE start_at <= ? AND end_at >= ?"
-	if err := tx.Select(&loginBonuses, query, requestAt, requestAt); err != nil {
+	masters, err := h.masterStore()
+	if err != nil {
 		return nil, err
 	}
+	loginBonuses := masters.ActiveLoginBonuses(requestAt)
 
 	sendLoginBonuses := make([]*UserLoginBonus, 0)
-	obtainCoins := []*UserPresent{}
 	obtainCards := []*UserPresent{}
 	obtainGems := []*UserPresent{}
 
@@ -384,7 +419,7 @@ func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) (
 		initBonus := false
 		// ボーナスの進捗取得
 		userBonus := new(UserLoginBonus)
-		query = "SELECT * FROM user_login_bonuses WHERE user_id=? AND login_bonus_id=?"
+		query := "SELECT * FROM user_login_bonuses WHERE user_id=? AND login_bonus_id=?"
 		if err := tx.Get(userBonus, query, userID, bonus.ID); err != nil {
 			if err != sql.ErrNoRows {
 				return nil, err
@@ -421,13 +456,9 @@ func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) (
 		userBonus.UpdatedAt = requestAt
 
 		// 今回付与するリソース取得
-		rewardItem := new(LoginBonusRewardMaster)
-		query = "SELECT * FROM login_bonus_reward_masters WHERE login_bonus_id=? AND reward_sequence=?"
-		if err := tx.Get(rewardItem, query, bonus.ID, userBonus.LastRewardSequence); err != nil {
-			if err == sql.ErrNoRows {
-				return nil, ErrLoginBonusRewardNotFound
-			}
-			return nil, err
+		rewardItem, ok := masters.LoginBonusReward(bonus.ID, userBonus.LastRewardSequence)
+		if !ok {
+			return nil, ErrLoginBonusRewardNotFound
 		}
 
 		currentItem := &UserPresent{
@@ -442,10 +473,14 @@ func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) (
 
 		switch rewardItem.ItemType {
 		case 1: // coin
-			obtainCoins = append(obtainCoins, currentItem)
+			// 台帳にはログインボーナス報酬マスタのIDを記録する
+			refID := rewardItem.ID
+			if _, err := h.creditCoins(tx, userID, rewardItem.Amount, CoinReasonLoginBonus, &refID, requestAt); err != nil {
+				return nil, err
+			}
 		case 2: // card(ハンマー)
 			obtainCards = append(obtainCards, currentItem)
-		case 3, 4: // 強化素材
+		case 3, 4, 5: // 強化素材、ガチャチケット
 			obtainGems = append(obtainGems, currentItem)
 		default:
 			return nil, ErrInvalidItemType
@@ -467,11 +502,6 @@ func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) (
 		sendLoginBonuses = append(sendLoginBonuses, userBonus)
 	}
 
-	err := h.obtainCoins(tx, obtainCoins)
-	if err != nil {
-		return nil, err
-	}
-
 	err = h.obtainCards(tx, obtainCards)
 	if err != nil {
 		return nil, err
@@ -487,16 +517,14 @@ func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) (
 
 // obtainPresent プレゼント付与処理
 func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*UserPresent, error) {
-	normalPresents := make([]*PresentAllMaster, 0)
-	query := "SELECT * FROM present_all_masters WHERE registered_start_at <= ? AND registered_end_at >= ?"
-	if err := tx.Select(&normalPresents, query, requestAt, requestAt); err != nil {
+	masters, err := h.masterStore()
+	if err != nil {
 		return nil, err
 	}
+	normalPresents := masters.ActivePresentAlls(requestAt)
 
 	receivedPresentsID := make([]int64, 0)
-	query = "SELECT present_all_masters.id FROM present_all_masters" +
-		" JOIN user_present_all_received_history ON user_present_all_received_history.present_all_id = present_all_masters.id" +
-		" WHERE user_present_all_received_history.user_id=?"
+	query := "SELECT present_all_id FROM user_present_all_received_history WHERE user_id=?"
 	if err := tx.Select(&receivedPresentsID, query, userID); err != nil {
 		return nil, err
 	}
@@ -574,7 +602,7 @@ func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*
 		})
 	}
 
-	err := eg.Wait()
+	err = eg.Wait()
 	if err != nil {
 		return nil, err
 	}
@@ -129,14 +129,14 @@ func (h *Handler) receivePresent(c echo.Context) error {
 			obtainCoins = append(obtainCoins, obtainPresent[i])
 		case 2: // card(ハンマー)
 			obtainCards = append(obtainCards, obtainPresent[i])
-		case 3, 4: // 強化素材
+		case 3, 4, 5: // 強化素材、ガチャチケット
 			obtainGems = append(obtainGems, obtainPresent[i])
 		default:
 			return errorResponse(c, http.StatusBadRequest, err)
 		}
 	}
 
-	err = h.obtainCoins(tx, obtainCoins)
+	err = h.obtainCoins(tx, obtainCoins, CoinReasonPresent)
 	if err != nil {
 		if err == ErrUserNotFound || err == ErrItemNotFound {
 			return errorResponse(c, http.StatusNotFound, err)
@@ -187,69 +187,33 @@ type ReceivePresentResponse struct {
 	UpdatedResources *UpdatedResource `json:"updatedResources"`
 }
 
-func (h *Handler) obtainCoins(tx *sqlx.Tx, obtainCoins []*UserPresent) error {
-	userCoinIds := make([]int64, len(obtainCoins))
-	userCoinFromDB := make([]*User, len(obtainCoins))
-	userCoinMap := make(map[int64]*User, len(obtainCoins))
-	userCoins := make([]*User, 0, len(obtainCoins))
-
-	if len(obtainCoins) == 0 {
-		return nil
-	}
-
-	for i := range obtainCoins {
-		userCoinIds = append(userCoinIds, obtainCoins[i].UserID)
-	}
-
-	query := "SELECT * FROM users WHERE id IN (?)"
-	query, params, err := sqlx.In(query, userCoinIds)
-	if err != nil {
-		return err
-	}
-	err = tx.Select(&userCoinFromDB, query, params...)
-	if err != nil {
-		return err
-	}
-	for i := range userCoinFromDB {
-		userCoinMap[userCoinFromDB[i].ID] = userCoinFromDB[i]
-	}
-	for i := range obtainCoins {
-		userCoinMap[obtainCoins[i].UserID].IsuCoin += int64(obtainCoins[i].Amount)
-		userCoins = append(userCoins, userCoinMap[obtainCoins[i].UserID])
-	}
-
-	if len(userCoins) <= 0 {
-		return nil
-	}
-
-	// query := "UPDATE users SET isu_coin=? WHERE id=?"
-	query = "INSERT INTO users(id, isu_coin, last_activated_at, registered_at, last_getreward_at, created_at, updated_at)" +
-		" VALUES(:id, :isu_coin, :last_activated_at, :registered_at, :last_getreward_at, :created_at, :updated_at)" +
-		" ON DUPLICATE KEY UPDATE isu_coin = VALUES(isu_coin)"
-	if _, err := tx.NamedExec(query, userCoins); err != nil {
-		return err
+// obtainCoins ISU-COINのプレゼントを1件ずつ付与し、台帳にはreasonとプレゼントのIDを記録する
+func (h *Handler) obtainCoins(tx *sqlx.Tx, obtainCoins []*UserPresent, reason int) error {
+	for _, v := range obtainCoins {
+		var refID *int64
+		if v.ID != 0 {
+			id := v.ID
+			refID = &id
+		}
+		if _, err := h.creditCoins(tx, v.UserID, int64(v.Amount), reason, refID, v.UpdatedAt); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
 func (h *Handler) obtainCards(tx *sqlx.Tx, obtainCards []*UserPresent) error {
-	query := "SELECT * FROM item_masters WHERE item_type=?"
-	items := []*ItemMaster{}
-	if err := tx.Select(&items, query, 2); err != nil {
+	masters, err := h.masterStore()
+	if err != nil {
 		return err
 	}
 
 	cards := make([]*UserCard, 0, len(obtainCards))
 
 	for i := range obtainCards {
-		var item *ItemMaster
-		for j := range items {
-			if obtainCards[i].ItemID == items[j].ID {
-				item = items[j]
-			}
-		}
-		if item == nil {
+		item, ok := masters.Item(obtainCards[i].ItemID)
+		if !ok || item.ItemType != 2 {
 			return ErrItemNotFound
 		}
 
@@ -275,7 +239,7 @@ func (h *Handler) obtainCards(tx *sqlx.Tx, obtainCards []*UserPresent) error {
 		return nil
 	}
 
-	query = "INSERT INTO user_cards(id, user_id, card_id, amount_per_sec, level, total_exp, created_at, updated_at)" +
+	query := "INSERT INTO user_cards(id, user_id, card_id, amount_per_sec, level, total_exp, created_at, updated_at)" +
 		" VALUES (:id, :user_id, :card_id, :amount_per_sec, :level, :total_exp, :created_at, :updated_at)"
 	if _, err := tx.NamedExec(query, cards); err != nil {
 		return err
@@ -285,30 +249,24 @@ func (h *Handler) obtainCards(tx *sqlx.Tx, obtainCards []*UserPresent) error {
 }
 
 func (h *Handler) obtainGems(tx *sqlx.Tx, obtainGems []*UserPresent) error {
-	query := "SELECT * FROM item_masters"
-	items := []*ItemMaster{}
-	if err := tx.Select(&items, query); err != nil {
+	masters, err := h.masterStore()
+	if err != nil {
 		return err
 	}
 
 	uItemsMap := make(map[string]*UserItem, len(obtainGems))
 
 	for i := range obtainGems {
-		var item *ItemMaster
-		for j := range items {
-			if obtainGems[i].ItemID == items[j].ID {
-				item = items[j]
-			}
-		}
-		if item == nil {
+		item, ok := masters.Item(obtainGems[i].ItemID)
+		if !ok {
 			return ErrItemNotFound
 		}
 
 		// 所持数取得
 		index := strconv.Itoa(int(obtainGems[i].UserID)) + strconv.Itoa(int(item.ID))
-		_, ok := uItemsMap[index]
+		_, ok = uItemsMap[index]
 		if !ok {
-			query = "SELECT * FROM user_items WHERE user_id=? AND item_id=?"
+			query := "SELECT * FROM user_items WHERE user_id=? AND item_id=?"
 			uItemsMap[index] = new(UserItem)
 			if err := tx.Get(uItemsMap[index], query, obtainGems[i].UserID, item.ID); err != nil {
 				if err != sql.ErrNoRows {
@@ -349,7 +307,7 @@ func (h *Handler) obtainGems(tx *sqlx.Tx, obtainGems []*UserPresent) error {
 		return nil
 	}
 
-	query = "INSERT INTO user_items(id, user_id, item_id, item_type, amount, created_at, updated_at)" +
+	query := "INSERT INTO user_items(id, user_id, item_id, item_type, amount, created_at, updated_at)" +
 		" VALUES (:id, :user_id, :item_id, :item_type, :amount, :created_at, :updated_at)" +
 		" ON DUPLICATE KEY UPDATE amount = VALUES(amount), updated_at=VALUES(updated_at)"
 	if _, err := tx.NamedExec(query, uItems); err != nil {
@@ -388,37 +346,16 @@ func (h *Handler) listItem(c echo.Context) error {
 	}
 
 	cardList := make([]*UserCard, 0)
-	query = "SELECT * FROM user_cards WHERE user_id=?"
+	query = "SELECT * FROM user_cards WHERE user_id=? AND deleted_at IS NULL"
 	if err = c.Get("db").(*sqlx.DB).Select(&cardList, query, userID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	// generate one time token
-	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = c.Get("db").(*sqlx.DB).Exec(query, requestAt, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-	tID, err := h.generateID()
+	token, err := h.Tokens.Issue(c.Get("db").(*sqlx.DB), userID, TokenPurposeCardExp, requestAt)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	tk, err := generateULID()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-	token := &UserOneTimeToken{
-		ID:        tID,
-		UserID:    userID,
-		Token:     tk,
-		TokenType: 2,
-		CreatedAt: requestAt,
-		UpdatedAt: requestAt,
-		ExpiredAt: requestAt + 600,
-	}
-	query = "INSERT INTO user_one_time_tokens(id, user_id, token, token_type, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err = c.Get("db").(*sqlx.DB).Exec(query, token.ID, token.UserID, token.Token, token.TokenType, token.CreatedAt, token.UpdatedAt, token.ExpiredAt); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
 
 	return successResponse(c, &ListItemResponse{
 		OneTimeToken: token.Token,
@@ -36,10 +36,16 @@ func (h *Handler) reward(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	// 最後に取得した報酬時刻取得
+	tx, err := c.Get("db").(*sqlx.DB).Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 最後に取得した報酬時刻取得。同時に受け取っても二重に付与しないよう行をロックする
 	user := new(User)
-	query := "SELECT * FROM users WHERE id=?"
-	if err = c.Get("db").(*sqlx.DB).Get(user, query, userID); err != nil {
+	query := "SELECT * FROM users WHERE id=? FOR UPDATE"
+	if err = tx.Get(user, query, userID); err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
@@ -47,9 +53,8 @@ func (h *Handler) reward(c echo.Context) error {
 	}
 
 	// 使っているデッキの取得
-	deck := new(UserDeck)
-	query = "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL"
-	if err = c.Get("db").(*sqlx.DB).Get(deck, query, userID); err != nil {
+	deck, err := getActiveDeck(tx, userID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, err)
 		}
@@ -57,8 +62,8 @@ func (h *Handler) reward(c echo.Context) error {
 	}
 
 	cards := make([]*UserCard, 0)
-	query = "SELECT * FROM user_cards WHERE id IN (?, ?, ?)"
-	if err = c.Get("db").(*sqlx.DB).Select(&cards, query, deck.CardID1, deck.CardID2, deck.CardID3); err != nil {
+	query = "SELECT * FROM user_cards WHERE id IN (?, ?, ?) AND deleted_at IS NULL"
+	if err = tx.Select(&cards, query, deck.CardID1, deck.CardID2, deck.CardID3); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	if len(cards) != 3 {
@@ -70,11 +75,17 @@ func (h *Handler) reward(c echo.Context) error {
 	getCoin := int(pastTime) * (cards[0].AmountPerSec + cards[1].AmountPerSec + cards[2].AmountPerSec)
 
 	// 報酬の保存(ゲームない通貨を保存)(users)
-	user.IsuCoin += int64(getCoin)
+	if user.IsuCoin, err = h.creditCoins(tx, userID, int64(getCoin), CoinReasonReward, nil, requestAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
 	user.LastGetRewardAt = requestAt
 
-	query = "UPDATE users SET isu_coin=?, last_getreward_at=? WHERE id=?"
-	if _, err = c.Get("db").(*sqlx.DB).Exec(query, user.IsuCoin, user.LastGetRewardAt, user.ID); err != nil {
+	query = "UPDATE users SET last_getreward_at=? WHERE id=?"
+	if _, err = tx.Exec(query, user.LastGetRewardAt, user.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = tx.Commit(); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
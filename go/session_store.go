@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+const (
+	SessionStoreMemory string = "memory"
+	SessionStoreNone   string = "none"
+
+	// sessionRevocationIntervalMS 他のノードでのセッションの無効化を確認する間隔
+	sessionRevocationIntervalMS int = 1000
+	// sessionRevocationRetention セッションの無効化の記録を残す秒数
+	sessionRevocationRetention int64 = 3600
+)
+
+// SessionEntry セッションIDに紐づくユーザとシャード
+type SessionEntry struct {
+	UserID    int64 `json:"userId"`
+	Shard     int   `json:"shard"`
+	ExpiredAt int64 `json:"expiredAt"`
+}
+
+// SessionStore セッションIDからユーザとシャードを引くディレクトリ
+// ヒットしたエントリはDBを確かめずに使う。無効化はrevokeUserSessionsで全ノードに伝える
+type SessionStore interface {
+	Get(sessionID string) (*SessionEntry, bool)
+	Set(sessionID string, entry *SessionEntry)
+	Delete(sessionID string)
+	// DeleteUser ユーザの全セッションをこのノードのディレクトリから消す
+	DeleteUser(userID int64)
+	Reset()
+	Stats() *SessionStoreStats
+}
+
+type SessionStoreStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Fallbacks int64 `json:"fallbacks"`
+	Size      int   `json:"size"`
+}
+
+// newSessionStore ISUCON_SESSION_STOREに応じたSessionStoreを生成する
+func newSessionStore() (SessionStore, error) {
+	switch kind := getEnv("ISUCON_SESSION_STORE", SessionStoreMemory); kind {
+	case SessionStoreMemory:
+		ttl, err := strconv.Atoi(getEnv("ISUCON_SESSION_TTL", "86400"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ISUCON_SESSION_TTL: %w", err)
+		}
+		return newMemorySessionStore(time.Duration(ttl) * time.Second), nil
+	case SessionStoreNone:
+		return &nopSessionStore{}, nil
+	default:
+		return nil, fmt.Errorf("unknown session store: %s", kind)
+	}
+}
+
+// memorySessionStore ノードごとのTTL付きインメモリストア
+type memorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*memorySessionItem
+	users    map[int64]map[string]struct{}
+	ttl      time.Duration
+	ticker   *helpisu.Ticker
+
+	hits   int64
+	misses int64
+}
+
+type memorySessionItem struct {
+	entry    *SessionEntry
+	storedAt time.Time
+}
+
+func newMemorySessionStore(ttl time.Duration) *memorySessionStore {
+	s := &memorySessionStore{
+		sessions: map[string]*memorySessionItem{},
+		users:    map[int64]map[string]struct{}{},
+		ttl:      ttl,
+	}
+	s.ticker = helpisu.NewTicker(60*1000, s.evict)
+	go s.ticker.Start()
+	return s
+}
+
+func (s *memorySessionStore) Get(sessionID string) (*SessionEntry, bool) {
+	s.mu.RLock()
+	item, ok := s.sessions[sessionID]
+	s.mu.RUnlock()
+
+	if !ok || time.Since(item.storedAt) > s.ttl {
+		atomic.AddInt64(&s.misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&s.hits, 1)
+	return item.entry, true
+}
+
+func (s *memorySessionStore) Set(sessionID string, entry *SessionEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[sessionID] = &memorySessionItem{entry: entry, storedAt: time.Now()}
+	if _, ok := s.users[entry.UserID]; !ok {
+		s.users[entry.UserID] = map[string]struct{}{}
+	}
+	s.users[entry.UserID][sessionID] = struct{}{}
+}
+
+func (s *memorySessionStore) Delete(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteLocked(sessionID)
+}
+
+func (s *memorySessionStore) DeleteUser(userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sessionID := range s.users[userID] {
+		delete(s.sessions, sessionID)
+	}
+	delete(s.users, userID)
+}
+
+func (s *memorySessionStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions = map[string]*memorySessionItem{}
+	s.users = map[int64]map[string]struct{}{}
+	atomic.StoreInt64(&s.hits, 0)
+	atomic.StoreInt64(&s.misses, 0)
+}
+
+func (s *memorySessionStore) Stats() *SessionStoreStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return &SessionStoreStats{
+		Hits:   atomic.LoadInt64(&s.hits),
+		Misses: atomic.LoadInt64(&s.misses),
+		Size:   len(s.sessions),
+	}
+}
+
+func (s *memorySessionStore) deleteLocked(sessionID string) {
+	item, ok := s.sessions[sessionID]
+	if !ok {
+		return
+	}
+	delete(s.sessions, sessionID)
+	if ids, ok := s.users[item.entry.UserID]; ok {
+		delete(ids, sessionID)
+		if len(ids) == 0 {
+			delete(s.users, item.entry.UserID)
+		}
+	}
+}
+
+// evict TTLを過ぎたセッションを捨てる
+func (s *memorySessionStore) evict() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sessionID, item := range s.sessions {
+		if time.Since(item.storedAt) > s.ttl {
+			s.deleteLocked(sessionID)
+		}
+	}
+}
+
+// nopSessionStore 何も保持しない。常にDBを参照する従来の挙動になる
+type nopSessionStore struct {
+	misses int64
+}
+
+func (s *nopSessionStore) Get(string) (*SessionEntry, bool) {
+	atomic.AddInt64(&s.misses, 1)
+	return nil, false
+}
+func (s *nopSessionStore) Set(string, *SessionEntry) {}
+func (s *nopSessionStore) Delete(string)             {}
+func (s *nopSessionStore) DeleteUser(int64)          {}
+func (s *nopSessionStore) Reset()                    { atomic.StoreInt64(&s.misses, 0) }
+func (s *nopSessionStore) Stats() *SessionStoreStats {
+	return &SessionStoreStats{Misses: atomic.LoadInt64(&s.misses)}
+}
+
+// revokeUserSessions ユーザのセッションを全ノードのディレクトリから消す
+// このノードではすぐに消し、他のノードはプライマリに残した記録をapplySessionRevocationsで読んで消す
+func (h *Handler) revokeUserSessions(userID int64) error {
+	h.Sessions.DeleteUser(userID)
+	query := "INSERT INTO user_session_revocations(user_id, created_at) VALUES (?, ?)"
+	_, err := h.DB.Exec(query, userID, time.Now().Unix())
+	return err
+}
+
+// startSessionRevocation 他のノードでのセッションの無効化を定期的に反映し、古い記録を消す
+func (h *Handler) startSessionRevocation(logger echo.Logger) {
+	t := helpisu.NewTicker(sessionRevocationIntervalMS, func() {
+		if err := h.applySessionRevocations(); err != nil {
+			logger.Errorf("failed to apply session revocations: %v", err)
+		}
+	})
+	go t.Start()
+
+	cleanup := helpisu.NewTicker(60*1000, func() {
+		// 最新の記録は残し、作り直されたテーブルと区別できるようにする
+		query := "DELETE FROM user_session_revocations WHERE id < ? AND created_at < ?"
+		if _, err := h.DB.Exec(query, atomic.LoadInt64(&h.sessionRevocationSeq), time.Now().Unix()-sessionRevocationRetention); err != nil {
+			logger.Errorf("failed to clean up session revocations: %v", err)
+		}
+	})
+	go cleanup.Start()
+}
+
+// applySessionRevocations 前回より後に記録された無効化をこのノードのディレクトリに反映する
+func (h *Handler) applySessionRevocations() error {
+	var latest int64
+	if err := h.DB.Get(&latest, "SELECT COALESCE(MAX(id), 0) FROM user_session_revocations"); err != nil {
+		return err
+	}
+
+	seen := atomic.LoadInt64(&h.sessionRevocationSeq)
+	if latest < seen {
+		// 初期化でテーブルが作り直されたので、どのセッションが無効になったか分からない
+		h.Sessions.Reset()
+		seen = 0
+	}
+	if latest > seen {
+		userIDs := make([]int64, 0)
+		query := "SELECT user_id FROM user_session_revocations WHERE id > ? AND id <= ?"
+		if err := h.DB.Select(&userIDs, query, seen, latest); err != nil {
+			return err
+		}
+		for _, userID := range userIDs {
+			h.Sessions.DeleteUser(userID)
+		}
+	}
+	atomic.StoreInt64(&h.sessionRevocationSeq, latest)
+	return nil
+}
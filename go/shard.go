@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ShardRouter ユーザIDから所属するシャードのインデックス(0始まり)を決定する
+type ShardRouter interface {
+	Shard(userID int64) int
+}
+
+const (
+	ShardStrategyTable string = "table"
+	ShardStrategyRange string = "range"
+	ShardStrategyHash  string = "hash"
+
+	defaultVirtualNodes int = 64
+	// defaultHostShards ISUCON_DB_HOST_{n}が無くても127.0.0.1に繋ぐシャードの数
+	defaultHostShards int = 4
+)
+
+// defaultShardTable 従来の userID % 7 による 2/2/2/1 の振り分け
+var defaultShardTable = []int{0, 0, 1, 1, 2, 2, 3}
+
+// ShardConfig シャード構成
+type ShardConfig struct {
+	Strategy     string       `json:"strategy"`
+	Shards       int          `json:"shards"`
+	Table        []int        `json:"table"`
+	Ranges       []ShardRange `json:"ranges"`
+	Weights      []int        `json:"weights"`
+	VirtualNodes int          `json:"virtualNodes"`
+}
+
+// ShardRange [Start, End) の範囲のユーザIDをShardに割り当てる。Endが0の場合は上限なし
+type ShardRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Shard int   `json:"shard"`
+}
+
+// loadShardConfig ISUCON_SHARD_CONFIGが指定されていればJSONファイルから、なければ環境変数から構成を読み込む
+func loadShardConfig() (*ShardConfig, error) {
+	if path := os.Getenv("ISUCON_SHARD_CONFIG"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg := new(ShardConfig)
+		if err := json.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse shard config %s: %w", path, err)
+		}
+		if cfg.Strategy == "" {
+			cfg.Strategy = ShardStrategyTable
+		}
+		if cfg.Shards == 0 {
+			cfg.Shards = 4
+		}
+		if cfg.Strategy == ShardStrategyTable && len(cfg.Table) == 0 {
+			cfg.Table = defaultShardTable
+		}
+		return cfg, nil
+	}
+
+	shards, err := strconv.Atoi(getEnv("ISUCON_SHARD_COUNT", "4"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ISUCON_SHARD_COUNT: %w", err)
+	}
+	cfg := &ShardConfig{
+		Strategy:     getEnv("ISUCON_SHARD_STRATEGY", ShardStrategyTable),
+		Shards:       shards,
+		VirtualNodes: defaultVirtualNodes,
+	}
+
+	if cfg.Table, err = parseIntList(os.Getenv("ISUCON_SHARD_TABLE")); err != nil {
+		return nil, fmt.Errorf("invalid ISUCON_SHARD_TABLE: %w", err)
+	}
+	if cfg.Strategy == ShardStrategyTable && len(cfg.Table) == 0 {
+		cfg.Table = defaultShardTable
+	}
+	if cfg.Weights, err = parseIntList(os.Getenv("ISUCON_SHARD_WEIGHTS")); err != nil {
+		return nil, fmt.Errorf("invalid ISUCON_SHARD_WEIGHTS: %w", err)
+	}
+	if cfg.Ranges, err = parseShardRanges(os.Getenv("ISUCON_SHARD_RANGES")); err != nil {
+		return nil, fmt.Errorf("invalid ISUCON_SHARD_RANGES: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// validateShardHosts defaultHostShardsを超えるシャードはISUCON_DB_HOST_{n}が設定されているかを確認する
+func validateShardHosts(cfg *ShardConfig) error {
+	for i := defaultHostShards + 1; i <= cfg.Shards; i++ {
+		if os.Getenv(fmt.Sprintf("ISUCON_DB_HOST_%d", i)) == "" {
+			return fmt.Errorf("ISUCON_DB_HOST_%d is required for %d shards", i, cfg.Shards)
+		}
+	}
+	return nil
+}
+
+// newShardRouter 構成に応じたShardRouterを生成する
+func newShardRouter(cfg *ShardConfig) (ShardRouter, error) {
+	if cfg.Shards <= 0 {
+		return nil, fmt.Errorf("shard count must be positive")
+	}
+
+	switch cfg.Strategy {
+	case ShardStrategyTable:
+		if len(cfg.Table) == 0 {
+			return nil, fmt.Errorf("shard table is empty")
+		}
+		for _, s := range cfg.Table {
+			if s < 0 || s >= cfg.Shards {
+				return nil, fmt.Errorf("shard table refers to unknown shard %d", s)
+			}
+		}
+		return &tableShardRouter{table: cfg.Table}, nil
+
+	case ShardStrategyRange:
+		if len(cfg.Ranges) == 0 {
+			return nil, fmt.Errorf("shard ranges are empty")
+		}
+		ranges := make([]ShardRange, len(cfg.Ranges))
+		copy(ranges, cfg.Ranges)
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+		for i, r := range ranges {
+			if r.Shard < 0 || r.Shard >= cfg.Shards {
+				return nil, fmt.Errorf("shard range refers to unknown shard %d", r.Shard)
+			}
+			if r.End != 0 && r.End <= r.Start {
+				return nil, fmt.Errorf("invalid shard range [%d, %d)", r.Start, r.End)
+			}
+			if i > 0 && (ranges[i-1].End == 0 || ranges[i-1].End > r.Start) {
+				return nil, fmt.Errorf("shard ranges overlap at %d", r.Start)
+			}
+		}
+		return &rangeShardRouter{ranges: ranges}, nil
+
+	case ShardStrategyHash:
+		weights := cfg.Weights
+		if len(weights) == 0 {
+			weights = make([]int, cfg.Shards)
+			for i := range weights {
+				weights[i] = 1
+			}
+		}
+		if len(weights) != cfg.Shards {
+			return nil, fmt.Errorf("shard weights must have %d entries", cfg.Shards)
+		}
+		vnodes := cfg.VirtualNodes
+		if vnodes <= 0 {
+			vnodes = defaultVirtualNodes
+		}
+		return newHashShardRouter(weights, vnodes)
+	}
+
+	return nil, fmt.Errorf("unknown shard strategy: %s", cfg.Strategy)
+}
+
+// tableShardRouter userID % len(table) をキーにしたルックアップテーブルで振り分ける
+type tableShardRouter struct {
+	table []int
+}
+
+func (r *tableShardRouter) Shard(userID int64) int {
+	i := userID % int64(len(r.table))
+	if i < 0 {
+		i = -i
+	}
+	return r.table[i]
+}
+
+// rangeShardRouter ユーザIDの範囲で振り分ける。どの範囲にも入らない場合は最後の範囲のシャード
+type rangeShardRouter struct {
+	ranges []ShardRange
+}
+
+func (r *rangeShardRouter) Shard(userID int64) int {
+	i := sort.Search(len(r.ranges), func(i int) bool { return r.ranges[i].Start > userID }) - 1
+	if i < 0 {
+		return r.ranges[0].Shard
+	}
+	if rg := r.ranges[i]; rg.End == 0 || userID < rg.End {
+		return rg.Shard
+	}
+	return r.ranges[len(r.ranges)-1].Shard
+}
+
+// hashShardRouter 重み付きの仮想ノードを持つコンシステントハッシュで振り分ける
+type hashShardRouter struct {
+	points []uint32
+	owners []int
+}
+
+func newHashShardRouter(weights []int, vnodes int) (*hashShardRouter, error) {
+	type point struct {
+		hash  uint32
+		shard int
+	}
+	points := make([]point, 0)
+	for shard, w := range weights {
+		if w < 0 {
+			return nil, fmt.Errorf("shard weight must not be negative")
+		}
+		for i := 0; i < w*vnodes; i++ {
+			points = append(points, point{hash: hashString(fmt.Sprintf("shard-%d-%d", shard, i)), shard: shard})
+		}
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("all shard weights are zero")
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	r := &hashShardRouter{
+		points: make([]uint32, len(points)),
+		owners: make([]int, len(points)),
+	}
+	for i, p := range points {
+		r.points[i] = p.hash
+		r.owners[i] = p.shard
+	}
+	return r, nil
+}
+
+func (r *hashShardRouter) Shard(userID int64) int {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(userID))
+	h := fnv.New32a()
+	h.Write(b) //nolint:errcheck
+	key := h.Sum32()
+
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= key })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s)) //nolint:errcheck
+	return h.Sum32()
+}
+
+// parseIntList "0,0,1,1" 形式の文字列をパースする
+func parseIntList(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	list := make([]int, 0)
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+// parseShardRanges "start-end:shard,start-:shard" 形式の文字列をパースする
+func parseShardRanges(s string) ([]ShardRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ranges := make([]ShardRange, 0)
+	for _, v := range strings.Split(s, ",") {
+		bounds, shard, ok := strings.Cut(strings.TrimSpace(v), ":")
+		if !ok {
+			return nil, fmt.Errorf("missing shard in %q", v)
+		}
+		start, end, ok := strings.Cut(bounds, "-")
+		if !ok {
+			return nil, fmt.Errorf("missing range in %q", v)
+		}
+		r := ShardRange{}
+		var err error
+		if r.Start, err = strconv.ParseInt(start, 10, 64); err != nil {
+			return nil, err
+		}
+		if end != "" {
+			if r.End, err = strconv.ParseInt(end, 10, 64); err != nil {
+				return nil, err
+			}
+		}
+		if r.Shard, err = strconv.Atoi(shard); err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
@@ -0,0 +1,860 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+const (
+	MigrationStatusCopying     int = 1 // 初回コピー中
+	MigrationStatusFencing     int = 2 // 全ノードが移行中のユーザへのリクエストをロックし始めるのを待っている
+	MigrationStatusCutover     int = 3 // 切り替え中
+	MigrationStatusCleanup     int = 4 // 移行元の削除中
+	MigrationStatusCompleted   int = 5
+	MigrationStatusFailed      int = 6
+	MigrationStatusRollingBack int = 7
+	MigrationStatusRolledBack  int = 8
+
+	migrationInsertChunkSize int = 1000
+
+	// shardRoutingRefreshIntervalMS 各ノードがプライマリから上書きと実行中の移行を読み直す間隔
+	shardRoutingRefreshIntervalMS int = 1000
+	// shardRoutingNodeStaleSec プライマリを読み直さなくなってからこの秒数が経ったノードは移行で待たない
+	// そのノード自身は半分の秒数で全てのユーザへのリクエストにロックを取り始める
+	shardRoutingNodeStaleSec int64 = 10
+	// migrationBarrierTimeoutSec 全ノードの確認を待つ最大の秒数
+	migrationBarrierTimeoutSec int64 = 60
+	// migrationLockTimeoutSec 移行中のユーザのロックを待つ秒数
+	migrationLockTimeoutSec int = 10
+	// migrationStaleAfterSec 更新が止まった移行を中断されたとみなすまでの秒数
+	migrationStaleAfterSec int64 = 10 * 60
+)
+
+// activeMigrationStatuses 実行中の移行の状態。この状態の移行があるユーザへのリクエストは全ノードでロックを取る
+var activeMigrationStatuses = []int{
+	MigrationStatusCopying,
+	MigrationStatusFencing,
+	MigrationStatusCutover,
+	MigrationStatusCleanup,
+	MigrationStatusRollingBack,
+}
+
+// ackMigrationStatuses 全ノードの確認を待ってから次に進む移行の状態
+var ackMigrationStatuses = map[int]struct{}{
+	MigrationStatusFencing:     {},
+	MigrationStatusCleanup:     {},
+	MigrationStatusRollingBack: {},
+}
+
+// userShardTable ユーザ単位でシャードに置かれるテーブル
+type userShardTable struct {
+	Name       string
+	UserColumn string
+}
+
+// userShardTables 移行対象のテーブル。ユーザデータのテーブルを追加したらここにも追加する
+var userShardTables = []userShardTable{
+	{Name: "users", UserColumn: "id"},
+	{Name: "user_devices", UserColumn: "user_id"},
+	{Name: "user_bans", UserColumn: "user_id"},
+	{Name: "user_cards", UserColumn: "user_id"},
+	{Name: "user_decks", UserColumn: "user_id"},
+	{Name: "user_items", UserColumn: "user_id"},
+	{Name: "user_login_bonuses", UserColumn: "user_id"},
+	{Name: "user_presents", UserColumn: "user_id"},
+	{Name: "user_present_all_received_history", UserColumn: "user_id"},
+	{Name: "user_sessions", UserColumn: "user_id"},
+	{Name: "user_one_time_tokens", UserColumn: "user_id"},
+	{Name: "user_gacha_pities", UserColumn: "user_id"},
+	{Name: "user_gacha_draws", UserColumn: "user_id"},
+	{Name: "user_gacha_draw_items", UserColumn: "user_id"},
+	{Name: "user_gacha_states", UserColumn: "user_id"},
+	{Name: "user_gacha_box_items", UserColumn: "user_id"},
+	{Name: "user_coin_transactions", UserColumn: "user_id"},
+	{Name: "user_idempotency_keys", UserColumn: "user_id"},
+	{Name: "user_active_decks", UserColumn: "user_id"},
+	{Name: "user_deck_histories", UserColumn: "user_id"},
+}
+
+// overrideShardRouter ユーザ単位の上書きを優先するShardRouter
+// 上書きはプライマリのuser_shard_overridesを各ノードが定期的に読み直したもの
+type overrideShardRouter struct {
+	base      ShardRouter
+	mu        sync.RWMutex
+	overrides map[int64]int
+}
+
+func newOverrideShardRouter(base ShardRouter) *overrideShardRouter {
+	return &overrideShardRouter{
+		base:      base,
+		overrides: make(map[int64]int),
+	}
+}
+
+func (r *overrideShardRouter) Shard(userID int64) int {
+	r.mu.RLock()
+	shard, ok := r.overrides[userID]
+	r.mu.RUnlock()
+	if ok {
+		return shard
+	}
+	return r.base.Shard(userID)
+}
+
+func (r *overrideShardRouter) set(userID int64, shard int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.base.Shard(userID) == shard {
+		delete(r.overrides, userID)
+		return
+	}
+	r.overrides[userID] = shard
+}
+
+func (r *overrideShardRouter) replace(overrides map[int64]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.overrides = overrides
+}
+
+// shardMigrator ユーザのシャード間移行を管理する
+// 移行の状態はプライマリのuser_shard_migrationsにあり、どのノードで始めた移行でも全ノードが従う
+type shardMigrator struct {
+	h      *Handler
+	router *overrideShardRouter
+	// nodeID 移行の確認に使うこのノードのID
+	nodeID string
+	// refreshedAt 最後にプライマリを読み直せた時刻(UnixNano)
+	refreshedAt int64
+
+	mu sync.Mutex
+	// migrating 実行中の移行があるユーザ
+	migrating map[int64]struct{}
+	// inflight ロックを取らずに処理しているリクエストの数
+	inflight map[int64]int
+}
+
+func newShardMigrator(h *Handler, router *overrideShardRouter) *shardMigrator {
+	return &shardMigrator{
+		h:         h,
+		router:    router,
+		nodeID:    helpisu.NewULID(),
+		migrating: make(map[int64]struct{}),
+		inflight:  make(map[int64]int),
+	}
+}
+
+// load 起動時に上書き設定と実行中の移行を読み込む
+func (m *shardMigrator) load() error {
+	if err := m.failStale(); err != nil {
+		return err
+	}
+	return m.refresh()
+}
+
+// startRefresh 他のノードで始まった移行と切り替えを定期的に取り込む
+func (m *shardMigrator) startRefresh(logger echo.Logger) {
+	t := helpisu.NewTicker(shardRoutingRefreshIntervalMS, func() {
+		if err := m.failStale(); err != nil {
+			logger.Errorf("failed to fail stale shard migrations: %v", err)
+		}
+		if err := m.refresh(); err != nil {
+			logger.Errorf("failed to refresh shard overrides: %v", err)
+		}
+	})
+	go t.Start()
+}
+
+// refresh 実行中の移行と上書きをプライマリから読み直し、読み直したことをプライマリに伝える
+// 上書きは移行中にしか変わらないので、移行を先に読み、上書きを先に差し替えることで、
+// 移行の終わったユーザが古い上書きのままロックを取らずに振り分けられることはない
+func (m *shardMigrator) refresh() error {
+	active := make([]*UserShardMigration, 0)
+	query, params, err := sqlx.In("SELECT * FROM user_shard_migrations WHERE status IN (?)", activeMigrationStatuses)
+	if err != nil {
+		return err
+	}
+	if err = m.h.DB.Select(&active, query, params...); err != nil {
+		return err
+	}
+	overrides := make([]*UserShardOverride, 0)
+	if err = m.h.DB.Select(&overrides, "SELECT * FROM user_shard_overrides"); err != nil {
+		return err
+	}
+
+	overrideMap := make(map[int64]int, len(overrides))
+	for _, o := range overrides {
+		overrideMap[o.UserID] = o.Shard
+	}
+	migrating := make(map[int64]struct{}, len(active))
+	for _, rec := range active {
+		migrating[rec.UserID] = struct{}{}
+	}
+
+	m.router.replace(overrideMap)
+	m.mu.Lock()
+	m.migrating = migrating
+	// 差し替えた後はロックを取らずに始まるリクエストはないので、残っていなければ確認済みにできる
+	acks := make([]*UserShardMigration, 0)
+	for _, rec := range active {
+		if _, ok := ackMigrationStatuses[rec.Status]; ok && m.inflight[rec.UserID] == 0 {
+			acks = append(acks, rec)
+		}
+	}
+	m.mu.Unlock()
+
+	now := time.Now()
+	for _, rec := range acks {
+		query := "INSERT IGNORE INTO user_shard_migration_acks(migration_id, status, node_id, created_at) VALUES (?, ?, ?, ?)"
+		if _, err := m.h.DB.Exec(query, rec.ID, rec.Status, m.nodeID, now.Unix()); err != nil {
+			return err
+		}
+	}
+	query = "INSERT INTO shard_routing_nodes(node_id, refreshed_at) VALUES (?, UNIX_TIMESTAMP()) ON DUPLICATE KEY UPDATE refreshed_at=VALUES(refreshed_at)"
+	if _, err := m.h.DB.Exec(query, m.nodeID); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&m.refreshedAt, now.UnixNano())
+	return nil
+}
+
+// failStale 更新が止まった移行を失敗にする。移行を実行していたノードが落ちた場合、ロールバックで片付ける
+func (m *shardMigrator) failStale() error {
+	now := time.Now().Unix()
+	query, params, err := sqlx.In("UPDATE user_shard_migrations SET status=?, message=?, updated_at=? WHERE status IN (?) AND updated_at < ?",
+		MigrationStatusFailed, "interrupted", now, activeMigrationStatuses, now-migrationStaleAfterSec)
+	if err != nil {
+		return err
+	}
+	_, err = m.h.DB.Exec(query, params...)
+	return err
+}
+
+// enter ロックを取らずに処理してよいユーザであれば、処理中のリクエストとして数える
+// プライマリを読み直せていないノードは移行に気づけないので、全てのユーザでロックを取る
+func (m *shardMigrator) enter(userID int64) bool {
+	refreshedAt := time.Unix(0, atomic.LoadInt64(&m.refreshedAt))
+	if time.Since(refreshedAt) > time.Duration(shardRoutingNodeStaleSec)*time.Second/2 {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.migrating[userID]; ok {
+		return false
+	}
+	m.inflight[userID]++
+	return true
+}
+
+// leave enterで数えたリクエストが終わった
+func (m *shardMigrator) leave(userID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inflight[userID]--; m.inflight[userID] <= 0 {
+		delete(m.inflight, userID)
+	}
+}
+
+func (m *shardMigrator) setMigrating(userID int64, migrating bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if migrating {
+		m.migrating[userID] = struct{}{}
+	} else {
+		delete(m.migrating, userID)
+	}
+}
+
+// migrationLock 移行中のユーザへのリクエストと移行の各段階を全ノードで直列化する、プライマリのGET_LOCK
+type migrationLock struct {
+	conn *sql.Conn
+	name string
+}
+
+// lock ユーザのロックを取る。migrationLockTimeoutSec秒待っても取れなければErrMigrationLockTimeout
+func (m *shardMigrator) lock(userID int64) (*migrationLock, error) {
+	ctx := context.Background()
+	conn, err := m.h.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("isucon_user_shard_%d", userID)
+	var got sql.NullInt64
+	if err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, migrationLockTimeoutSec).Scan(&got); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !got.Valid || got.Int64 != 1 {
+		conn.Close()
+		return nil, ErrMigrationLockTimeout
+	}
+	return &migrationLock{conn: conn, name: name}, nil
+}
+
+// unlock ロックを外す。外せなければロックを持ったまま接続がプールに戻らないよう接続を捨てる
+func (l *migrationLock) unlock() {
+	if _, err := l.conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", l.name); err != nil {
+		l.conn.Raw(func(interface{}) error { return driver.ErrBadConn }) //nolint:errcheck
+	}
+	l.conn.Close()
+}
+
+// currentShard プライマリの上書きを読んで、ユーザが今所属するシャードを返す
+func (m *shardMigrator) currentShard(userID int64) (int, error) {
+	shard := m.router.base.Shard(userID)
+	if err := m.h.DB.Get(&shard, "SELECT shard FROM user_shard_overrides WHERE user_id=?", userID); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	m.router.set(userID, shard)
+	return shard, nil
+}
+
+// guard 移行中のユーザへのリクエストを全ノードで移行の各段階と直列化し、プライマリの上書きに従って振り分ける
+func (m *shardMigrator) guard(c echo.Context, userID int64, next echo.HandlerFunc) error {
+	if m.enter(userID) {
+		defer m.leave(userID)
+		return next(c)
+	}
+
+	l, err := m.lock(userID)
+	if err != nil {
+		if err == ErrMigrationLockTimeout {
+			return errorResponse(c, http.StatusServiceUnavailable, err)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer l.unlock()
+
+	// 他のノードで切り替わっているかもしれない
+	shard, err := m.currentShard(userID)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	c.Set("db", m.h.Shards[shard])
+
+	return next(c)
+}
+
+// start 移行を開始する
+func (m *shardMigrator) start(userID int64, targetShard int, requestAt int64) (*UserShardMigration, error) {
+	if targetShard < 0 || targetShard >= len(m.h.Shards) {
+		return nil, ErrInvalidShard
+	}
+
+	l, err := m.lock(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+
+	sourceShard, err := m.currentShard(userID)
+	if err != nil {
+		return nil, err
+	}
+	if sourceShard == targetShard {
+		return nil, ErrInvalidShard
+	}
+	if running, err := m.countActive(userID, 0); err != nil {
+		return nil, err
+	} else if running > 0 {
+		return nil, ErrMigrationInProgress
+	}
+
+	var exists int
+	if err := m.h.Shards[sourceShard].Get(&exists, "SELECT COUNT(*) FROM users WHERE id=?", userID); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	mID, err := m.h.generateID()
+	if err != nil {
+		return nil, err
+	}
+	rec := &UserShardMigration{
+		ID:          mID,
+		UserID:      userID,
+		SourceShard: sourceShard,
+		TargetShard: targetShard,
+		Status:      MigrationStatusCopying,
+		CreatedAt:   requestAt,
+		UpdatedAt:   requestAt,
+	}
+	query := "INSERT INTO user_shard_migrations(id, user_id, source_shard, target_shard, status, message, copied_rows, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	if _, err = m.h.DB.Exec(query, rec.ID, rec.UserID, rec.SourceShard, rec.TargetShard, rec.Status, rec.Message, rec.CopiedRows, rec.CreatedAt, rec.UpdatedAt); err != nil {
+		return nil, err
+	}
+	m.setMigrating(userID, true)
+
+	go m.run(rec)
+
+	return rec, nil
+}
+
+// countActive ユーザの実行中の移行の数。excludeIDの移行は数えない
+func (m *shardMigrator) countActive(userID int64, excludeID int64) (int, error) {
+	query, params, err := sqlx.In("SELECT COUNT(*) FROM user_shard_migrations WHERE user_id=? AND id<>? AND status IN (?)", userID, excludeID, activeMigrationStatuses)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = m.h.DB.Get(&count, query, params...)
+	return count, err
+}
+
+// run 初回コピー -> 全ノードの待機 -> 切り替え -> 移行元削除 の順に実行する
+// 移行元への書き込みはリクエストごとに移行先へ反映せず、全ノードがこのユーザへのリクエストに
+// ロックを取り始めたことを確認してから、ロックを持った切り替えで一度だけ差分を取り込む
+func (m *shardMigrator) run(rec *UserShardMigration) {
+	src := m.h.Shards[rec.SourceShard]
+	dst := m.h.Shards[rec.TargetShard]
+	userID := rec.UserID
+
+	// 初回コピー
+	if _, err := syncUserRows(src, dst, userID); err != nil {
+		m.fail(rec, fmt.Errorf("copy: %w", err))
+		return
+	}
+	if err := m.step(rec, MigrationStatusCopying, func() error {
+		return m.updateStatus(rec, MigrationStatusFencing, "")
+	}); err != nil {
+		return
+	}
+
+	// 移行に気づく前のノードがロックを取らずに受けたリクエストが終わるのを待つ
+	if err := m.waitForNodes(rec); err != nil {
+		m.step(rec, MigrationStatusFencing, func() error { return err }) //nolint:errcheck
+		return
+	}
+
+	// 切り替え。ロックを持っている間は全ノードでこのユーザへのリクエストが止まる
+	var checksum string
+	if err := m.step(rec, MigrationStatusFencing, func() error {
+		if err := m.updateStatus(rec, MigrationStatusCutover, ""); err != nil {
+			return err
+		}
+		copied, err := syncUserRows(src, dst, userID)
+		if err != nil {
+			return fmt.Errorf("cutover: %w", err)
+		}
+		rec.CopiedRows = copied
+		if err := verifyUserRows(src, dst, userID); err != nil {
+			return fmt.Errorf("cutover: %w", err)
+		}
+		if checksum, err = checksumUserData(src, userID); err != nil {
+			return fmt.Errorf("cutover: %w", err)
+		}
+		if err := m.setOverride(userID, rec.TargetShard); err != nil {
+			return fmt.Errorf("cutover: %w", err)
+		}
+		cutoverAt := time.Now().Unix()
+		rec.CutoverAt = &cutoverAt
+		return m.updateStatus(rec, MigrationStatusCleanup, "")
+	}); err != nil {
+		return
+	}
+
+	// 移行元の削除。全ノードが切り替え後の上書きを読み直すのを待ち、
+	// 切り替えの後に移行元へ書き込まれていないことを確かめてから消す
+	if err := m.waitForNodes(rec); err != nil {
+		m.step(rec, MigrationStatusCleanup, func() error { return err }) //nolint:errcheck
+		return
+	}
+	if err := m.step(rec, MigrationStatusCleanup, func() error {
+		final, err := checksumUserData(src, userID)
+		if err != nil {
+			return fmt.Errorf("cleanup: %w", err)
+		}
+		if final != checksum {
+			return fmt.Errorf("cleanup: source rows changed after cutover")
+		}
+		if err := deleteUserRows(src, userID); err != nil {
+			return fmt.Errorf("cleanup: %w", err)
+		}
+		return m.updateStatus(rec, MigrationStatusCompleted, "")
+	}); err != nil {
+		return
+	}
+
+	m.setMigrating(userID, false)
+	m.clearAcks(rec)
+}
+
+// waitForNodes 生きている全ノードが移行の今の状態を読み直し、ロックを取らずに受けたリクエストを終えるのを待つ
+// 移行は状態を変えてから待つので、待っている間も全ノードがプライマリを読み直していれば確認は揃う
+func (m *shardMigrator) waitForNodes(rec *UserShardMigration) error {
+	query := "SELECT COUNT(*) FROM shard_routing_nodes n" +
+		" LEFT JOIN user_shard_migration_acks a ON a.node_id=n.node_id AND a.migration_id=? AND a.status=?" +
+		" WHERE n.refreshed_at >= UNIX_TIMESTAMP()-? AND a.node_id IS NULL"
+	deadline := time.Now().Add(time.Duration(migrationBarrierTimeoutSec) * time.Second)
+	for {
+		var waiting int
+		if err := m.h.DB.Get(&waiting, query, rec.ID, rec.Status, shardRoutingNodeStaleSec); err != nil {
+			return err
+		}
+		if waiting == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrMigrationBarrierTimeout
+		}
+		time.Sleep(time.Duration(shardRoutingRefreshIntervalMS) * time.Millisecond / 2)
+	}
+}
+
+// clearAcks 終わった移行の確認を削除する
+func (m *shardMigrator) clearAcks(rec *UserShardMigration) {
+	m.h.DB.Exec("DELETE FROM user_shard_migration_acks WHERE migration_id=?", rec.ID) //nolint:errcheck
+}
+
+// step ユーザのロックを取って移行を1段階進める。ロールバック等で状態が変わっていれば何もしない
+func (m *shardMigrator) step(rec *UserShardMigration, expected int, f func() error) error {
+	l, err := m.lock(rec.UserID)
+	if err != nil {
+		m.fail(rec, err)
+		return err
+	}
+	defer l.unlock()
+
+	var status int
+	if err := m.h.DB.Get(&status, "SELECT status FROM user_shard_migrations WHERE id=?", rec.ID); err != nil {
+		m.fail(rec, err)
+		return err
+	}
+	if status != expected {
+		return ErrMigrationInProgress
+	}
+	if err := f(); err != nil {
+		m.fail(rec, err)
+		return err
+	}
+	return nil
+}
+
+// rollback 移行をロールバック中にし、ユーザを移行元に戻す処理を非同期で始める
+func (m *shardMigrator) rollback(migrationID int64) (*UserShardMigration, error) {
+	rec, err := m.beginRollback(migrationID)
+	if err != nil || rec.Status == MigrationStatusRolledBack {
+		return rec, err
+	}
+
+	go m.finishRollback(*rec)
+
+	return rec, nil
+}
+
+// finishRollback ユーザを移行元に戻す。切り替え済みであれば移行先のデータを書き戻す
+func (m *shardMigrator) finishRollback(rec UserShardMigration) {
+	// 移行先に振り分けているノードがロックを取り始めるのを待つ
+	if err := m.waitForNodes(&rec); err != nil {
+		m.step(&rec, MigrationStatusRollingBack, func() error { return err }) //nolint:errcheck
+		return
+	}
+
+	src := m.h.Shards[rec.SourceShard]
+	dst := m.h.Shards[rec.TargetShard]
+	userID := rec.UserID
+
+	if err := m.step(&rec, MigrationStatusRollingBack, func() error {
+		shard, err := m.currentShard(userID)
+		if err != nil {
+			return fmt.Errorf("rollback: %w", err)
+		}
+		if shard == rec.TargetShard {
+			if _, err := syncUserRows(dst, src, userID); err != nil {
+				return fmt.Errorf("rollback: %w", err)
+			}
+			if err := verifyUserRows(dst, src, userID); err != nil {
+				return fmt.Errorf("rollback: %w", err)
+			}
+		}
+		if err := m.setOverride(userID, rec.SourceShard); err != nil {
+			return fmt.Errorf("rollback: %w", err)
+		}
+		if err := deleteUserRows(dst, userID); err != nil {
+			return fmt.Errorf("rollback: %w", err)
+		}
+		return m.updateStatus(&rec, MigrationStatusRolledBack, "")
+	}); err != nil {
+		return
+	}
+
+	m.setMigrating(userID, false)
+	m.clearAcks(&rec)
+}
+
+// beginRollback ロックを取って移行をロールバック中にする。ロールバック済みであればそのまま返す
+func (m *shardMigrator) beginRollback(migrationID int64) (*UserShardMigration, error) {
+	rec := new(UserShardMigration)
+	if err := m.h.DB.Get(rec, "SELECT * FROM user_shard_migrations WHERE id=?", migrationID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrMigrationNotFound
+		}
+		return nil, err
+	}
+	if rec.Status == MigrationStatusRolledBack {
+		return rec, nil
+	}
+
+	l, err := m.lock(rec.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+
+	// ロックを取るまでに状態が変わっている可能性がある
+	if err := m.h.DB.Get(rec, "SELECT * FROM user_shard_migrations WHERE id=?", migrationID); err != nil {
+		return nil, err
+	}
+	switch rec.Status {
+	case MigrationStatusRolledBack:
+		return rec, nil
+	// 初回コピー中はロックの外で移行先に書き込んでいるので待ってもらう
+	case MigrationStatusCopying, MigrationStatusRollingBack:
+		return nil, ErrMigrationInProgress
+	}
+	if running, err := m.countActive(rec.UserID, rec.ID); err != nil {
+		return nil, err
+	} else if running > 0 {
+		return nil, ErrMigrationInProgress
+	}
+	// 完了後に別のシャードへ移行されている場合は戻せない
+	if rec.Status == MigrationStatusCompleted {
+		shard, err := m.currentShard(rec.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if shard != rec.TargetShard {
+			return nil, ErrMigrationConflict
+		}
+	}
+
+	if err := m.updateStatus(rec, MigrationStatusRollingBack, ""); err != nil {
+		return nil, err
+	}
+	m.setMigrating(rec.UserID, true)
+	return rec, nil
+}
+
+// setOverride ユーザのシャードを上書きする。元のルーティングと同じであれば上書きを削除する
+func (m *shardMigrator) setOverride(userID int64, shard int) error {
+	now := time.Now().Unix()
+	if m.router.base.Shard(userID) == shard {
+		if _, err := m.h.DB.Exec("DELETE FROM user_shard_overrides WHERE user_id=?", userID); err != nil {
+			return err
+		}
+	} else {
+		query := "INSERT INTO user_shard_overrides(user_id, shard, created_at, updated_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE shard=VALUES(shard), updated_at=VALUES(updated_at)"
+		if _, err := m.h.DB.Exec(query, userID, shard, now, now); err != nil {
+			return err
+		}
+	}
+	m.router.set(userID, shard)
+	m.h.Sessions.DeleteUser(userID)
+	return nil
+}
+
+func (m *shardMigrator) updateStatus(rec *UserShardMigration, status int, message string) error {
+	rec.Status = status
+	rec.Message = message
+	rec.UpdatedAt = time.Now().Unix()
+
+	query := "UPDATE user_shard_migrations SET status=?, message=?, copied_rows=?, cutover_at=?, updated_at=? WHERE id=?"
+	_, err := m.h.DB.Exec(query, rec.Status, rec.Message, rec.CopiedRows, rec.CutoverAt, rec.UpdatedAt, rec.ID)
+	return err
+}
+
+// fail 移行を失敗にする。移行先のデータはロールバックまで残す
+func (m *shardMigrator) fail(rec *UserShardMigration, err error) {
+	m.updateStatus(rec, MigrationStatusFailed, err.Error()) //nolint:errcheck
+	m.setMigrating(rec.UserID, false)
+}
+
+// syncUserRows 移行元のユーザデータで移行先のユーザデータを置き換える
+func syncUserRows(src, dst *sqlx.DB, userID int64) (int64, error) {
+	srcTx, err := src.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer srcTx.Rollback() //nolint:errcheck
+
+	dstTx, err := dst.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer dstTx.Rollback() //nolint:errcheck
+
+	var copied int64
+	for _, t := range userShardTables {
+		records, err := readUserRows(srcTx, t, userID)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := dstTx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s=?", t.Name, t.UserColumn), userID); err != nil {
+			return 0, err
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		columns := make([]string, 0, len(records[0]))
+		for col := range records[0] {
+			columns = append(columns, col)
+		}
+		sort.Strings(columns)
+		query := fmt.Sprintf("INSERT INTO %s(`%s`) VALUES (:%s)", t.Name, strings.Join(columns, "`, `"), strings.Join(columns, ", :"))
+		for i := 0; i < len(records); i += migrationInsertChunkSize {
+			end := i + migrationInsertChunkSize
+			if end > len(records) {
+				end = len(records)
+			}
+			if _, err := dstTx.NamedExec(query, records[i:end]); err != nil {
+				return 0, err
+			}
+		}
+		copied += int64(len(records))
+	}
+
+	if err := dstTx.Commit(); err != nil {
+		return 0, err
+	}
+	return copied, nil
+}
+
+// readUserRows テーブルにあるユーザの行を全て読む
+func readUserRows(q sqlx.Queryer, t userShardTable, userID int64) ([]map[string]interface{}, error) {
+	rows, err := q.Queryx(fmt.Sprintf("SELECT * FROM %s WHERE %s=?", t.Name, t.UserColumn), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		r := map[string]interface{}{}
+		if err := rows.MapScan(r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// checksumUserRows 行の順序によらない行の中身のチェックサム
+func checksumUserRows(records []map[string]interface{}) string {
+	digests := make([]string, 0, len(records))
+	for _, r := range records {
+		columns := make([]string, 0, len(r))
+		for col := range r {
+			columns = append(columns, col)
+		}
+		sort.Strings(columns)
+
+		h := sha256.New()
+		for _, col := range columns {
+			switch v := r[col].(type) {
+			case nil:
+				fmt.Fprintf(h, "%s\x00N\x00", col)
+			case []byte:
+				fmt.Fprintf(h, "%s\x00V%s\x00", col, v)
+			default:
+				fmt.Fprintf(h, "%s\x00V%v\x00", col, v)
+			}
+		}
+		digests = append(digests, hex.EncodeToString(h.Sum(nil)))
+	}
+	sort.Strings(digests)
+
+	h := sha256.New()
+	for _, d := range digests {
+		h.Write([]byte(d)) //nolint:errcheck
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verifyUserRows 移行元と移行先でユーザデータの中身が一致するか確認する
+func verifyUserRows(src, dst *sqlx.DB, userID int64) error {
+	for _, t := range userShardTables {
+		srcRows, err := readUserRows(src, t, userID)
+		if err != nil {
+			return err
+		}
+		dstRows, err := readUserRows(dst, t, userID)
+		if err != nil {
+			return err
+		}
+		if len(srcRows) != len(dstRows) {
+			return fmt.Errorf("row count mismatch on %s: source=%d, target=%d", t.Name, len(srcRows), len(dstRows))
+		}
+		if checksumUserRows(srcRows) != checksumUserRows(dstRows) {
+			return fmt.Errorf("checksum mismatch on %s", t.Name)
+		}
+	}
+	return nil
+}
+
+// checksumUserData ユーザデータ全体のチェックサム
+func checksumUserData(db *sqlx.DB, userID int64) (string, error) {
+	h := sha256.New()
+	for _, t := range userShardTables {
+		records, err := readUserRows(db, t, userID)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00", t.Name, checksumUserRows(records))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// deleteUserRows ユーザデータを削除する
+func deleteUserRows(db *sqlx.DB, userID int64) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, t := range userShardTables {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s=?", t.Name, t.UserColumn), userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type UserShardMigration struct {
+	ID          int64  `json:"id" db:"id"`
+	UserID      int64  `json:"userId" db:"user_id"`
+	SourceShard int    `json:"sourceShard" db:"source_shard"`
+	TargetShard int    `json:"targetShard" db:"target_shard"`
+	Status      int    `json:"status" db:"status"`
+	Message     string `json:"message" db:"message"`
+	CopiedRows  int64  `json:"copiedRows" db:"copied_rows"`
+	CutoverAt   *int64 `json:"cutoverAt,omitempty" db:"cutover_at"`
+	CreatedAt   int64  `json:"createdAt" db:"created_at"`
+	UpdatedAt   int64  `json:"updatedAt" db:"updated_at"`
+}
+
+type UserShardOverride struct {
+	UserID    int64 `json:"userId" db:"user_id"`
+	Shard     int   `json:"shard" db:"shard"`
+	CreatedAt int64 `json:"createdAt" db:"created_at"`
+	UpdatedAt int64 `json:"updatedAt" db:"updated_at"`
+}
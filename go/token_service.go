@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TokenPurpose ワンタイムトークンの用途。user_one_time_tokens.token_typeに入る
+type TokenPurpose int
+
+const (
+	// TokenPurposeGacha ガチャを引く
+	TokenPurposeGacha TokenPurpose = 1
+	// TokenPurposeCardExp カードを強化する
+	TokenPurposeCardExp TokenPurpose = 2
+)
+
+// tokenPurposes 用途ごとの有効期限の環境変数
+var tokenPurposes = map[TokenPurpose]string{
+	TokenPurposeGacha:   "ISUCON_TOKEN_TTL_GACHA",
+	TokenPurposeCardExp: "ISUCON_TOKEN_TTL_CARD_EXP",
+}
+
+const (
+	// defaultTokenTTL 用途ごとの有効期限の初期値(秒)
+	defaultTokenTTL int64 = 600
+	// defaultTokenMaxLive 用途ごとにユーザが同時に持てるトークンの数の初期値
+	defaultTokenMaxLive int = 5
+)
+
+// TokenService ワンタイムトークンの発行と消費
+// 用途が違うトークンは互いに失効させないので、ガチャ画面とアイテム画面を並行して開いても両方使える
+type TokenService struct {
+	ttls map[TokenPurpose]int64
+	// maxLive 用途ごとに同時に有効なトークンの数。超えたら古いものから失効する
+	maxLive    int
+	generateID func() (int64, error)
+}
+
+// newTokenService 環境変数から有効期限を読んでTokenServiceを作る
+func newTokenService(generateID func() (int64, error)) (*TokenService, error) {
+	s := &TokenService{
+		ttls:       make(map[TokenPurpose]int64, len(tokenPurposes)),
+		maxLive:    defaultTokenMaxLive,
+		generateID: generateID,
+	}
+	for purpose, key := range tokenPurposes {
+		ttl, err := strconv.ParseInt(getEnv(key, strconv.FormatInt(defaultTokenTTL, 10)), 10, 64)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid %s: %s", key, getEnv(key, ""))
+		}
+		s.ttls[purpose] = ttl
+	}
+	maxLive, err := strconv.Atoi(getEnv("ISUCON_TOKEN_MAX_LIVE", strconv.Itoa(defaultTokenMaxLive)))
+	if err != nil || maxLive <= 0 {
+		return nil, fmt.Errorf("invalid ISUCON_TOKEN_MAX_LIVE: %s", getEnv("ISUCON_TOKEN_MAX_LIVE", ""))
+	}
+	s.maxLive = maxLive
+	return s, nil
+}
+
+// TTL 用途ごとの有効期限(秒)
+func (s *TokenService) TTL(purpose TokenPurpose) int64 {
+	if ttl, ok := s.ttls[purpose]; ok {
+		return ttl
+	}
+	return defaultTokenTTL
+}
+
+// Issue トークンを発行する
+// 同じ用途の有効なトークンがmaxLiveを超えた分と、期限切れのトークンは失効する
+func (s *TokenService) Issue(db *sqlx.DB, userID int64, purpose TokenPurpose, requestAt int64) (*UserOneTimeToken, error) {
+	tID, err := s.generateID()
+	if err != nil {
+		return nil, err
+	}
+	tk, err := generateULID()
+	if err != nil {
+		return nil, err
+	}
+	token := &UserOneTimeToken{
+		ID:        tID,
+		UserID:    userID,
+		Token:     tk,
+		TokenType: int(purpose),
+		CreatedAt: requestAt,
+		UpdatedAt: requestAt,
+		ExpiredAt: requestAt + s.TTL(purpose),
+	}
+	query := "INSERT INTO user_one_time_tokens(id, user_id, token, token_type, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	if _, err = db.Exec(query, token.ID, token.UserID, token.Token, token.TokenType, token.CreatedAt, token.UpdatedAt, token.ExpiredAt); err != nil {
+		return nil, err
+	}
+
+	if err = s.revokeStale(db, userID, purpose, requestAt); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// revokeStale 期限切れのトークンと、同じ用途で新しい方からmaxLive個より古いトークンを失効する
+func (s *TokenService) revokeStale(db *sqlx.DB, userID int64, purpose TokenPurpose, requestAt int64) error {
+	query := "UPDATE user_one_time_tokens SET deleted_at=?, updated_at=? WHERE user_id=? AND deleted_at IS NULL AND expired_at < ?"
+	if _, err := db.Exec(query, requestAt, requestAt, userID, requestAt); err != nil {
+		return err
+	}
+
+	ids := make([]int64, 0)
+	query = "SELECT id FROM user_one_time_tokens WHERE user_id=? AND token_type=? AND deleted_at IS NULL ORDER BY created_at DESC, id DESC"
+	if err := db.Select(&ids, query, userID, int(purpose)); err != nil {
+		return err
+	}
+	if len(ids) <= s.maxLive {
+		return nil
+	}
+	query, params, err := sqlx.In("UPDATE user_one_time_tokens SET deleted_at=?, updated_at=? WHERE id IN (?)", requestAt, requestAt, ids[s.maxLive:])
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(query, params...)
+	return err
+}
+
+// Consume トークンを使う。有効なら失効させ、使えなければErrInvalidTokenを返す
+// 確認と失効を1つの条件付きUPDATEで行うので、同じトークンを同時に使っても1回しか通らない
+func (s *TokenService) Consume(db *sqlx.DB, userID int64, token string, purpose TokenPurpose, requestAt int64) error {
+	query := "UPDATE user_one_time_tokens SET deleted_at=?, updated_at=?" +
+		" WHERE user_id=? AND token=? AND token_type=? AND deleted_at IS NULL AND expired_at >= ?"
+	res, err := db.Exec(query, requestAt, requestAt, userID, token, int(purpose), requestAt)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
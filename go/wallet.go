@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ISU-COINの増減の理由
+const (
+	CoinReasonGacha      int = 1
+	CoinReasonReward     int = 2
+	CoinReasonPresent    int = 3
+	CoinReasonLoginBonus int = 4
+	CoinReasonAdminGrant int = 5
+	CoinReasonCardSell   int = 6
+)
+
+// UserCoinTransaction ISU-COINの増減の記録
+type UserCoinTransaction struct {
+	ID     int64 `json:"id" db:"id"`
+	UserID int64 `json:"userId" db:"user_id"`
+	// Seq ユーザごとの1からの連番
+	Seq int64 `json:"seq" db:"seq"`
+	// Delta 増減。減らしたときは負
+	Delta        int64 `json:"delta" db:"delta"`
+	BalanceAfter int64 `json:"balanceAfter" db:"balance_after"`
+	Reason       int   `json:"reason" db:"reason"`
+	// RefID 増減の元になったもののID(ガチャの抽選IDなど)
+	RefID     *int64 `json:"refId,omitempty" db:"ref_id"`
+	CreatedAt int64  `json:"createdAt" db:"created_at"`
+}
+
+// debitCoins 残高が足りるときだけISU-COINを減らして記録し、減らした後の残高を返す
+// 残高の確認と減算を1つのUPDATEで行うので、同時に引かれても残高が負にならない
+func (h *Handler) debitCoins(tx *sqlx.Tx, userID int64, amount int64, reason int, refID *int64, requestAt int64) (int64, error) {
+	if amount <= 0 {
+		return getCoinBalance(tx, userID)
+	}
+
+	res, err := tx.Exec("UPDATE users SET isu_coin=isu_coin-? WHERE id=? AND isu_coin>=?", amount, userID, amount)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		if _, err := getCoinBalance(tx, userID); err != nil {
+			return 0, err
+		}
+		return 0, ErrNotEnoughCoin
+	}
+
+	return h.recordCoinTransaction(tx, userID, -amount, reason, refID, requestAt)
+}
+
+// creditCoins ISU-COINを増やして記録し、増やした後の残高を返す
+func (h *Handler) creditCoins(tx *sqlx.Tx, userID int64, amount int64, reason int, refID *int64, requestAt int64) (int64, error) {
+	if amount <= 0 {
+		return getCoinBalance(tx, userID)
+	}
+
+	res, err := tx.Exec("UPDATE users SET isu_coin=isu_coin+? WHERE id=?", amount, userID)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, ErrUserNotFound
+	}
+
+	return h.recordCoinTransaction(tx, userID, amount, reason, refID, requestAt)
+}
+
+// recordCoinTransaction 更新後の残高を読んで台帳に追記する
+// usersの行は直前のUPDATEでロックされているので、連番も残高も他と重ならない
+func (h *Handler) recordCoinTransaction(tx *sqlx.Tx, userID int64, delta int64, reason int, refID *int64, requestAt int64) (int64, error) {
+	balance, err := getCoinBalance(tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	var seq int64
+	if err = tx.Get(&seq, "SELECT COALESCE(MAX(seq), 0) + 1 FROM user_coin_transactions WHERE user_id=?", userID); err != nil {
+		return 0, err
+	}
+
+	tID, err := h.generateID()
+	if err != nil {
+		return 0, err
+	}
+	query := "INSERT INTO user_coin_transactions(id, user_id, seq, delta, balance_after, reason, ref_id, created_at)" +
+		" VALUES (:id, :user_id, :seq, :delta, :balance_after, :reason, :ref_id, :created_at)"
+	if _, err = tx.NamedExec(query, &UserCoinTransaction{
+		ID:           tID,
+		UserID:       userID,
+		Seq:          seq,
+		Delta:        delta,
+		BalanceAfter: balance,
+		Reason:       reason,
+		RefID:        refID,
+		CreatedAt:    requestAt,
+	}); err != nil {
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+// getCoinBalance ISU-COINの残高
+func getCoinBalance(tx *sqlx.Tx, userID int64) (int64, error) {
+	var balance int64
+	if err := tx.Get(&balance, "SELECT isu_coin FROM users WHERE id=?", userID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserNotFound
+		}
+		return 0, err
+	}
+	return balance, nil
+}
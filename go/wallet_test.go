@@ -0,0 +1,421 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// testUserPresentsSchema user_presentsは4_alldataで作られるのでテスト用に作る
+const testUserPresentsSchema = "DROP TABLE IF EXISTS `user_presents`;" +
+	"CREATE TABLE `user_presents` (" +
+	" `id` bigint NOT NULL," +
+	" `user_id` bigint NOT NULL," +
+	" `sent_at` bigint NOT NULL," +
+	" `item_type` int(1) NOT NULL," +
+	" `item_id` int NOT NULL," +
+	" `amount` int NOT NULL," +
+	" `present_message` varchar(255)," +
+	" `created_at` bigint NOT NULL," +
+	" `updated_at` bigint NOT NULL," +
+	" `deleted_at` bigint default NULL," +
+	" PRIMARY KEY (`id`)," +
+	" INDEX userid_idx (`user_id`)" +
+	") ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;"
+
+// openTestDB ISUCON_TEST_DB_HOSTのMySQLにスキーマを作り直して返す。設定が無ければスキップする
+// テーブルを全て作り直すので、ISUCON_TEST_DB_NAMEにはテスト専用のデータベースを指定する
+func openTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	host := os.Getenv("ISUCON_TEST_DB_HOST")
+	if host == "" {
+		t.Skip("ISUCON_TEST_DB_HOST is not set")
+	}
+	dsn := fmt.Sprintf(
+		"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=%s&multiStatements=true&interpolateParams=true",
+		getEnv("ISUCON_TEST_DB_USER", "isucon"),
+		getEnv("ISUCON_TEST_DB_PASSWORD", "isucon"),
+		host,
+		getEnv("ISUCON_TEST_DB_PORT", "3306"),
+		getEnv("ISUCON_TEST_DB_NAME", "isucon_test"),
+		"Asia%2FTokyo",
+	)
+	db, err := sqlx.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(64)
+	t.Cleanup(func() { db.Close() })
+
+	for _, f := range []string{"3_schema_exclude_user_presents.sql", "7_alter_master_tables.sql", "8_alter_user_tables.sql"} {
+		b, err := os.ReadFile(SQLDirectory + f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec(string(b)); err != nil {
+			t.Fatalf("failed to apply %s: %v", f, err)
+		}
+	}
+	if _, err = db.Exec(testUserPresentsSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// newTestHandler 1シャード構成のHandler
+func newTestHandler(t *testing.T, db *sqlx.DB) *Handler {
+	t.Helper()
+
+	t.Setenv("ISUCON_TOKEN_MAX_LIVE", "1000")
+	h := &Handler{
+		DB:          db,
+		Shards:      []*sqlx.DB{db},
+		Router:      newOverrideShardRouter(&tableShardRouter{table: []int{0}}),
+		Sessions:    &nopSessionStore{},
+		GachaSecret: []byte("test-secret"),
+	}
+	var err error
+	if h.Tokens, err = newTokenService(h.generateID); err != nil {
+		t.Fatal(err)
+	}
+	resetMasterStore()
+	t.Cleanup(resetMasterStore)
+	return h
+}
+
+// createTestUser ISU-COINを持ったユーザと端末を作る
+func createTestUser(t *testing.T, h *Handler, coins int64, requestAt int64) (int64, string) {
+	t.Helper()
+
+	userID, err := h.generateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := "INSERT INTO users(id, isu_coin, last_getreward_at, last_activated_at, registered_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	if _, err = h.DB.Exec(query, userID, coins, requestAt, requestAt, requestAt, requestAt, requestAt); err != nil {
+		t.Fatal(err)
+	}
+
+	deviceID, err := h.generateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerID := "viewer-" + strconv.FormatInt(userID, 10)
+	query = "INSERT INTO user_devices(id, user_id, platform_id, platform_type, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)"
+	if _, err = h.DB.Exec(query, deviceID, userID, viewerID, 1, requestAt, requestAt); err != nil {
+		t.Fatal(err)
+	}
+	return userID, viewerID
+}
+
+// assertCoinLedger 台帳の連番が欠けておらず、残高が負になったことがなく、openingに増減を足すとisu_coinになるか
+func assertCoinLedger(t *testing.T, db *sqlx.DB, userID int64, opening int64) []*UserCoinTransaction {
+	t.Helper()
+
+	var balance int64
+	if err := db.Get(&balance, "SELECT isu_coin FROM users WHERE id=?", userID); err != nil {
+		t.Fatal(err)
+	}
+	if balance < 0 {
+		t.Errorf("isu_coin is negative: %d", balance)
+	}
+
+	ledger := make([]*UserCoinTransaction, 0)
+	if err := db.Select(&ledger, "SELECT * FROM user_coin_transactions WHERE user_id=? ORDER BY seq ASC", userID); err != nil {
+		t.Fatal(err)
+	}
+	running := opening
+	for i, v := range ledger {
+		if v.Seq != int64(i+1) {
+			t.Errorf("seq %d at position %d", v.Seq, i)
+		}
+		running += v.Delta
+		if v.BalanceAfter != running {
+			t.Errorf("seq %d: balance_after=%d, expected %d", v.Seq, v.BalanceAfter, running)
+		}
+		if v.BalanceAfter < 0 {
+			t.Errorf("seq %d: balance went negative: %d", v.Seq, v.BalanceAfter)
+		}
+	}
+	if running != balance {
+		t.Errorf("opening %d + ledger deltas = %d, isu_coin = %d", opening, running, balance)
+	}
+	return ledger
+}
+
+func TestDebitCoinsNeverGoesNegative(t *testing.T) {
+	db := openTestDB(t)
+	h := newTestHandler(t, db)
+
+	const opening, amount, workers = 10000, 700, 40
+	userID, _ := createTestUser(t, h, opening, 1656000000)
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+	)
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx, err := db.Beginx()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer tx.Rollback() //nolint:errcheck
+
+			ref := int64(i)
+			if _, err = h.debitCoins(tx, userID, amount, CoinReasonGacha, &ref, 1656000000); err != nil {
+				if err != ErrNotEnoughCoin {
+					errs <- err
+				}
+				return
+			}
+			if err = tx.Commit(); err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			succeeded++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if want := opening / amount; succeeded != want {
+		t.Errorf("%d debits succeeded, expected %d", succeeded, want)
+	}
+	ledger := assertCoinLedger(t, db, userID, opening)
+	if len(ledger) != succeeded {
+		t.Errorf("%d ledger entries for %d debits", len(ledger), succeeded)
+	}
+}
+
+func TestCoinLedgerUnderConcurrentCreditsAndDebits(t *testing.T) {
+	db := openTestDB(t)
+	h := newTestHandler(t, db)
+
+	const opening = 5000
+	const credits, creditAmount = 30, 100
+	const debits, debitAmount = 60, 150
+	userID, _ := createTestUser(t, h, opening, 1656000000)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		debited int
+	)
+	errs := make(chan error, credits+debits)
+	for i := 0; i < credits+debits; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx, err := db.Beginx()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer tx.Rollback() //nolint:errcheck
+
+			isDebit := i%3 != 0
+			if isDebit {
+				_, err = h.debitCoins(tx, userID, debitAmount, CoinReasonGacha, nil, 1656000000)
+			} else {
+				_, err = h.creditCoins(tx, userID, creditAmount, CoinReasonReward, nil, 1656000000)
+			}
+			if err == ErrNotEnoughCoin {
+				return
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			if isDebit {
+				mu.Lock()
+				debited++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var balance int64
+	if err := db.Get(&balance, "SELECT isu_coin FROM users WHERE id=?", userID); err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(opening + credits*creditAmount - debited*debitAmount); balance != want {
+		t.Errorf("isu_coin=%d, expected %d", balance, want)
+	}
+	assertCoinLedger(t, db, userID, opening)
+}
+
+// callHandler ミドルウェアを通さずにハンドラを呼ぶ
+func callHandler(h echo.HandlerFunc, db *sqlx.DB, body string, requestAt int64, params map[string]string) *httptest.ResponseRecorder {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	for k, v := range params {
+		c.SetParamNames(append(c.ParamNames(), k)...)
+		c.SetParamValues(append(c.ParamValues(), v)...)
+	}
+	c.Set("db", db)
+	c.Set("requestTime", requestAt)
+	if err := h(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+func TestDrawGachaAndRewardKeepCoinLedger(t *testing.T) {
+	db := openTestDB(t)
+	h := newTestHandler(t, db)
+
+	const requestAt int64 = 1656000000
+	const opening, price = 20000, 1000
+	const draws, rewards = 40, 20
+
+	if _, err := db.Exec("INSERT INTO version_masters(id, status, master_version) VALUES (1, 1, '1')"); err != nil {
+		t.Fatal(err)
+	}
+	query := "INSERT INTO gacha_masters(id, name, start_at, end_at, display_order, created_at, price) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	if _, err := db.Exec(query, 1, "test", requestAt-3600, requestAt+3600, 1, requestAt, price); err != nil {
+		t.Fatal(err)
+	}
+	query = "INSERT INTO gacha_item_masters(id, gacha_id, item_type, item_id, amount, weight, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	for i, w := range []int{1, 10, 89} {
+		if _, err := db.Exec(query, i+1, 1, 3, i+1, 1, w, requestAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	userID, viewerID := createTestUser(t, h, opening, requestAt)
+	if _, err := db.Exec("UPDATE users SET last_getreward_at=? WHERE id=?", requestAt-1000, userID); err != nil {
+		t.Fatal(err)
+	}
+	cardIDs := make([]int64, 0, DeckCardNumber)
+	for i := 0; i < DeckCardNumber; i++ {
+		cID, _ := h.generateID()
+		query = "INSERT INTO user_cards(id, user_id, card_id, amount_per_sec, level, total_exp, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+		if _, err := db.Exec(query, cID, userID, 2+i, 1, 1, 0, requestAt, requestAt); err != nil {
+			t.Fatal(err)
+		}
+		cardIDs = append(cardIDs, cID)
+	}
+	deckID, _ := h.generateID()
+	query = "INSERT INTO user_decks(id, user_id, slot, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	if _, err := db.Exec(query, deckID, userID, 1, cardIDs[0], cardIDs[1], cardIDs[2], requestAt, requestAt); err != nil {
+		t.Fatal(err)
+	}
+
+	draw := func() *httptest.ResponseRecorder {
+		token, err := h.Tokens.Issue(db, userID, TokenPurposeGacha, requestAt)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		body := fmt.Sprintf(`{"viewerId":%q,"oneTimeToken":%q}`, viewerID, token.Token)
+		return callHandler(h.drawGacha, db, body, requestAt, map[string]string{
+			"userID":  strconv.FormatInt(userID, 10),
+			"gachaID": "1",
+			"n":       "1",
+		})
+	}
+
+	// ガチャの状態と天井カウンタの行を作っておく
+	if rec := draw(); rec == nil || rec.Code != http.StatusOK {
+		t.Fatalf("first draw failed: %v", rec)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		drawn     = 1
+		rewarded  int
+		conflicts int
+	)
+	unexpected := make(chan error, draws+rewards)
+	for i := 0; i < draws; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := draw()
+			if rec == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			switch rec.Code {
+			case http.StatusOK:
+				drawn++
+			case http.StatusConflict:
+				conflicts++
+			default:
+				unexpected <- errors.New(rec.Body.String())
+			}
+		}()
+	}
+	for i := 0; i < rewards; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := callHandler(h.reward, db, fmt.Sprintf(`{"viewerId":%q}`, viewerID), requestAt+int64(i), map[string]string{
+				"userID": strconv.FormatInt(userID, 10),
+			})
+			if rec.Code != http.StatusOK {
+				unexpected <- errors.New(rec.Body.String())
+				return
+			}
+			mu.Lock()
+			rewarded++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	close(unexpected)
+	for err := range unexpected {
+		t.Errorf("unexpected response: %v", err)
+	}
+
+	ledger := assertCoinLedger(t, db, userID, opening)
+	var gachaEntries, debited int64
+	for _, v := range ledger {
+		if v.Reason == CoinReasonGacha {
+			gachaEntries++
+			debited -= v.Delta
+		}
+	}
+	if gachaEntries != int64(drawn) || debited != int64(drawn*price) {
+		t.Errorf("%d draws succeeded, ledger has %d gacha entries debiting %d", drawn, gachaEntries, debited)
+	}
+	if rewarded != rewards {
+		t.Errorf("%d of %d rewards succeeded", rewarded, rewards)
+	}
+	t.Logf("draws=%d conflicts=%d rewards=%d", drawn, conflicts, rewarded)
+}
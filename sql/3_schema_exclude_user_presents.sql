@@ -34,10 +34,46 @@ DROP TABLE IF EXISTS `user_cards`;
 
 DROP TABLE IF EXISTS `item_masters`;
 
+DROP TABLE IF EXISTS `level_curve_masters`;
+
 DROP TABLE IF EXISTS `version_masters`;
 
 DROP TABLE IF EXISTS `admin_users`;
 
+DROP TABLE IF EXISTS `user_shard_overrides`;
+
+DROP TABLE IF EXISTS `user_session_revocations`;
+
+DROP TABLE IF EXISTS `user_shard_migrations`;
+
+DROP TABLE IF EXISTS `user_shard_migration_acks`;
+
+DROP TABLE IF EXISTS `shard_routing_nodes`;
+
+DROP TABLE IF EXISTS `master_version_activations`;
+
+DROP TABLE IF EXISTS `master_update_logs`;
+
+DROP TABLE IF EXISTS `master_histories`;
+
+DROP TABLE IF EXISTS `user_gacha_pities`;
+
+DROP TABLE IF EXISTS `user_gacha_draws`;
+
+DROP TABLE IF EXISTS `user_gacha_draw_items`;
+
+DROP TABLE IF EXISTS `user_gacha_states`;
+
+DROP TABLE IF EXISTS `user_gacha_box_items`;
+
+DROP TABLE IF EXISTS `user_coin_transactions`;
+
+DROP TABLE IF EXISTS `user_idempotency_keys`;
+
+DROP TABLE IF EXISTS `user_active_decks`;
+
+DROP TABLE IF EXISTS `user_deck_histories`;
+
 CREATE TABLE `users` (
   `id` bigint NOT NULL,
   `isu_coin` bigint NOT NULL default 0 comment '所持ISU-COIN',
@@ -215,6 +251,19 @@ CREATE TABLE `item_masters` (
   PRIMARY KEY (`id`)
 ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
 
+/* カードの必要経験値と生産性の成長曲線。item_masters.level_curve_idから参照する */
+CREATE TABLE `level_curve_masters` (
+  `id` bigint NOT NULL,
+  `name` varchar(128) NOT NULL,
+  `curve_type` int(1) NOT NULL comment '1:倍率 2:表 3:レベル帯ごとの倍率',
+  `exp_rate` int NOT NULL default 1200 comment '1:1レベルごとの必要経験値の倍率(1000で1倍)',
+  `exp_table` text NOT NULL comment '2:lv1 -> lv2から順に必要な累計経験値のカンマ区切り',
+  `exp_segments` varchar(255) NOT NULL default '' comment '3:「開始レベル:倍率」のカンマ区切り',
+  `amount_table` text NOT NULL comment 'lv2から順にレベルが上がったときの生産性の増分のカンマ区切り。空なら線形',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
 /*　マスタバージョンを管理するテーブル */
 CREATE TABLE `version_masters` (
   `id` bigint NOT NULL,
@@ -241,7 +290,7 @@ CREATE TABLE `user_one_time_tokens` (
   `id` bigint NOT NULL,
   `user_id` bigint NOT NULL,
   `token` varchar(36) NOT NULL,
-  `token_type` int(2) NOT NULL comment '1:ガチャ用、2:カード強化用',
+  `token_type` int(2) NOT NULL comment 'TokenPurpose。1:ガチャ用、2:カード強化用',
   `created_at` bigint NOT NULL,
   `updated_at` bigint NOT NULL,
   `expired_at` bigint NOT NULL,
@@ -273,3 +322,226 @@ CREATE TABLE `admin_users` (
   `deleted_at` bigint default NULL,
   PRIMARY KEY (`id`)
 ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* シャードの振り分けをユーザ単位で上書きする(プライマリのみ) */
+CREATE TABLE `user_shard_overrides` (
+  `user_id` bigint NOT NULL,
+  `shard` int NOT NULL comment 'シャードのインデックス(0始まり)',
+  `created_at` bigint NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`user_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* ログインやBANでユーザのセッションを無効化した記録。各ノードが読んでセッションディレクトリから消す(プライマリのみ) */
+CREATE TABLE `user_session_revocations` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `user_id` bigint NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* ユーザのシャード間移行(プライマリのみ) */
+CREATE TABLE `user_shard_migrations` (
+  `id` bigint NOT NULL,
+  `user_id` bigint NOT NULL,
+  `source_shard` int NOT NULL comment '移行元シャード',
+  `target_shard` int NOT NULL comment '移行先シャード',
+  `status` int(2) NOT NULL comment '1:コピー中、2:全ノードの待機中、3:切り替え中、4:移行元削除中、5:完了、6:失敗、7:ロールバック中、8:ロールバック済み',
+  `message` varchar(1024) NOT NULL default '',
+  `copied_rows` bigint NOT NULL default 0,
+  `cutover_at` bigint default NULL,
+  `created_at` bigint NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX user_id_idx (`user_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* 各ノードが移行の状態を読み直し、ロックを取らずに受けたリクエストを終えたことの確認(プライマリのみ) */
+CREATE TABLE `user_shard_migration_acks` (
+  `migration_id` bigint NOT NULL,
+  `status` int(2) NOT NULL comment '確認したuser_shard_migrationsのstatus',
+  `node_id` varchar(26) NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`migration_id`, `status`, `node_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* シャードの振り分けを読み直しているノード。移行はここで生きているノードの確認を待つ(プライマリのみ) */
+CREATE TABLE `shard_routing_nodes` (
+  `node_id` varchar(26) NOT NULL,
+  `refreshed_at` bigint NOT NULL comment '最後にプライマリを読み直した日時',
+  PRIMARY KEY (`node_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* マスタバージョン切り替えの予約(プライマリのみ) */
+CREATE TABLE `master_version_activations` (
+  `id` bigint NOT NULL,
+  `version_master_id` bigint NOT NULL comment '有効にするversion_mastersのID',
+  `master_version` varchar(128) NOT NULL,
+  `previous_master_version` varchar(128) NOT NULL default '' comment '切り替え前のマスタバージョン',
+  `activate_at` bigint NOT NULL comment '切り替え日時',
+  `grace_seconds` bigint NOT NULL default 0 comment '切り替え後に前のマスタバージョンを受け付ける秒数',
+  `status` int(2) NOT NULL comment '1:予約中、2:切り替え済み、3:取り消し、4:失敗、5:切り替え中',
+  `message` varchar(1024) NOT NULL default '',
+  `activated_at` bigint default NULL,
+  `created_at` bigint NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX status_activate_at_idx (`status`, `activate_at`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* 全シャードのマスタ更新(プライマリのみ) */
+CREATE TABLE `master_update_logs` (
+  `id` bigint NOT NULL,
+  `seq` bigint NOT NULL AUTO_INCREMENT comment '更新を始めた順の連番。履歴の時点はこの順で比べる',
+  `xid` varchar(64) NOT NULL comment 'XAトランザクションのID',
+  `status` int(2) NOT NULL comment '1:PREPARE中、2:コミット中、3:コミット済み、4:ロールバック済み、5:修復待ち',
+  `tables` varchar(1024) NOT NULL default '' comment '更新したテーブル',
+  `master_version` varchar(128) NOT NULL default '' comment '更新後に有効なマスタバージョン',
+  `previous_master_version` varchar(128) NOT NULL default '' comment '更新前に有効なマスタバージョン',
+  `rollback_to` varchar(128) NOT NULL default '' comment 'ロールバックの戻し先のマスタバージョン',
+  `committed_shards` varchar(255) NOT NULL default '' comment 'コミット済みのシャード',
+  `message` varchar(1024) NOT NULL default '',
+  `created_at` bigint NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE uniq_seq (`seq`),
+  INDEX status_idx (`status`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* マスタの行ごとの変更履歴(プライマリのみ) */
+CREATE TABLE `master_histories` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `update_id` bigint NOT NULL comment 'master_update_logsのID',
+  `update_seq` bigint NOT NULL comment 'master_update_logsのseq',
+  `master_version` varchar(128) NOT NULL comment '更新後に有効なマスタバージョン',
+  `table_name` varchar(64) NOT NULL,
+  `row_id` bigint NOT NULL,
+  `before_data` json default NULL comment '変更前の行。追加ではNULL',
+  `after_data` json default NULL comment '変更後の行。削除ではNULL',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX table_update_seq_idx (`table_name`, `update_seq`),
+  INDEX update_id_idx (`update_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* ガチャの天井カウンタ */
+CREATE TABLE `user_gacha_pities` (
+  `user_id` bigint NOT NULL,
+  `gacha_id` bigint NOT NULL,
+  `draws_since_rare` int NOT NULL default 0 comment '最後にレアが出てから引いた回数',
+  `total_draws` bigint NOT NULL default 0,
+  `last_rare_at` bigint default NULL,
+  `created_at` bigint NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`user_id`, `gacha_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* ガチャの抽選記録。シードと抽選時のマスタから結果を再現できる */
+CREATE TABLE `user_gacha_draws` (
+  `id` bigint NOT NULL,
+  `user_id` bigint NOT NULL,
+  `gacha_id` bigint NOT NULL,
+  `draw_count` int NOT NULL,
+  `consumed_coin` bigint NOT NULL default 0 comment '消費したISU-COIN',
+  `cost_item_id` bigint default NULL comment 'ガチャチケットなどで引いた場合に消費したアイテム',
+  `consumed_item` bigint NOT NULL default 0,
+  `is_free` tinyint(1) NOT NULL default 0 comment '1日1回の無料で引いたか',
+  `seed` varchar(64) NOT NULL comment 'HMAC-SHA256(秘密鍵, 抽選ID)の16進',
+  `snapshot` json NOT NULL comment '抽選時のガチャ、排出アイテム、天井カウンタ',
+  `result` json NOT NULL comment '排出されたガチャアイテムマスタのID',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX user_created_idx (`user_id`, `created_at`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* ガチャの抽選記録の1回ごとの排出結果 */
+CREATE TABLE `user_gacha_draw_items` (
+  `draw_id` bigint NOT NULL comment 'user_gacha_drawsのID',
+  `seq` int NOT NULL comment '何回目の抽選か(0から)',
+  `user_id` bigint NOT NULL,
+  `gacha_item_id` bigint NOT NULL,
+  `item_type` int(1) NOT NULL,
+  `item_id` int NOT NULL,
+  `amount` int NOT NULL,
+  `present_id` bigint NOT NULL comment '付与したプレゼント',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`draw_id`, `seq`),
+  INDEX user_created_idx (`user_id`, `created_at`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* ステップアップガチャ、ボックスガチャ、1日あたりの回数のユーザごとの状態 */
+CREATE TABLE `user_gacha_states` (
+  `user_id` bigint NOT NULL,
+  `gacha_id` bigint NOT NULL,
+  `step` int NOT NULL default 1 comment '次に引くステップ(1から)',
+  `step_loops` int NOT NULL default 0 comment '最後のステップから1に戻った回数',
+  `box_resets` int NOT NULL default 0 comment 'ボックスをリセットした回数',
+  `daily_draws` int NOT NULL default 0 comment 'last_drawn_atの日に引いた回数',
+  `daily_free_drawn` tinyint(1) NOT NULL default 0 comment 'last_drawn_atの日に無料の1回を使ったか',
+  `last_drawn_at` bigint default NULL,
+  `created_at` bigint NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`user_id`, `gacha_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* ボックスガチャの排出アイテムごとに引いた数 */
+CREATE TABLE `user_gacha_box_items` (
+  `user_id` bigint NOT NULL,
+  `gacha_id` bigint NOT NULL,
+  `gacha_item_id` bigint NOT NULL,
+  `drawn` int NOT NULL default 0,
+  `created_at` bigint NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`user_id`, `gacha_id`, `gacha_item_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* ISU-COINの増減の記録。追記のみ */
+CREATE TABLE `user_coin_transactions` (
+  `id` bigint NOT NULL,
+  `user_id` bigint NOT NULL,
+  `seq` bigint NOT NULL comment 'ユーザごとの1からの連番',
+  `delta` bigint NOT NULL comment '増減。減らしたときは負',
+  `balance_after` bigint NOT NULL,
+  `reason` int NOT NULL comment '1:ガチャ 2:報酬 3:プレゼント 4:ログインボーナス 5:管理者による付与 6:カード売却',
+  `ref_id` bigint default NULL comment '増減の元になったもののID',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE uniq_user_seq (`user_id`, `seq`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* 冪等キーと、そのキーで処理したリクエストのレスポンス */
+CREATE TABLE `user_idempotency_keys` (
+  `user_id` bigint NOT NULL,
+  `idempotency_key` varchar(255) NOT NULL,
+  `request_hash` char(64) NOT NULL comment 'メソッド、パス、ボディのsha256',
+  `status_code` int default NULL comment '処理中ならNULL',
+  `content_type` varchar(255) default NULL,
+  `response_body` mediumblob default NULL,
+  `created_at` bigint NOT NULL,
+  `expired_at` bigint NOT NULL,
+  PRIMARY KEY (`user_id`, `idempotency_key`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* 報酬とホームの生産性に使うデッキの枠。行が無ければ1枠目 */
+CREATE TABLE `user_active_decks` (
+  `user_id` bigint NOT NULL,
+  `slot` int NOT NULL comment 'user_decks.slot',
+  `created_at` bigint NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`user_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+/* デッキを保存するたびに追記する編成の記録 */
+CREATE TABLE `user_deck_histories` (
+  `id` bigint NOT NULL,
+  `user_id` bigint NOT NULL,
+  `deck_id` bigint NOT NULL comment 'user_decks.id',
+  `slot` int NOT NULL,
+  `name` varchar(64) NOT NULL,
+  `user_card_id_1` bigint NOT NULL,
+  `user_card_id_2` bigint NOT NULL,
+  `user_card_id_3` bigint NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX idx_user_id (`user_id`, `created_at`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
@@ -0,0 +1,49 @@
+/* 4_alldataで作られるマスタテーブルに後から追加した列 */
+
+/* ガチャの天井 */
+ALTER TABLE `gacha_masters`
+  ADD COLUMN `pity_draws` int NOT NULL default 0 comment '天井。この回数目までにレアが出なければレア確定。0は天井なし',
+  ADD COLUMN `multi_draw_guarantee` tinyint(1) NOT NULL default 0 comment '複数回引きでレアを1つ確定にするか';
+
+ALTER TABLE `gacha_item_masters`
+  ADD COLUMN `is_rare` tinyint(1) NOT NULL default 0 comment '天井と確定枠で排出されるか';
+
+/* ガチャの価格と通貨 */
+ALTER TABLE `gacha_masters`
+  ADD COLUMN `cost_item_type` int(1) NOT NULL default 1 comment '引くのに使う通貨。1はISU-COIN、それ以外はcost_item_idのアイテム',
+  ADD COLUMN `cost_item_id` bigint NOT NULL default 0,
+  ADD COLUMN `price` int NOT NULL default 1000 comment '1回あたりの価格',
+  ADD COLUMN `draw_counts` varchar(64) NOT NULL default '1,10' comment '1度に引ける回数のカンマ区切り',
+  ADD COLUMN `multi_draw_discount` int NOT NULL default 0 comment '2回以上まとめて引いたときの割引率(%)';
+
+/* ステップアップガチャとボックスガチャ */
+ALTER TABLE `gacha_masters`
+  ADD COLUMN `gacha_type` int(1) NOT NULL default 1 comment '1:通常 2:ステップアップ 3:ボックス',
+  ADD COLUMN `step_prices` varchar(255) NOT NULL default '' comment 'ステップアップガチャのステップごとの1回あたりの価格のカンマ区切り';
+
+ALTER TABLE `gacha_item_masters`
+  ADD COLUMN `step` int NOT NULL default 0 comment 'ステップアップガチャで排出されるステップ。0は全ステップ',
+  ADD COLUMN `stock` int NOT NULL default 0 comment 'ボックスガチャでのユーザごとの在庫';
+
+/* 1日あたりの回数制限と無料の1回 */
+ALTER TABLE `gacha_masters`
+  ADD COLUMN `daily_draw_limit` int NOT NULL default 0 comment '1ユーザが1日に引ける回数。0は制限なし',
+  ADD COLUMN `daily_free_draw` tinyint(1) NOT NULL default 0 comment '1日1回、単発を無料で引けるか';
+
+/* カードの限界突破 */
+ALTER TABLE `item_masters`
+  ADD COLUMN `limit_break_max` int NOT NULL default 0 comment '限界突破できる段階数。0は限界突破なし',
+  ADD COLUMN `limit_break_levels` int NOT NULL default 0 comment '1段階ごとに上がる最高レベル',
+  ADD COLUMN `limit_break_amount_per_sec` int NOT NULL default 0 comment '1段階ごとに上がるlv maxのときの生産性',
+  ADD COLUMN `limit_break_item_id` bigint NOT NULL default 0 comment '同じカードの代わりに使える素材アイテム。0は素材なし',
+  ADD COLUMN `limit_break_item_amount` int NOT NULL default 1 comment '1段階に必要な素材アイテムの数';
+
+/* カードの成長曲線 */
+ALTER TABLE `item_masters`
+  ADD COLUMN `level_curve_id` bigint NOT NULL default 0 comment 'level_curve_masters.id。0は必要経験値が前のレベルの1.2倍で生産性が線形の既定の曲線';
+
+/* カードの売却 */
+ALTER TABLE `item_masters`
+  ADD COLUMN `sell_price` int NOT NULL default 0 comment '売却したときのISU-COIN',
+  ADD COLUMN `sell_item_id` bigint NOT NULL default 0 comment '売却したときにもらえる強化素材。0はなし',
+  ADD COLUMN `sell_item_amount` int NOT NULL default 0 comment '売却したときにもらえる強化素材の数';
@@ -0,0 +1,14 @@
+/* 4_alldataで作られるユーザのテーブルに後から追加した列 */
+
+/* カードの限界突破 */
+ALTER TABLE `user_cards`
+  ADD COLUMN `limit_break` int NOT NULL default 0 comment '限界突破した段階';
+
+/* デッキの枠。既存のデッキは1枠目になる */
+/* NULLは一意制約で重複扱いにならないので、削除されていない行だけslotを持つlive_slotで1枠1行にする */
+ALTER TABLE `user_decks`
+  ADD COLUMN `slot` int NOT NULL default 1 comment 'デッキの枠(1から)',
+  ADD COLUMN `name` varchar(64) NOT NULL default '' comment 'デッキ名',
+  ADD COLUMN `live_slot` int AS (IF(`deleted_at` IS NULL, `slot`, NULL)) VIRTUAL INVISIBLE comment '削除されていない行の枠',
+  DROP INDEX uniq_user_id,
+  ADD UNIQUE uniq_user_live_slot (`user_id`, `live_slot`);